@@ -0,0 +1,714 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+
+	AdminListDefaultLimit = 50
+	BanReasonMaxLength    = 255
+	StopReasonMaxLength   = 255
+
+	CSRFTokenHeader = "X-CSRF-Token"
+
+	BannedErrMsg = "このアカウントは利用停止されています"
+)
+
+// adminToken is ISUCARI_ADMIN_TOKEN; empty disables bearer access.
+var adminToken string
+
+var (
+	roleRanks    = map[string]int{RoleUser: 0, RoleModerator: 1, RoleAdmin: 2}
+	itemStatuses = []string{ItemStatusOnSale, ItemStatusTrading, ItemStatusSoldOut, ItemStatusStop, ItemStatusCancel}
+
+	ErrTradeItemForceStopped = &TradeError{http.StatusForbidden, "運営により出品停止された商品です"}
+)
+
+type adminContextKey struct{}
+
+// statuses of users in the audit log
+const (
+	UserStatusActive = "active"
+	UserStatusBanned = "banned"
+)
+
+func userBanStatus(u User) string {
+	if u.BannedAt != nil {
+		return UserStatusBanned
+	}
+	return UserStatusActive
+}
+
+// AdminActor is who calls the admin API: a signed in moderator or admin, or
+// the holder of ISUCARI_ADMIN_TOKEN, whose UserID is 0.
+type AdminActor struct {
+	UserID int64
+	Role   string
+}
+
+func requestAdminActor(r *http.Request) AdminActor {
+	a, _ := r.Context().Value(adminContextKey{}).(AdminActor)
+	return a
+}
+
+// withRole lets a request through with the bearer admin token, or with the
+// session of a user whose role is at least role. Session requests that change
+// anything must carry the CSRF token in the X-CSRF-Token header, since admin
+// request bodies have no csrf_token.
+func withRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor := AdminActor{}
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			if adminToken == "" || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(adminToken)) != 1 {
+				outputErrorMsg(w, http.StatusUnauthorized, "invalid admin token")
+				return
+			}
+			actor.Role = RoleAdmin
+		} else {
+			user, errCode, errMsg := getUser(r)
+			if errMsg != "" {
+				outputErrorMsg(w, errCode, errMsg)
+				return
+			}
+			if roleRanks[user.Role] < roleRanks[role] {
+				outputErrorMsg(w, http.StatusForbidden, "権限がありません")
+				return
+			}
+			if r.Method != http.MethodGet {
+				csrfToken := getCSRFToken(r)
+				if csrfToken == "" || r.Header.Get(CSRFTokenHeader) != csrfToken {
+					outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+					return
+				}
+			}
+			actor.UserID = user.ID
+			actor.Role = user.Role
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), adminContextKey{}, actor)))
+	}
+}
+
+type adminUser struct {
+	ID           int64  `json:"id"`
+	AccountName  string `json:"account_name"`
+	Address      string `json:"address"`
+	NumSellItems int    `json:"num_sell_items"`
+	Role         string `json:"role"`
+	BannedAt     int64  `json:"banned_at,omitempty"`
+	BanReason    string `json:"ban_reason,omitempty"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+func newAdminUser(u User) adminUser {
+	au := adminUser{
+		ID:           u.ID,
+		AccountName:  u.AccountName,
+		Address:      u.Address,
+		NumSellItems: u.NumSellItems,
+		Role:         u.Role,
+		BanReason:    u.BanReason,
+		CreatedAt:    u.CreatedAt.Unix(),
+	}
+	if u.BannedAt != nil {
+		au.BannedAt = u.BannedAt.Unix()
+	}
+	return au
+}
+
+type adminItem struct {
+	Item
+	StopReason string `json:"stop_reason,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+}
+
+func newAdminItem(item Item) adminItem {
+	return adminItem{
+		Item:       item,
+		StopReason: item.StopReason,
+		CreatedAt:  item.CreatedAt.Unix(),
+		UpdatedAt:  item.UpdatedAt.Unix(),
+	}
+}
+
+type resAdminUsers struct {
+	Users      []adminUser `json:"users"`
+	HasNext    bool        `json:"has_next"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+type resAdminItems struct {
+	Items      []adminItem `json:"items"`
+	HasNext    bool        `json:"has_next"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+type resAdminTrade struct {
+	Item                adminItem            `json:"item"`
+	Seller              *adminUser           `json:"seller"`
+	Buyer               *adminUser           `json:"buyer,omitempty"`
+	TransactionEvidence *TransactionEvidence `json:"transaction_evidence,omitempty"`
+	Shipping            *Shipping            `json:"shipping,omitempty"`
+	Payments            []Payment            `json:"payments"`
+	Cancellations       []TradeCancellation  `json:"cancellations"`
+}
+
+type reqAdminReason struct {
+	Reason string `json:"reason"`
+}
+
+type reqAdminRole struct {
+	Role string `json:"role"`
+}
+
+// escapeLike escapes the wildcards of LIKE in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// getAdminUsers searches users by id or account name prefix, newest first.
+func getAdminUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, err := parsePage(query, "admin/users", AdminListDefaultLimit)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	if q := query.Get("q"); q != "" {
+		if id, err := strconv.ParseInt(q, 10, 64); err == nil {
+			conds = append(conds, "(`id` = ? OR `account_name` LIKE ?)")
+			args = append(args, id, escapeLike(q)+"%")
+		} else {
+			conds = append(conds, "`account_name` LIKE ?")
+			args = append(args, escapeLike(q)+"%")
+		}
+	}
+	if v := query.Get("role"); v != "" {
+		if _, ok := roleRanks[v]; !ok {
+			outputErrorMsg(w, http.StatusBadRequest, "role param error")
+			return
+		}
+		conds = append(conds, "`role` = ?")
+		args = append(args, v)
+	}
+	switch query.Get("banned") {
+	case "":
+	case "true":
+		conds = append(conds, "`banned_at` IS NOT NULL")
+	case "false":
+		conds = append(conds, "`banned_at` IS NULL")
+	default:
+		outputErrorMsg(w, http.StatusBadRequest, "banned param error")
+		return
+	}
+	if page.Cursor != nil {
+		conds = append(conds, "`id` < ?")
+		args = append(args, page.Cursor.ID)
+	}
+	args = append(args, page.Limit+1)
+
+	users := []User{}
+	err = dbx.Select(&users, "SELECT * FROM `users` WHERE "+strings.Join(conds, " AND ")+" ORDER BY `id` DESC LIMIT ?", args...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resAdminUsers{Users: []adminUser{}}
+	if len(users) > page.Limit {
+		users = users[:page.Limit]
+		res.HasNext = true
+		res.NextCursor = page.NextCursor(Cursor{ID: users[page.Limit-1].ID})
+	}
+	for _, u := range users {
+		res.Users = append(res.Users, newAdminUser(u))
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// getAdminItems searches items by name, status and seller, newest first.
+func getAdminItems(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, err := parsePage(query, "admin/items", AdminListDefaultLimit)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	if q := query.Get("q"); q != "" {
+		conds = append(conds, "`name` LIKE ?")
+		args = append(args, "%"+escapeLike(q)+"%")
+	}
+	if v := query.Get("status"); v != "" {
+		statuses := strings.Split(v, ",")
+		for _, status := range statuses {
+			if !containsStatus(itemStatuses, status) {
+				outputErrorMsg(w, http.StatusBadRequest, "status param error")
+				return
+			}
+		}
+		conds = append(conds, "`status` IN (?)")
+		args = append(args, statuses)
+	}
+	if v := query.Get("seller_id"); v != "" {
+		sellerID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sellerID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "seller_id param error")
+			return
+		}
+		conds = append(conds, "`seller_id` = ?")
+		args = append(args, sellerID)
+	}
+	if page.Cursor != nil {
+		conds = append(conds, "`id` < ?")
+		args = append(args, page.Cursor.ID)
+	}
+	args = append(args, page.Limit+1)
+
+	inQuery, inArgs, err := sqlx.In("SELECT * FROM `items` WHERE "+strings.Join(conds, " AND ")+" ORDER BY `id` DESC LIMIT ?", args...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []Item{}
+	err = dbx.Select(&items, inQuery, inArgs...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resAdminItems{Items: []adminItem{}}
+	if len(items) > page.Limit {
+		items = items[:page.Limit]
+		res.HasNext = true
+		res.NextCursor = page.NextCursor(Cursor{ID: items[page.Limit-1].ID})
+	}
+	for _, item := range items {
+		res.Items = append(res.Items, newAdminItem(item))
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// postAdminStopItem withdraws a listing. The seller sees the reason and
+// cannot resume it.
+func postAdminStopItem(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect item id")
+		return
+	}
+
+	rar := reqAdminReason{}
+	err = json.NewDecoder(r.Body).Decode(&rar)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+	if rar.Reason == "" || utf8.RuneCountInString(rar.Reason) > StopReasonMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "reason param error")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, err := lockTrade(tx, itemID)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	err = applyStop(tx, TradeStop, st, TradeRoleSystem, adminAuditActor(r))
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("UPDATE `items` SET `stop_reason` = ? WHERE `id` = ?", rar.Reason, itemID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	st.Item.StopReason = rar.Reason
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	invalidateUser(st.Item.SellerID)
+	searchIndex.Put(st.Item)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newAdminItem(st.Item))
+}
+
+// postAdminResumeItem puts a stopped listing back on sale, whoever stopped it.
+func postAdminResumeItem(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect item id")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, err := lockTrade(tx, itemID)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	err = applyStop(tx, TradeResume, st, TradeRoleSystem, adminAuditActor(r))
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	invalidateUser(st.Item.SellerID)
+	searchIndex.Put(st.Item)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newAdminItem(st.Item))
+}
+
+// postAdminBanUser blocks the user from signing in and drops every session
+// they have. Admins cannot be banned; demote them first.
+func postAdminBanUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(pat.Param(r, "user_id"), 10, 64)
+	if err != nil || userID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect user id")
+		return
+	}
+
+	rar := reqAdminReason{}
+	err = json.NewDecoder(r.Body).Decode(&rar)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+	if rar.Reason == "" || utf8.RuneCountInString(rar.Reason) > BanReasonMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "reason param error")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	user := User{}
+	err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", userID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "user not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if user.Role == RoleAdmin {
+		outputErrorMsg(w, http.StatusForbidden, "admins cannot be banned")
+		tx.Rollback()
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE `users` SET `banned_at` = ?, `ban_reason` = ? WHERE `id` = ?", now, rar.Reason, userID)
+	if err == nil {
+		err = writeAudit(tx, adminAuditActor(r), AuditEvent{
+			Action:       "ban",
+			EntityType:   AuditEntityUser,
+			EntityID:     userID,
+			UserID:       userID,
+			StatusBefore: userBanStatus(user),
+			StatusAfter:  UserStatusBanned,
+		}, map[string]string{"reason": rar.Reason})
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	user.BannedAt = &now
+	user.BanReason = rar.Reason
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	invalidateUser(userID)
+
+	// getUser refuses banned users anyway; this also covers the sessions of
+	// a user who gets unbanned later
+	if backend, ok := sessionBackend(); ok {
+		err = backend.DeleteByUser(userID)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newAdminUser(user))
+}
+
+func postAdminUnbanUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(pat.Param(r, "user_id"), 10, 64)
+	if err != nil || userID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect user id")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	user := User{}
+	err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", userID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "user not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("UPDATE `users` SET `banned_at` = NULL, `ban_reason` = '' WHERE `id` = ?", userID)
+	if err == nil {
+		err = writeAudit(tx, adminAuditActor(r), AuditEvent{
+			Action:       "unban",
+			EntityType:   AuditEntityUser,
+			EntityID:     userID,
+			UserID:       userID,
+			StatusBefore: userBanStatus(user),
+			StatusAfter:  UserStatusActive,
+		}, nil)
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	user.BannedAt = nil
+	user.BanReason = ""
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	invalidateUser(userID)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newAdminUser(user))
+}
+
+func putAdminUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(pat.Param(r, "user_id"), 10, 64)
+	if err != nil || userID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect user id")
+		return
+	}
+
+	rar := reqAdminRole{}
+	err = json.NewDecoder(r.Body).Decode(&rar)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+	if _, ok := roleRanks[rar.Role]; !ok {
+		outputErrorMsg(w, http.StatusBadRequest, "role param error")
+		return
+	}
+	if actor := requestAdminActor(r); actor.UserID == userID && rar.Role != RoleAdmin {
+		outputErrorMsg(w, http.StatusForbidden, "you cannot demote yourself")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	user := User{}
+	err = tx.Get(&user, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", userID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "user not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("UPDATE `users` SET `role` = ? WHERE `id` = ?", rar.Role, userID)
+	if err == nil {
+		err = writeAudit(tx, adminAuditActor(r), AuditEvent{
+			Action:       "change_role",
+			EntityType:   AuditEntityUser,
+			EntityID:     userID,
+			UserID:       userID,
+			StatusBefore: user.Role,
+			StatusAfter:  rar.Role,
+		}, nil)
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	user.Role = rar.Role
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	invalidateUser(userID)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newAdminUser(user))
+}
+
+// getAdminTrade shows everything recorded about the trade of an item,
+// including the payment saga and cancellations.
+func getAdminTrade(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect item id")
+		return
+	}
+
+	item := Item{}
+	err = dbx.Get(&item, "SELECT * FROM `items` WHERE `id` = ?", itemID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resAdminTrade{
+		Item:          newAdminItem(item),
+		Payments:      []Payment{},
+		Cancellations: []TradeCancellation{},
+	}
+
+	userIDs := []int64{item.SellerID}
+	if item.BuyerID != 0 {
+		userIDs = append(userIDs, item.BuyerID)
+	}
+	inQuery, inArgs, err := sqlx.In("SELECT * FROM `users` WHERE `id` IN (?)", userIDs)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	users := []User{}
+	err = dbx.Select(&users, inQuery, inArgs...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for _, u := range users {
+		au := newAdminUser(u)
+		if u.ID == item.SellerID {
+			res.Seller = &au
+		}
+		if u.ID == item.BuyerID {
+			res.Buyer = &au
+		}
+	}
+
+	transactionEvidence := TransactionEvidence{}
+	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ?", itemID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err == nil {
+		res.TransactionEvidence = &transactionEvidence
+
+		shipping := Shipping{}
+		err = dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidence.ID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		if err == nil {
+			res.Shipping = &shipping
+		}
+	}
+
+	err = dbx.Select(&res.Payments, "SELECT * FROM `payments` WHERE `item_id` = ? ORDER BY `id`", itemID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	err = dbx.Select(&res.Cancellations, "SELECT * FROM `trade_cancellations` WHERE `item_id` = ? ORDER BY `id`", itemID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
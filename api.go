@@ -6,14 +6,28 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 const (
 	IsucariAPIToken = "Bearer 75ugk2m37a750fwir5xr-22l6h4wmue1bwrubzwd0"
 
 	userAgent = "isucon9-qualify-webapp"
+
+	PaymentStatusOK      = "ok"
+	PaymentStatusFail    = "fail"
+	PaymentStatusInvalid = "invalid"
+
+	PaymentRefundStatusOK       = "ok"
+	PaymentRefundStatusNotFound = "not_found"
+
+	// well under PaymentPendingTimeout, so a buy waiting on the services
+	// gives up before the compensator sweeps its payment
+	ExternalServiceTimeout = 10 * time.Second
 )
 
+var apiClient = &http.Client{Timeout: ExternalServiceTimeout}
+
 type APIPaymentServiceTokenReq struct {
 	ShopID string `json:"shop_id"`
 	Token  string `json:"token"`
@@ -50,6 +64,75 @@ type APIShipmentStatusReq struct {
 	ReserveID string `json:"reserve_id"`
 }
 
+type APIPaymentServiceRefundReq struct {
+	ShopID string `json:"shop_id"`
+	Token  string `json:"token"`
+	APIKey string `json:"api_key"`
+	Price  int    `json:"price"`
+}
+
+type APIPaymentServiceRefundRes struct {
+	Status string `json:"status"`
+}
+
+type APIShipmentCancelReq struct {
+	ReserveID string `json:"reserve_id"`
+}
+
+type PaymentService interface {
+	Token(param *APIPaymentServiceTokenReq) (*APIPaymentServiceTokenRes, error)
+	Refund(param *APIPaymentServiceRefundReq) (*APIPaymentServiceRefundRes, error)
+}
+
+type ShipmentService interface {
+	Create(param *APIShipmentCreateReq) (*APIShipmentCreateRes, error)
+	Request(param *APIShipmentRequestReq) ([]byte, error)
+	Status(param *APIShipmentStatusReq) (*APIShipmentStatusRes, error)
+	Cancel(param *APIShipmentCancelReq) error
+}
+
+// httpPaymentService resolves the service URL on every call because
+// /initialize can change it at runtime.
+type httpPaymentService struct {
+	url func() string
+}
+
+func NewHTTPPaymentService(url func() string) PaymentService {
+	return &httpPaymentService{url: url}
+}
+
+func (s *httpPaymentService) Token(param *APIPaymentServiceTokenReq) (*APIPaymentServiceTokenRes, error) {
+	return APIPaymentToken(s.url(), param)
+}
+
+func (s *httpPaymentService) Refund(param *APIPaymentServiceRefundReq) (*APIPaymentServiceRefundRes, error) {
+	return APIPaymentRefund(s.url(), param)
+}
+
+type httpShipmentService struct {
+	url func() string
+}
+
+func NewHTTPShipmentService(url func() string) ShipmentService {
+	return &httpShipmentService{url: url}
+}
+
+func (s *httpShipmentService) Create(param *APIShipmentCreateReq) (*APIShipmentCreateRes, error) {
+	return APIShipmentCreate(s.url(), param)
+}
+
+func (s *httpShipmentService) Request(param *APIShipmentRequestReq) ([]byte, error) {
+	return APIShipmentRequest(s.url(), param)
+}
+
+func (s *httpShipmentService) Status(param *APIShipmentStatusReq) (*APIShipmentStatusRes, error) {
+	return APIShipmentStatus(s.url(), param)
+}
+
+func (s *httpShipmentService) Cancel(param *APIShipmentCancelReq) error {
+	return APIShipmentCancel(s.url(), param)
+}
+
 func APIPaymentToken(paymentURL string, param *APIPaymentServiceTokenReq) (*APIPaymentServiceTokenRes, error) {
 	b, _ := json.Marshal(param)
 
@@ -61,7 +144,7 @@ func APIPaymentToken(paymentURL string, param *APIPaymentServiceTokenReq) (*APIP
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +179,7 @@ func APIShipmentCreate(shipmentURL string, param *APIShipmentCreateReq) (*APIShi
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", IsucariAPIToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -131,7 +214,7 @@ func APIShipmentRequest(shipmentURL string, param *APIShipmentRequestReq) ([]byt
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", IsucariAPIToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +243,7 @@ func APIShipmentStatus(shipmentURL string, param *APIShipmentStatusReq) (*APIShi
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", IsucariAPIToken)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -182,3 +265,71 @@ func APIShipmentStatus(shipmentURL string, param *APIShipmentStatusReq) (*APIShi
 
 	return ssr, nil
 }
+
+// APIPaymentRefund voids a settled token. POST /refund is not part of
+// docs/EXTERNAL_SERVICE_SPEC.md; it is the contract the fake implements and
+// the one we expect from the payment service.
+func APIPaymentRefund(paymentURL string, param *APIPaymentServiceRefundReq) (*APIPaymentServiceRefundRes, error) {
+	b, _ := json.Marshal(param)
+
+	req, err := http.NewRequest(http.MethodPost, paymentURL+"/refund", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read res.Body and the status code of the response from payment service was not 200: %v", err)
+		}
+		return nil, fmt.Errorf("status code: %d; body: %s", res.StatusCode, b)
+	}
+
+	prr := &APIPaymentServiceRefundRes{}
+	err = json.NewDecoder(res.Body).Decode(prr)
+	if err != nil {
+		return nil, err
+	}
+
+	return prr, nil
+}
+
+// APIShipmentCancel drops a reservation that has not been picked up yet.
+// Like /refund, POST /cancel is an extension of the documented API.
+func APIShipmentCancel(shipmentURL string, param *APIShipmentCancelReq) error {
+	b, _ := json.Marshal(param)
+
+	req, err := http.NewRequest(http.MethodPost, shipmentURL+"/cancel", bytes.NewBuffer(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", IsucariAPIToken)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return fmt.Errorf("failed to read res.Body and the status code of the response from shipment service was not 200: %v", err)
+		}
+		return fmt.Errorf("status code: %d; body: %s", res.StatusCode, b)
+	}
+
+	return nil
+}
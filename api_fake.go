@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	FakePaymentTokenTTL = 5 * time.Minute
+
+	fakeReserveIDMax        = 10000000000
+	fakeQRCodeImageSize     = 64
+	fakeQRCodeModuleSize    = 4
+	fakeQRCodeModulesPerRow = fakeQRCodeImageSize / fakeQRCodeModuleSize
+)
+
+var (
+	ErrFakeWrongShopID     = errors.New("wrong shop id")
+	ErrFakeWrongAPIKey     = errors.New("wrong api key")
+	ErrFakeWrongCardNumber = errors.New("card number is wrong")
+	ErrFakeRequiredParam   = errors.New("required parameter was not passed")
+	ErrFakeEmpty           = errors.New("empty")
+	ErrFakeWrongParameters = errors.New("wrong parameters")
+
+	fakeCardNumberPattern = regexp.MustCompile(`^[0-9A-F]{8}$`)
+)
+
+type fakePaymentToken struct {
+	ShopID     string
+	CardNumber string
+	ExpiresAt  time.Time
+}
+
+// FakePaymentService is an in-memory stand-in for the payment service. Tokens
+// are issued by IssueToken (the equivalent of POST /card) and settled by Token.
+type FakePaymentService struct {
+	sync.Mutex
+
+	ShopID string
+	APIKey string
+
+	tokens    map[string]*fakePaymentToken
+	failCards map[string]bool
+	charges   map[string]int
+	refunds   map[string]int
+	now       func() time.Time
+}
+
+func NewFakePaymentService() *FakePaymentService {
+	return &FakePaymentService{
+		ShopID:    PaymentServiceIsucariShopID,
+		APIKey:    PaymentServiceIsucariAPIKey,
+		tokens:    map[string]*fakePaymentToken{},
+		failCards: map[string]bool{},
+		charges:   map[string]int{},
+		refunds:   map[string]int{},
+		now:       time.Now,
+	}
+}
+
+func (s *FakePaymentService) IssueToken(shopID, cardNumber string) (string, error) {
+	if shopID != s.ShopID {
+		return "", ErrFakeWrongShopID
+	}
+	if !fakeCardNumberPattern.MatchString(cardNumber) {
+		return "", ErrFakeWrongCardNumber
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	token := secureRandomStr(16)
+	s.tokens[token] = &fakePaymentToken{
+		ShopID:     shopID,
+		CardNumber: cardNumber,
+		ExpiresAt:  s.now().Add(FakePaymentTokenTTL),
+	}
+
+	return token, nil
+}
+
+// SetCardFailure makes every payment with the card return "fail", which is how
+// the real service reports an insufficient balance.
+func (s *FakePaymentService) SetCardFailure(cardNumber string, fail bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if fail {
+		s.failCards[cardNumber] = true
+	} else {
+		delete(s.failCards, cardNumber)
+	}
+}
+
+// Charged returns the settled amount for a token, if any.
+func (s *FakePaymentService) Charged(token string) (int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	price, ok := s.charges[token]
+	return price, ok
+}
+
+func (s *FakePaymentService) Token(param *APIPaymentServiceTokenReq) (*APIPaymentServiceTokenRes, error) {
+	if param.ShopID != s.ShopID {
+		return nil, ErrFakeWrongShopID
+	}
+	if param.APIKey != s.APIKey {
+		return nil, ErrFakeWrongAPIKey
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	t, ok := s.tokens[param.Token]
+	if !ok || t.ShopID != param.ShopID || s.now().After(t.ExpiresAt) {
+		return &APIPaymentServiceTokenRes{Status: PaymentStatusInvalid}, nil
+	}
+	// tokens are single use
+	delete(s.tokens, param.Token)
+
+	if s.failCards[t.CardNumber] {
+		return &APIPaymentServiceTokenRes{Status: PaymentStatusFail}, nil
+	}
+
+	s.charges[param.Token] = param.Price
+
+	return &APIPaymentServiceTokenRes{Status: PaymentStatusOK}, nil
+}
+
+// Refunded returns the refunded amount for a token, if any.
+func (s *FakePaymentService) Refunded(token string) (int, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	price, ok := s.refunds[token]
+	return price, ok
+}
+
+func (s *FakePaymentService) Refund(param *APIPaymentServiceRefundReq) (*APIPaymentServiceRefundRes, error) {
+	if param.ShopID != s.ShopID {
+		return nil, ErrFakeWrongShopID
+	}
+	if param.APIKey != s.APIKey {
+		return nil, ErrFakeWrongAPIKey
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.refunds[param.Token]; ok {
+		return &APIPaymentServiceRefundRes{Status: PaymentRefundStatusOK}, nil
+	}
+	price, ok := s.charges[param.Token]
+	if !ok {
+		return &APIPaymentServiceRefundRes{Status: PaymentRefundStatusNotFound}, nil
+	}
+	delete(s.charges, param.Token)
+	s.refunds[param.Token] = price
+
+	return &APIPaymentServiceRefundRes{Status: PaymentRefundStatusOK}, nil
+}
+
+type fakeShipment struct {
+	Req         APIShipmentCreateReq
+	Status      string
+	ReserveTime int64
+}
+
+// FakeShipmentService is an in-memory stand-in for the shipment service.
+// Create and Request are driven by the app; Accept and Deliver play the part
+// of the courier scanning the QR code and finishing the delivery.
+type FakeShipmentService struct {
+	sync.Mutex
+
+	shipments map[string]*fakeShipment
+	rand      *rand.Rand
+	now       func() time.Time
+}
+
+func NewFakeShipmentService() *FakeShipmentService {
+	return &FakeShipmentService{
+		shipments: map[string]*fakeShipment{},
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:       time.Now,
+	}
+}
+
+func (s *FakeShipmentService) Create(param *APIShipmentCreateReq) (*APIShipmentCreateRes, error) {
+	if param.ToAddress == "" || param.ToName == "" || param.FromAddress == "" || param.FromName == "" {
+		return nil, ErrFakeRequiredParam
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var reserveID string
+	for {
+		reserveID = fmt.Sprintf("%010d", s.rand.Int63n(fakeReserveIDMax))
+		if _, ok := s.shipments[reserveID]; !ok {
+			break
+		}
+	}
+
+	sh := &fakeShipment{
+		Req:         *param,
+		Status:      ShippingsStatusInitial,
+		ReserveTime: s.now().Unix(),
+	}
+	s.shipments[reserveID] = sh
+
+	return &APIShipmentCreateRes{
+		ReserveID:   reserveID,
+		ReserveTime: sh.ReserveTime,
+	}, nil
+}
+
+func (s *FakeShipmentService) Request(param *APIShipmentRequestReq) ([]byte, error) {
+	if param.ReserveID == "" {
+		return nil, ErrFakeRequiredParam
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	sh, ok := s.shipments[param.ReserveID]
+	if !ok {
+		return nil, ErrFakeEmpty
+	}
+	if sh.Status == ShippingsStatusInitial {
+		sh.Status = ShippingsStatusWaitPickup
+	}
+
+	return fakeQRCode(param.ReserveID)
+}
+
+func (s *FakeShipmentService) Status(param *APIShipmentStatusReq) (*APIShipmentStatusRes, error) {
+	if param.ReserveID == "" {
+		return nil, ErrFakeRequiredParam
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	sh, ok := s.shipments[param.ReserveID]
+	if !ok {
+		return nil, ErrFakeEmpty
+	}
+
+	return &APIShipmentStatusRes{
+		Status:      sh.Status,
+		ReserveTime: sh.ReserveTime,
+	}, nil
+}
+
+func (s *FakeShipmentService) Cancel(param *APIShipmentCancelReq) error {
+	if param.ReserveID == "" {
+		return ErrFakeRequiredParam
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	sh, ok := s.shipments[param.ReserveID]
+	if !ok {
+		return ErrFakeEmpty
+	}
+	switch sh.Status {
+	case ShippingsStatusInitial, ShippingsStatusWaitPickup:
+		sh.Status = ShippingsStatusCancel
+	case ShippingsStatusCancel:
+	default:
+		return ErrFakeWrongParameters
+	}
+
+	return nil
+}
+
+// Accept is the equivalent of GET /accept: the courier picks the parcel up.
+func (s *FakeShipmentService) Accept(reserveID string) error {
+	return s.advance(reserveID, ShippingsStatusWaitPickup, ShippingsStatusShipping)
+}
+
+// Deliver finishes a delivery that is in progress.
+func (s *FakeShipmentService) Deliver(reserveID string) error {
+	return s.advance(reserveID, ShippingsStatusShipping, ShippingsStatusDone)
+}
+
+func (s *FakeShipmentService) advance(reserveID, from, to string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	sh, ok := s.shipments[reserveID]
+	if !ok {
+		return ErrFakeEmpty
+	}
+	if sh.Status != from {
+		return ErrFakeWrongParameters
+	}
+	sh.Status = to
+
+	return nil
+}
+
+// fakeQRCode renders a deterministic pattern derived from the reserve ID. It is
+// not a scannable QR code, only a valid PNG unique to the shipment.
+func fakeQRCode(reserveID string) ([]byte, error) {
+	img := image.NewGray(image.Rect(0, 0, fakeQRCodeImageSize, fakeQRCodeImageSize))
+	seed := int64(0)
+	for _, c := range reserveID {
+		seed = seed*31 + int64(c)
+	}
+	rnd := rand.New(rand.NewSource(seed))
+
+	for my := 0; my < fakeQRCodeModulesPerRow; my++ {
+		for mx := 0; mx < fakeQRCodeModulesPerRow; mx++ {
+			c := color.Gray{Y: 255}
+			if rnd.Intn(2) == 0 {
+				c = color.Gray{Y: 0}
+			}
+			for y := 0; y < fakeQRCodeModuleSize; y++ {
+				for x := 0; x < fakeQRCodeModuleSize; x++ {
+					img.SetGray(mx*fakeQRCodeModuleSize+x, my*fakeQRCodeModuleSize+y, c)
+				}
+			}
+		}
+	}
+
+	buf := bytes.Buffer{}
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
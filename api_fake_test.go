@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func fakeTokenReq(s *FakePaymentService, token string, price int) *APIPaymentServiceTokenReq {
+	return &APIPaymentServiceTokenReq{ShopID: s.ShopID, Token: token, APIKey: s.APIKey, Price: price}
+}
+
+func TestFakePaymentTokenIsSingleUse(t *testing.T) {
+	s := NewFakePaymentService()
+	token, err := s.IssueToken(s.ShopID, "AAAAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Token(fakeTokenReq(s, token, 100))
+	if err != nil || res.Status != PaymentStatusOK {
+		t.Fatalf("first use: %v, %v", res, err)
+	}
+	if price, ok := s.Charged(token); !ok || price != 100 {
+		t.Fatalf("charged %d, %v; want 100", price, ok)
+	}
+
+	res, err = s.Token(fakeTokenReq(s, token, 100))
+	if err != nil || res.Status != PaymentStatusInvalid {
+		t.Fatalf("second use: %v, %v", res, err)
+	}
+}
+
+func TestFakePaymentToken(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		card     string
+		failCard bool
+		elapsed  time.Duration
+		token    string
+		status   string
+	}{
+		{name: "ok", card: "0123ABCD", status: PaymentStatusOK},
+		{name: "failing card", card: "0123ABCD", failCard: true, status: PaymentStatusFail},
+		{name: "expired", card: "0123ABCD", elapsed: FakePaymentTokenTTL + time.Second, status: PaymentStatusInvalid},
+		{name: "unknown token", card: "0123ABCD", token: "unknown", status: PaymentStatusInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewFakePaymentService()
+			s.now = func() time.Time { return now }
+			s.SetCardFailure(tt.card, tt.failCard)
+
+			token, err := s.IssueToken(s.ShopID, tt.card)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				token = tt.token
+			}
+			s.now = func() time.Time { return now.Add(tt.elapsed) }
+
+			res, err := s.Token(fakeTokenReq(s, token, 100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tt.status {
+				t.Errorf("status %q, want %q", res.Status, tt.status)
+			}
+			if _, ok := s.Charged(token); ok != (tt.status == PaymentStatusOK) {
+				t.Errorf("charged %v", ok)
+			}
+		})
+	}
+}
+
+func TestFakePaymentRejectsCredentials(t *testing.T) {
+	s := NewFakePaymentService()
+
+	if _, err := s.IssueToken("0", "AAAAAAAA"); err != ErrFakeWrongShopID {
+		t.Errorf("IssueToken with wrong shop: %v", err)
+	}
+	if _, err := s.IssueToken(s.ShopID, "aaaaaaaa"); err != ErrFakeWrongCardNumber {
+		t.Errorf("IssueToken with wrong card: %v", err)
+	}
+
+	req := fakeTokenReq(s, "token", 100)
+	req.APIKey = "wrong"
+	if _, err := s.Token(req); err != ErrFakeWrongAPIKey {
+		t.Errorf("Token with wrong key: %v", err)
+	}
+	if _, err := s.Refund(&APIPaymentServiceRefundReq{ShopID: s.ShopID, APIKey: "wrong", Token: "token"}); err != ErrFakeWrongAPIKey {
+		t.Errorf("Refund with wrong key: %v", err)
+	}
+}
+
+func TestFakePaymentRefund(t *testing.T) {
+	s := NewFakePaymentService()
+	token, _ := s.IssueToken(s.ShopID, "AAAAAAAA")
+	s.Token(fakeTokenReq(s, token, 300))
+
+	refund := &APIPaymentServiceRefundReq{ShopID: s.ShopID, APIKey: s.APIKey, Token: token, Price: 300}
+	for i := 0; i < 2; i++ {
+		// a retried refund succeeds again without refunding twice
+		res, err := s.Refund(refund)
+		if err != nil || res.Status != PaymentRefundStatusOK {
+			t.Fatalf("refund %d: %v, %v", i, res, err)
+		}
+	}
+	if price, ok := s.Refunded(token); !ok || price != 300 {
+		t.Errorf("refunded %d, %v; want 300", price, ok)
+	}
+	if _, ok := s.Charged(token); ok {
+		t.Error("still charged after refund")
+	}
+
+	res, err := s.Refund(&APIPaymentServiceRefundReq{ShopID: s.ShopID, APIKey: s.APIKey, Token: "unknown"})
+	if err != nil || res.Status != PaymentRefundStatusNotFound {
+		t.Errorf("refund of unknown token: %v, %v", res, err)
+	}
+}
+
+func fakeShipmentCreateReq() *APIShipmentCreateReq {
+	return &APIShipmentCreateReq{ToAddress: "to address", ToName: "to", FromAddress: "from address", FromName: "from"}
+}
+
+func fakeShipmentStatus(t *testing.T, s *FakeShipmentService, reserveID string) string {
+	t.Helper()
+	res, err := s.Status(&APIShipmentStatusReq{ReserveID: reserveID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Status
+}
+
+func TestFakeShipmentDelivery(t *testing.T) {
+	s := NewFakeShipmentService()
+	created, err := s.Create(fakeShipmentCreateReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserveID := created.ReserveID
+	if got := fakeShipmentStatus(t, s, reserveID); got != ShippingsStatusInitial {
+		t.Fatalf("status %q after create", got)
+	}
+
+	// the courier cannot pick up before the seller asks for it
+	if err := s.Accept(reserveID); err != ErrFakeWrongParameters {
+		t.Errorf("Accept before Request: %v", err)
+	}
+
+	img, err := s.Request(&APIShipmentRequestReq{ReserveID: reserveID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(img)); err != nil {
+		t.Errorf("QR code is not a PNG: %v", err)
+	}
+	again, _ := s.Request(&APIShipmentRequestReq{ReserveID: reserveID})
+	if !bytes.Equal(img, again) {
+		t.Error("QR code changed between requests")
+	}
+	if got := fakeShipmentStatus(t, s, reserveID); got != ShippingsStatusWaitPickup {
+		t.Fatalf("status %q after request", got)
+	}
+
+	if err := s.Accept(reserveID); err != nil {
+		t.Fatal(err)
+	}
+	if got := fakeShipmentStatus(t, s, reserveID); got != ShippingsStatusShipping {
+		t.Fatalf("status %q after accept", got)
+	}
+	if err := s.Cancel(&APIShipmentCancelReq{ReserveID: reserveID}); err != ErrFakeWrongParameters {
+		t.Errorf("Cancel while shipping: %v", err)
+	}
+
+	if err := s.Deliver(reserveID); err != nil {
+		t.Fatal(err)
+	}
+	if got := fakeShipmentStatus(t, s, reserveID); got != ShippingsStatusDone {
+		t.Fatalf("status %q after deliver", got)
+	}
+	if err := s.Deliver(reserveID); err != ErrFakeWrongParameters {
+		t.Errorf("second Deliver: %v", err)
+	}
+}
+
+func TestFakeShipmentCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		request bool
+	}{
+		{name: "initial"},
+		{name: "wait_pickup", request: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewFakeShipmentService()
+			created, _ := s.Create(fakeShipmentCreateReq())
+			if tt.request {
+				s.Request(&APIShipmentRequestReq{ReserveID: created.ReserveID})
+			}
+
+			for i := 0; i < 2; i++ {
+				// cancelling twice is not an error
+				if err := s.Cancel(&APIShipmentCancelReq{ReserveID: created.ReserveID}); err != nil {
+					t.Fatalf("cancel %d: %v", i, err)
+				}
+			}
+			if got := fakeShipmentStatus(t, s, created.ReserveID); got != ShippingsStatusCancel {
+				t.Errorf("status %q", got)
+			}
+			if err := s.Accept(created.ReserveID); err != ErrFakeWrongParameters {
+				t.Errorf("Accept after cancel: %v", err)
+			}
+		})
+	}
+}
+
+func TestFakeShipmentUnknownReserveID(t *testing.T) {
+	s := NewFakeShipmentService()
+
+	if _, err := s.Create(&APIShipmentCreateReq{ToAddress: "to address"}); err != ErrFakeRequiredParam {
+		t.Errorf("Create without names: %v", err)
+	}
+	if _, err := s.Status(&APIShipmentStatusReq{ReserveID: "0000000000"}); err != ErrFakeEmpty {
+		t.Errorf("Status: %v", err)
+	}
+	if _, err := s.Request(&APIShipmentRequestReq{ReserveID: "0000000000"}); err != ErrFakeEmpty {
+		t.Errorf("Request: %v", err)
+	}
+	if err := s.Cancel(&APIShipmentCancelReq{ReserveID: "0000000000"}); err != ErrFakeEmpty {
+		t.Errorf("Cancel: %v", err)
+	}
+}
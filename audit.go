@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	RequestIDHeader    = "X-Request-ID"
+	RequestIDMaxLength = 64
+
+	AuditEntityItem                = "item"
+	AuditEntityTransactionEvidence = "transaction_evidence"
+	AuditEntityShipping            = "shipping"
+	AuditEntityPayment             = "payment"
+	AuditEntityTradeCancellation   = "trade_cancellation"
+	AuditEntityUser                = "user"
+
+	AuditDefaultLimit = 100
+)
+
+type requestIDContextKey struct{}
+
+// withRequestID tags every request with an ID, taken from the X-Request-ID
+// header of a proxy in front or made up here, and sends it back in the
+// response. Audit events carry it so one request can be followed through.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = secureRandomStr(16)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > RequestIDMaxLength {
+		return false
+	}
+	for _, c := range id {
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// AuditActor is who made a change. UserID is 0 for background jobs and for
+// the admin token.
+type AuditActor struct {
+	UserID    int64
+	Role      string
+	RequestID string
+}
+
+func requestAuditActor(r *http.Request, userID int64, role string) AuditActor {
+	return AuditActor{UserID: userID, Role: role, RequestID: requestID(r)}
+}
+
+func adminAuditActor(r *http.Request) AuditActor {
+	a := requestAdminActor(r)
+	return requestAuditActor(r, a.UserID, a.Role)
+}
+
+// systemAuditActor is the actor of a background job. Each run gets its own
+// request ID.
+func systemAuditActor(job string) AuditActor {
+	return AuditActor{Role: string(TradeRoleSystem), RequestID: job + "-" + secureRandomStr(8)}
+}
+
+// AuditEvent is one row of the append-only audit log. A request that changes
+// several rows writes one event per row, all with the same RequestID.
+type AuditEvent struct {
+	ID           int64     `json:"id" db:"id"`
+	RequestID    string    `json:"request_id" db:"request_id"`
+	ActorID      int64     `json:"actor_id" db:"actor_id"`
+	ActorRole    string    `json:"actor_role" db:"actor_role"`
+	Action       string    `json:"action" db:"action"`
+	EntityType   string    `json:"entity_type" db:"entity_type"`
+	EntityID     int64     `json:"entity_id" db:"entity_id"`
+	ItemID       int64     `json:"item_id" db:"item_id"`
+	UserID       int64     `json:"user_id" db:"user_id"`
+	StatusBefore string    `json:"status_before" db:"status_before"`
+	StatusAfter  string    `json:"status_after" db:"status_after"`
+	Detail       string    `json:"-" db:"detail"`
+	CreatedAt    time.Time `json:"-" db:"created_at"`
+}
+
+// writeAudit appends an event. Pass the transaction of the change it
+// describes, so the event exists exactly when the change does. detail is
+// stored as JSON and may be nil.
+func writeAudit(e sqlx.Execer, actor AuditActor, ev AuditEvent, detail interface{}) error {
+	ev.Detail = ""
+	if detail != nil {
+		b, err := json.Marshal(detail)
+		if err != nil {
+			return err
+		}
+		ev.Detail = string(b)
+	}
+
+	_, err := e.Exec("INSERT INTO `audit_events` (`request_id`, `actor_id`, `actor_role`, `action`, `entity_type`, `entity_id`, `item_id`, `user_id`, `status_before`, `status_after`, `detail`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		actor.RequestID,
+		actor.UserID,
+		actor.Role,
+		ev.Action,
+		ev.EntityType,
+		ev.EntityID,
+		ev.ItemID,
+		ev.UserID,
+		ev.StatusBefore,
+		ev.StatusAfter,
+		ev.Detail,
+	)
+	return err
+}
+
+// tradeCounterparty is the party of the trade who is not the actor, the
+// user an event on the trade is about.
+func tradeCounterparty(item Item, actor AuditActor) int64 {
+	if actor.UserID == item.SellerID {
+		return item.BuyerID
+	}
+	return item.SellerID
+}
+
+type resAuditEvent struct {
+	AuditEvent
+	Detail    json.RawMessage `json:"detail,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+type resAuditEvents struct {
+	Events     []resAuditEvent `json:"events"`
+	HasNext    bool            `json:"has_next"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// getAdminAudit lists audit events newest first. user_id matches both the
+// actor and the user the event is about; since and until are unix times.
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, err := parsePage(query, "admin/audit", AuditDefaultLimit)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conds := []string{"1 = 1"}
+	args := []interface{}{}
+	if v := query.Get("user_id"); v != "" {
+		userID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || userID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "user_id param error")
+			return
+		}
+		conds = append(conds, "(`actor_id` = ? OR `user_id` = ?)")
+		args = append(args, userID, userID)
+	}
+	if v := query.Get("item_id"); v != "" {
+		itemID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || itemID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "item_id param error")
+			return
+		}
+		conds = append(conds, "`item_id` = ?")
+		args = append(args, itemID)
+	}
+	if v := query.Get("request_id"); v != "" {
+		conds = append(conds, "`request_id` = ?")
+		args = append(args, v)
+	}
+	for _, p := range []struct {
+		param string
+		cond  string
+	}{
+		{"since", "`created_at` >= ?"},
+		{"until", "`created_at` < ?"},
+	} {
+		v := query.Get(p.param)
+		if v == "" {
+			continue
+		}
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sec < 0 {
+			outputErrorMsg(w, http.StatusBadRequest, p.param+" param error")
+			return
+		}
+		conds = append(conds, p.cond)
+		args = append(args, time.Unix(sec, 0))
+	}
+	if page.Cursor != nil {
+		conds = append(conds, "`id` < ?")
+		args = append(args, page.Cursor.ID)
+	}
+	args = append(args, page.Limit+1)
+
+	events := []AuditEvent{}
+	err = dbx.Select(&events, "SELECT * FROM `audit_events` WHERE "+strings.Join(conds, " AND ")+" ORDER BY `id` DESC LIMIT ?", args...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := resAuditEvents{Events: []resAuditEvent{}}
+	if len(events) > page.Limit {
+		events = events[:page.Limit]
+		res.HasNext = true
+		res.NextCursor = page.NextCursor(Cursor{ID: events[page.Limit-1].ID})
+	}
+	for _, ev := range events {
+		rev := resAuditEvent{AuditEvent: ev, CreatedAt: ev.CreatedAt.Unix()}
+		if ev.Detail != "" {
+			rev.Detail = json.RawMessage(ev.Detail)
+		}
+		res.Events = append(res.Events, rev)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
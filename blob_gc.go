@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DefaultBlobGCInterval = 10 * time.Minute
+	// an upload has this long to be attached to an item before it counts as
+	// garbage
+	BlobGCGracePeriod = 1 * time.Hour
+	BlobGCBatchSize   = 100
+)
+
+// Blob is the bookkeeping of one object in imageStore. RefCount is the number
+// of item_images rows pointing at it, as image or as thumbnail.
+type Blob struct {
+	Key         string    `db:"key"`
+	RefCount    int       `db:"ref_count"`
+	Size        int64     `db:"size"`
+	ContentType string    `db:"content_type"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+// putImageBlob stores data under the hash of its content, so identical
+// images share one object. The blobs row is touched before the object is
+// written: a collection that already holds the row lock finishes first and
+// the object is written again afterwards.
+func putImageBlob(data []byte, ext, contentType string) (string, error) {
+	key := sha256Hex(data) + ext
+
+	_, err := dbx.Exec("INSERT INTO `blobs` (`key`, `size`, `content_type`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `updated_at` = CURRENT_TIMESTAMP",
+		key,
+		len(data),
+		contentType,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	err = imageStore.Put(key, data, contentType)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// addBlobRefs adds delta to the reference count of each key, once per time it
+// is listed. Rows are updated in key order so that concurrent transactions
+// do not deadlock.
+func addBlobRefs(tx *sqlx.Tx, delta int, keys ...string) error {
+	counts := map[string]int{}
+	for _, k := range keys {
+		counts[k]++
+	}
+	sorted := make([]string, 0, len(counts))
+	for k := range counts {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		// images uploaded before content addressing have no row; they are
+		// never collected
+		_, err := tx.Exec("UPDATE `blobs` SET `ref_count` = GREATEST(`ref_count` + ?, 0) WHERE `key` = ?", delta*counts[k], k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func itemImageBlobKeys(images []*ItemImage) []string {
+	keys := make([]string, 0, len(images)*2)
+	for _, img := range images {
+		keys = append(keys, img.ImageName, img.ThumbnailName)
+	}
+	return keys
+}
+
+// recountBlobRefs recomputes every reference count from item_images, for
+// after /initialize has replaced the items.
+func recountBlobRefs(q sqlx.Execer) error {
+	_, err := q.Exec("UPDATE `blobs` `b` LEFT JOIN (" +
+		"SELECT `k`, COUNT(*) AS `n` FROM (" +
+		"SELECT `image_name` AS `k` FROM `item_images` UNION ALL SELECT `thumbnail_name` FROM `item_images`" +
+		") `r` GROUP BY `k`" +
+		") `c` ON `c`.`k` = `b`.`key` SET `b`.`ref_count` = IFNULL(`c`.`n`, 0)")
+	return err
+}
+
+// runBlobGC deletes the images no item refers to any more.
+func runBlobGC(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		n, err := collectBlobs()
+		if err != nil {
+			log.Print(err)
+		}
+		if n > 0 {
+			log.Printf("blob gc: deleted %d unreferenced images", n)
+		}
+	}
+}
+
+func collectBlobs() (int, error) {
+	deleted := 0
+	lastKey := ""
+	for {
+		keys := []string{}
+		err := dbx.Select(&keys, "SELECT `key` FROM `blobs` WHERE `ref_count` = 0 AND `updated_at` < ? AND `key` > ? ORDER BY `key` LIMIT ?",
+			time.Now().Add(-BlobGCGracePeriod),
+			lastKey,
+			BlobGCBatchSize,
+		)
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, key := range keys {
+			lastKey = key
+			ok, err := collectBlob(key)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			if ok {
+				deleted++
+			}
+		}
+
+		if len(keys) < BlobGCBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// collectBlob deletes the object while holding the lock on its row, so an
+// upload of the same content waits and writes the object again.
+func collectBlob(key string) (bool, error) {
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	b := Blob{}
+	err = tx.Get(&b, "SELECT * FROM `blobs` WHERE `key` = ? FOR UPDATE", key)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if b.RefCount > 0 || b.UpdatedAt.After(time.Now().Add(-BlobGCGracePeriod)) {
+		return false, nil
+	}
+
+	_, err = tx.Exec("DELETE FROM `blobs` WHERE `key` = ?", key)
+	if err != nil {
+		return false, err
+	}
+	err = imageStore.Delete(key)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BlobBackendLocal = "local"
+	BlobBackendS3    = "s3"
+
+	DefaultUploadDir = "../public/upload"
+	DefaultUploadURL = "/upload/"
+	DefaultQRCodeDir = "../qrcode"
+
+	DefaultS3Region  = "us-east-1"
+	S3RequestTimeout = 10 * time.Second
+	S3ImagePrefix    = "upload/"
+	S3QRCodePrefix   = "qrcode/"
+
+	QRCodeContentType = "image/png"
+
+	s3SignatureAlgoName = "AWS4-HMAC-SHA256"
+)
+
+var (
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrBlobInvalidKey = errors.New("invalid blob key")
+)
+
+// BlobStore keeps uploaded images and shipping QR codes. Keys are relative
+// slash-separated paths.
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) error
+	// Get returns ErrBlobNotFound when there is no such key.
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	// URL is where browsers fetch the blob, or "" for stores that are only
+	// read through Get.
+	URL(key string) string
+}
+
+var (
+	// imageStore is served to browsers as is
+	imageStore BlobStore = NewLocalBlobStore(DefaultUploadDir, DefaultUploadURL)
+	// qrCodeStore is private; getQRCode checks who asks before reading it
+	qrCodeStore BlobStore = NewLocalBlobStore(DefaultQRCodeDir, "")
+)
+
+func validBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// LocalBlobStore keeps blobs as files under Dir. With a BaseURL, Dir is
+// expected to be served by the web server under that URL.
+type LocalBlobStore struct {
+	Dir     string
+	BaseURL string
+}
+
+func NewLocalBlobStore(dir, baseURL string) *LocalBlobStore {
+	return &LocalBlobStore{Dir: dir, BaseURL: baseURL}
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", ErrBlobInvalidKey
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so that readers never see half a
+// blob.
+func (s *LocalBlobStore) Put(key string, data []byte, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Get(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *LocalBlobStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalBlobStore) URL(key string) string {
+	if s.BaseURL == "" {
+		return ""
+	}
+	return s.BaseURL + key
+}
+
+// S3BlobStore talks to S3 or to anything speaking its API, such as MinIO.
+// Requests are path-style, http(s)://endpoint/bucket/key, so no DNS is needed
+// per bucket.
+type S3BlobStore struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is put in front of every key, so several stores can share a
+	// bucket.
+	Prefix string
+	// PublicURL is where the bucket is readable by browsers, a CDN for
+	// instance. Blobs have no URL when it is empty.
+	PublicURL string
+
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey, prefix, publicURL string) *S3BlobStore {
+	if region == "" {
+		region = DefaultS3Region
+	}
+	return &S3BlobStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Prefix:    prefix,
+		PublicURL: strings.TrimSuffix(publicURL, "/"),
+		client:    &http.Client{Timeout: S3RequestTimeout},
+		now:       time.Now,
+	}
+}
+
+func (s *S3BlobStore) objectPath(key string) string {
+	return "/" + s3Escape(s.Bucket) + "/" + s3EscapePath(s.Prefix+key)
+}
+
+func (s *S3BlobStore) Put(key string, data []byte, contentType string) error {
+	if !validBlobKey(key) {
+		return ErrBlobInvalidKey
+	}
+	res, err := s.do(http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(key string) ([]byte, error) {
+	if !validBlobKey(key) {
+		return nil, ErrBlobInvalidKey
+	}
+	res, err := s.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s3Error(res)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return ErrBlobInvalidKey
+	}
+	res, err := s.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) URL(key string) string {
+	if s.PublicURL == "" {
+		return ""
+	}
+	return s.PublicURL + "/" + s3EscapePath(s.Prefix+key)
+}
+
+func (s *S3BlobStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.Endpoint+s.objectPath(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, s.objectPath(key), body)
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the host
+// and every header set on req so far. Requests carry no query string, which
+// keeps the canonical request short.
+func (s *S3BlobStore) sign(req *http.Request, canonicalURI string, body []byte) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	values := map[string]string{"host": req.URL.Host}
+	for name, vs := range req.Header {
+		values[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	headers := make([]string, 0, len(values))
+	for name := range values {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+	canonicalHeaders := ""
+	for _, name := range headers {
+		canonicalHeaders += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3SignatureAlgoName,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignatureAlgoName, s.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3Error(res *http.Response) error {
+	b, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("s3: %s %s: %d %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, truncateString(string(b), 256))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// SigV4 requires.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(key string) string {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = s3Escape(seg)
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	CancellationStatusRequested = "requested"
+	CancellationStatusAccepted  = "accepted"
+	CancellationStatusRejected  = "rejected"
+
+	CancelReasonMaxLength = 255
+)
+
+var (
+	ErrTradeNotCancellable     = &TradeError{http.StatusForbidden, "発送前の取引のみキャンセルできます"}
+	ErrCancellationExists      = &TradeError{http.StatusConflict, "キャンセル申請中です"}
+	ErrCancellationNotFound    = &TradeError{http.StatusNotFound, "キャンセル申請がありません"}
+	ErrCancellationOwnResponse = &TradeError{http.StatusForbidden, "自分のキャンセル申請には応答できません"}
+
+	TradeCancel = &TradeTransition{
+		Name:         "cancel",
+		Roles:        []TradeRole{TradeRoleSeller, TradeRoleBuyer, TradeRoleSystem},
+		ItemFrom:     []string{ItemStatusTrading},
+		EvidenceFrom: []string{TransactionEvidenceStatusWaitShipping},
+		ShippingFrom: []string{ShippingsStatusInitial, ShippingsStatusWaitPickup},
+		ItemTo:       ItemStatusCancel,
+		EvidenceTo:   TransactionEvidenceStatusCancel,
+		ShippingTo:   []string{ShippingsStatusCancel},
+		RoleErr:      ErrTradeForbidden,
+		ItemErr:      ErrTradeItemNotTrading,
+		EvidenceErr:  ErrTradeNotCancellable,
+		ShippingErr:  ErrTradeNotCancellable,
+	}
+)
+
+type TradeCancellation struct {
+	ID                    int64     `json:"id" db:"id"`
+	TransactionEvidenceID int64     `json:"transaction_evidence_id" db:"transaction_evidence_id"`
+	ItemID                int64     `json:"item_id" db:"item_id"`
+	RequestedBy           int64     `json:"requested_by" db:"requested_by"`
+	RequestedRole         string    `json:"requested_role" db:"requested_role"`
+	Reason                string    `json:"reason" db:"reason"`
+	Relist                bool      `json:"relist" db:"relist"`
+	Status                string    `json:"status" db:"status"`
+	RespondedBy           int64     `json:"responded_by" db:"responded_by"`
+	RelistedItemID        int64     `json:"relisted_item_id" db:"relisted_item_id"`
+	CreatedAt             time.Time `json:"-" db:"created_at"`
+	UpdatedAt             time.Time `json:"-" db:"updated_at"`
+}
+
+type reqCancel struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+	Reason    string `json:"reason"`
+	// only the seller decides whether the item goes back on sale
+	Relist bool `json:"relist"`
+}
+
+type resCancel struct {
+	CancellationID int64  `json:"cancellation_id"`
+	Status         string `json:"status"`
+	RelistedItemID int64  `json:"relisted_item_id,omitempty"`
+}
+
+// cancelledTrade carries what has to happen once the cancel is committed.
+type cancelledTrade struct {
+	PaymentID int64
+	ReserveID string
+}
+
+// cancelTrade moves a trade to cancel and schedules the refund of its payment
+// in the same transaction, so a committed cancel is always refunded.
+func cancelTrade(tx *sqlx.Tx, st *TradeState, role TradeRole, actor AuditActor, reason string) (*cancelledTrade, error) {
+	err := TradeCancel.Check(st, role)
+	if err != nil {
+		return nil, err
+	}
+	err = TradeCancel.Apply(tx, st, "", actor)
+	if err != nil {
+		return nil, err
+	}
+
+	p := Payment{}
+	err = tx.Get(&p, "SELECT * FROM `payments` WHERE `transaction_evidence_id` = ? AND `state` = ? FOR UPDATE",
+		st.TransactionEvidence.ID,
+		PaymentStateCaptured,
+	)
+	if err == sql.ErrNoRows {
+		return &cancelledTrade{ReserveID: st.Shipping.ReserveID}, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, ErrTradeDB
+	}
+
+	err = markPaymentCompensating(tx, p.ID, reason)
+	if err != nil {
+		log.Print(err)
+		return nil, ErrTradeDB
+	}
+	err = writeAudit(tx, actor, AuditEvent{
+		Action:       TradeCancel.Name,
+		EntityType:   AuditEntityPayment,
+		EntityID:     p.ID,
+		ItemID:       st.Item.ID,
+		UserID:       tradeCounterparty(st.Item, actor),
+		StatusBefore: p.State,
+		StatusAfter:  PaymentStateCompensating,
+	}, map[string]string{"reason": reason})
+	if err != nil {
+		log.Print(err)
+		return nil, ErrTradeDB
+	}
+
+	return &cancelledTrade{PaymentID: p.ID}, nil
+}
+
+// settle runs after commit. The compensator refunds the payment and cancels
+// the shipment; trades bought before payments were recorded only get the
+// shipment cancelled because there is no token to refund.
+func (c *cancelledTrade) settle() {
+	if c.PaymentID != 0 {
+		go compensatePayment(c.PaymentID)
+		return
+	}
+
+	log.Printf("no payment record for cancelled reservation %s; refund it manually", c.ReserveID)
+	go func() {
+		err := shipmentService.Cancel(&APIShipmentCancelReq{
+			ReserveID: c.ReserveID,
+		})
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+}
+
+// relistItem puts a copy of a cancelled item on sale again.
+func relistItem(tx *sqlx.Tx, item Item, actor AuditActor) (int64, error) {
+	seller := User{}
+	err := tx.Get(&seller, "SELECT * FROM `users` WHERE `id` = ? FOR UPDATE", item.SellerID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO `items` (`seller_id`, `status`, `name`, `price`, `description`,`image_name`,`thumbnail_name`,`category_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		item.SellerID,
+		ItemStatusOnSale,
+		item.Name,
+		item.Price,
+		item.Description,
+		item.ImageName,
+		item.ThumbnailName,
+		item.CategoryID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	itemID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = copyItemImages(tx, item.ID, itemID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeAudit(tx, actor, AuditEvent{
+		Action:      "relist",
+		EntityType:  AuditEntityItem,
+		EntityID:    itemID,
+		ItemID:      itemID,
+		UserID:      item.SellerID,
+		StatusAfter: ItemStatusOnSale,
+	}, map[string]int64{"relisted_from": item.ID})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE `users` SET `num_sell_items`=? WHERE `id`=?",
+		seller.NumSellItems+1,
+		seller.ID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return itemID, nil
+}
+
+func postCancel(w http.ResponseWriter, r *http.Request) {
+	rc := reqCancel{}
+	err := json.NewDecoder(r.Body).Decode(&rc)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rc.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	if len([]rune(rc.Reason)) > CancelReasonMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "reason is too long")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, err := lockTrade(tx, rc.ItemID)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+	role := st.Role(user.ID)
+	err = TradeCancel.Check(st, role)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	var count int
+	err = tx.Get(&count, "SELECT COUNT(*) FROM `trade_cancellations` WHERE `transaction_evidence_id` = ? AND `status` = ?",
+		st.TransactionEvidence.ID,
+		CancellationStatusRequested,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if count > 0 {
+		outputTradeError(w, ErrCancellationExists)
+		tx.Rollback()
+		return
+	}
+
+	result, err := tx.Exec("INSERT INTO `trade_cancellations` (`transaction_evidence_id`, `item_id`, `requested_by`, `requested_role`, `reason`, `relist`, `status`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		st.TransactionEvidence.ID,
+		st.Item.ID,
+		user.ID,
+		role,
+		rc.Reason,
+		rc.Relist && role == TradeRoleSeller,
+		CancellationStatusRequested,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	cancellationID, err := result.LastInsertId()
+	if err == nil {
+		actor := requestAuditActor(r, user.ID, string(role))
+		err = writeAudit(tx, actor, AuditEvent{
+			Action:      "cancel_request",
+			EntityType:  AuditEntityTradeCancellation,
+			EntityID:    cancellationID,
+			ItemID:      st.Item.ID,
+			UserID:      tradeCounterparty(st.Item, actor),
+			StatusAfter: CancellationStatusRequested,
+		}, map[string]string{"reason": rc.Reason})
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resCancel{
+		CancellationID: cancellationID,
+		Status:         CancellationStatusRequested,
+	})
+}
+
+// lockCancellation locks the trade and its open cancellation request and
+// checks that the user is the party who has to answer it.
+func lockCancellation(tx *sqlx.Tx, itemID int64, userID int64) (*TradeState, *TradeCancellation, error) {
+	st, err := lockTrade(tx, itemID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st.Role(userID) == TradeRoleNone {
+		return nil, nil, ErrTradeForbidden
+	}
+	if st.TransactionEvidence == nil {
+		return nil, nil, ErrCancellationNotFound
+	}
+
+	c := TradeCancellation{}
+	err = tx.Get(&c, "SELECT * FROM `trade_cancellations` WHERE `transaction_evidence_id` = ? AND `status` = ? FOR UPDATE",
+		st.TransactionEvidence.ID,
+		CancellationStatusRequested,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrCancellationNotFound
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, nil, ErrTradeDB
+	}
+	if c.RequestedBy == userID {
+		return nil, nil, ErrCancellationOwnResponse
+	}
+
+	return st, &c, nil
+}
+
+func postCancelAccept(w http.ResponseWriter, r *http.Request) {
+	rc := reqCancel{}
+	err := json.NewDecoder(r.Body).Decode(&rc)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rc.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, c, err := lockCancellation(tx, rc.ItemID, user.ID)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+	role := st.Role(user.ID)
+
+	actor := requestAuditActor(r, user.ID, string(role))
+	ct, err := cancelTrade(tx, st, role, actor, "cancelled by agreement: "+c.Reason)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	relist := c.Relist
+	if role == TradeRoleSeller {
+		relist = rc.Relist
+	}
+	var relistedItemID int64
+	if relist {
+		relistedItemID, err = relistItem(tx, st.Item, actor)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+	}
+
+	_, err = tx.Exec("UPDATE `trade_cancellations` SET `status` = ?, `responded_by` = ?, `relist` = ?, `relisted_item_id` = ? WHERE `id` = ?",
+		CancellationStatusAccepted,
+		user.ID,
+		relist,
+		relistedItemID,
+		c.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	ct.settle()
+	searchIndex.Put(st.Item)
+	if relistedItemID != 0 {
+		invalidateUser(st.Item.SellerID)
+		searchIndex.Refresh(dbx, relistedItemID)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resCancel{
+		CancellationID: c.ID,
+		Status:         CancellationStatusAccepted,
+		RelistedItemID: relistedItemID,
+	})
+}
+
+func postCancelReject(w http.ResponseWriter, r *http.Request) {
+	rc := reqCancel{}
+	err := json.NewDecoder(r.Body).Decode(&rc)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rc.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, c, err := lockCancellation(tx, rc.ItemID, user.ID)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("UPDATE `trade_cancellations` SET `status` = ?, `responded_by` = ? WHERE `id` = ?",
+		CancellationStatusRejected,
+		user.ID,
+		c.ID,
+	)
+	if err == nil {
+		actor := requestAuditActor(r, user.ID, string(st.Role(user.ID)))
+		err = writeAudit(tx, actor, AuditEvent{
+			Action:       "cancel_reject",
+			EntityType:   AuditEntityTradeCancellation,
+			EntityID:     c.ID,
+			ItemID:       st.Item.ID,
+			UserID:       tradeCounterparty(st.Item, actor),
+			StatusBefore: c.Status,
+			StatusAfter:  CancellationStatusRejected,
+		}, nil)
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resCancel{
+		CancellationID: c.ID,
+		Status:         CancellationStatusRejected,
+	})
+}
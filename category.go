@@ -0,0 +1,444 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+const (
+	CacheKindCategory = "category"
+
+	CategoryNameMaxLength = 64
+)
+
+var ErrCategoryNotFound = errors.New("category not found")
+
+// CategoryTree is an immutable snapshot of the categories table. Readers get
+// it from currentCategoryTree and never lock; changes build a new tree and
+// swap it in.
+type CategoryTree struct {
+	all      []Category
+	byID     map[int]Category
+	children map[int][]int
+}
+
+var categoryTree atomic.Value
+
+func currentCategoryTree() *CategoryTree {
+	t, _ := categoryTree.Load().(*CategoryTree)
+	if t == nil {
+		return &CategoryTree{byID: map[int]Category{}, children: map[int][]int{}}
+	}
+	return t
+}
+
+func loadCategoryTree(q sqlx.Queryer) (*CategoryTree, error) {
+	categories := []Category{}
+	err := sqlx.Select(q, &categories, "SELECT * FROM `categories` ORDER BY `id`")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &CategoryTree{
+		byID:     make(map[int]Category, len(categories)),
+		children: map[int][]int{},
+	}
+	for _, c := range categories {
+		t.byID[c.ID] = c
+	}
+	for _, c := range categories {
+		if p, ok := t.byID[c.ParentID]; ok {
+			c.ParentCategoryName = p.CategoryName
+		}
+		t.byID[c.ID] = c
+		t.all = append(t.all, c)
+		t.children[c.ParentID] = append(t.children[c.ParentID], c.ID)
+	}
+	return t, nil
+}
+
+// prepareCategory loads the categories and replaces the tree in use.
+func prepareCategory(q sqlx.Queryer) error {
+	t, err := loadCategoryTree(q)
+	if err != nil {
+		return err
+	}
+	categoryTree.Store(t)
+	return nil
+}
+
+// Get returns the category with the name of its parent filled in.
+func (t *CategoryTree) Get(categoryID int) (Category, bool) {
+	c, ok := t.byID[categoryID]
+	return c, ok
+}
+
+func (t *CategoryTree) All() []Category {
+	return t.all
+}
+
+// Path returns the ancestors of the category from the root down, ending
+// with the category itself.
+func (t *CategoryTree) Path(categoryID int) []Category {
+	path := []Category{}
+	seen := map[int]bool{}
+	for id := categoryID; id != 0 && !seen[id]; {
+		c, ok := t.byID[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		path = append(path, c)
+		id = c.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Root returns the top level category the category belongs to.
+func (t *CategoryTree) Root(categoryID int) (Category, bool) {
+	path := t.Path(categoryID)
+	if len(path) == 0 {
+		return Category{}, false
+	}
+	return path[0], true
+}
+
+func (t *CategoryTree) Children(categoryID int) []Category {
+	children := []Category{}
+	for _, id := range t.children[categoryID] {
+		children = append(children, t.byID[id])
+	}
+	return children
+}
+
+// Descendants returns the IDs of the category and of every category below it.
+func (t *CategoryTree) Descendants(categoryID int) []int {
+	ids := []int{categoryID}
+	for i := 0; i < len(ids); i++ {
+		ids = append(ids, t.children[ids[i]]...)
+	}
+	return ids
+}
+
+// IsUnder tells whether categoryID is ancestorID or lies below it.
+func (t *CategoryTree) IsUnder(categoryID, ancestorID int) bool {
+	for _, c := range t.Path(categoryID) {
+		if c.ID == ancestorID {
+			return true
+		}
+	}
+	return false
+}
+
+// ChildOn returns the child of ancestorID on the path to categoryID, which
+// is what facets count items under.
+func (t *CategoryTree) ChildOn(categoryID, ancestorID int) (Category, bool) {
+	path := t.Path(categoryID)
+	if ancestorID == 0 {
+		if len(path) == 0 {
+			return Category{}, false
+		}
+		return path[0], true
+	}
+	for i, c := range path {
+		if c.ID == ancestorID && i+1 < len(path) {
+			return path[i+1], true
+		}
+	}
+	return Category{}, false
+}
+
+func getCategoryByID(categoryID int) (Category, error) {
+	c, ok := currentCategoryTree().Get(categoryID)
+	if !ok {
+		return Category{}, ErrCategoryNotFound
+	}
+	return c, nil
+}
+
+// reloadCategories is called after a change is committed; other instances
+// reload when they see the invalidation.
+func reloadCategories() {
+	err := prepareCategory(dbx)
+	if err != nil {
+		log.Print(err)
+	}
+
+	_, err = dbx.Exec("INSERT INTO `cache_invalidations` (`kind`, `key_id`) VALUES (?, ?)", CacheKindCategory, 0)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+type resCategory struct {
+	Category Category   `json:"category"`
+	Path     []Category `json:"path"`
+	Children []Category `json:"children"`
+}
+
+type reqAdminCategory struct {
+	ParentID     *int    `json:"parent_id"`
+	CategoryName *string `json:"category_name"`
+}
+
+func newResCategory(t *CategoryTree, c Category) resCategory {
+	return resCategory{
+		Category: c,
+		Path:     t.Path(c.ID),
+		Children: t.Children(c.ID),
+	}
+}
+
+func getCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(pat.Param(r, "category_id"))
+	if err != nil || categoryID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect category id")
+		return
+	}
+
+	t := currentCategoryTree()
+	c, ok := t.Get(categoryID)
+	if !ok {
+		outputErrorMsg(w, http.StatusNotFound, "category not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newResCategory(t, c))
+}
+
+func getAdminCategories(w http.ResponseWriter, r *http.Request) {
+	t := currentCategoryTree()
+
+	res := []resCategory{}
+	for _, c := range t.All() {
+		res = append(res, newResCategory(t, c))
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func validCategoryName(name string) bool {
+	n := utf8.RuneCountInString(name)
+	return n > 0 && n <= CategoryNameMaxLength
+}
+
+func postAdminCategory(w http.ResponseWriter, r *http.Request) {
+	rac := reqAdminCategory{}
+	err := json.NewDecoder(r.Body).Decode(&rac)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rac.CategoryName == nil || !validCategoryName(*rac.CategoryName) {
+		outputErrorMsg(w, http.StatusBadRequest, "category_name param error")
+		return
+	}
+	parentID := 0
+	if rac.ParentID != nil {
+		parentID = *rac.ParentID
+	}
+	if _, ok := currentCategoryTree().Get(parentID); parentID != 0 && !ok {
+		outputErrorMsg(w, http.StatusBadRequest, "parent category not found")
+		return
+	}
+
+	result, err := dbx.Exec("INSERT INTO `categories` (`parent_id`, `category_name`) VALUES (?, ?)", parentID, *rac.CategoryName)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	categoryID, err := result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	reloadCategories()
+
+	t := currentCategoryTree()
+	c, _ := t.Get(int(categoryID))
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newResCategory(t, c))
+}
+
+// putAdminCategory renames the category, moves it under another parent, or
+// both.
+func putAdminCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(pat.Param(r, "category_id"))
+	if err != nil || categoryID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect category id")
+		return
+	}
+
+	rac := reqAdminCategory{}
+	err = json.NewDecoder(r.Body).Decode(&rac)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rac.CategoryName != nil && !validCategoryName(*rac.CategoryName) {
+		outputErrorMsg(w, http.StatusBadRequest, "category_name param error")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	// the tree in memory may be behind, so check against the table
+	c := Category{}
+	err = tx.Get(&c, "SELECT * FROM `categories` WHERE `id` = ? FOR UPDATE", categoryID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "category not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if rac.CategoryName != nil {
+		c.CategoryName = *rac.CategoryName
+	}
+	if rac.ParentID != nil && *rac.ParentID != c.ParentID {
+		t, err := loadCategoryTree(tx)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+		parentID := *rac.ParentID
+		if _, ok := t.Get(parentID); parentID != 0 && !ok {
+			outputErrorMsg(w, http.StatusBadRequest, "parent category not found")
+			tx.Rollback()
+			return
+		}
+		if parentID != 0 && t.IsUnder(parentID, c.ID) {
+			outputErrorMsg(w, http.StatusBadRequest, "a category cannot be moved under itself")
+			tx.Rollback()
+			return
+		}
+		c.ParentID = parentID
+	}
+
+	_, err = tx.Exec("UPDATE `categories` SET `parent_id` = ?, `category_name` = ? WHERE `id` = ?",
+		c.ParentID,
+		c.CategoryName,
+		c.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	reloadCategories()
+
+	t := currentCategoryTree()
+	c, _ = t.Get(c.ID)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(newResCategory(t, c))
+}
+
+func deleteAdminCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, err := strconv.Atoi(pat.Param(r, "category_id"))
+	if err != nil || categoryID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect category id")
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	c := Category{}
+	err = tx.Get(&c, "SELECT * FROM `categories` WHERE `id` = ? FOR UPDATE", categoryID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "category not found")
+		tx.Rollback()
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	var children int
+	err = tx.Get(&children, "SELECT COUNT(*) FROM `categories` WHERE `parent_id` = ?", categoryID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if children > 0 {
+		outputErrorMsg(w, http.StatusConflict, "category has child categories")
+		tx.Rollback()
+		return
+	}
+
+	// a shared lock keeps items from being put into the category meanwhile
+	var items int
+	err = tx.Get(&items, "SELECT COUNT(*) FROM `items` WHERE `category_id` = ? LOCK IN SHARE MODE", categoryID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+	if items > 0 {
+		outputErrorMsg(w, http.StatusConflict, "category still has items")
+		tx.Rollback()
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM `categories` WHERE `id` = ?", categoryID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	reloadCategories()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	PaymentStatePending      = "pending"
+	PaymentStateCaptured     = "captured"
+	PaymentStateCompensating = "compensating"
+	PaymentStateCompensated  = "compensated"
+
+	// a buy request never holds a payment in pending for longer than this, so
+	// anything older was left behind by a crash
+	PaymentPendingTimeout = 1 * time.Minute
+
+	CompensationInterval   = 10 * time.Second
+	CompensationBatchSize  = 100
+	CompensationMinBackoff = 5 * time.Second
+	CompensationMaxBackoff = 10 * time.Minute
+)
+
+var ErrPaymentNotPending = errors.New("payment is no longer pending")
+
+// Payment is the saga log of a purchase. It is written outside of the buy
+// transaction so that it survives the rollback it may have to compensate for.
+type Payment struct {
+	ID                    int64     `json:"id" db:"id"`
+	ItemID                int64     `json:"item_id" db:"item_id"`
+	SellerID              int64     `json:"seller_id" db:"seller_id"`
+	BuyerID               int64     `json:"buyer_id" db:"buyer_id"`
+	TransactionEvidenceID int64     `json:"transaction_evidence_id" db:"transaction_evidence_id"`
+	Token                 string    `json:"-" db:"token"`
+	Price                 int       `json:"price" db:"price"`
+	PaymentStatus         string    `json:"payment_status" db:"payment_status"`
+	ReserveID             string    `json:"reserve_id" db:"reserve_id"`
+	State                 string    `json:"state" db:"state"`
+	RefundStatus          string    `json:"refund_status" db:"refund_status"`
+	ShipmentCancelled     bool      `json:"shipment_cancelled" db:"shipment_cancelled"`
+	Attempts              int       `json:"attempts" db:"attempts"`
+	LastError             string    `json:"last_error" db:"last_error"`
+	NextAttemptAt         time.Time `json:"-" db:"next_attempt_at"`
+	CreatedAt             time.Time `json:"-" db:"created_at"`
+	UpdatedAt             time.Time `json:"-" db:"updated_at"`
+}
+
+func beginPayment(item Item, buyerID int64, token string) (*Payment, error) {
+	p := &Payment{
+		ItemID:   item.ID,
+		SellerID: item.SellerID,
+		BuyerID:  buyerID,
+		Token:    token,
+		Price:    item.Price,
+		State:    PaymentStatePending,
+	}
+
+	result, err := dbx.Exec("INSERT INTO `payments` (`item_id`, `seller_id`, `buyer_id`, `token`, `price`, `state`) VALUES (?, ?, ?, ?, ?, ?)",
+		p.ItemID,
+		p.SellerID,
+		p.BuyerID,
+		p.Token,
+		p.Price,
+		p.State,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.ID, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// record stores what the external services answered. It goes through dbx so
+// the outcome is durable even if the buy transaction is rolled back.
+func (p *Payment) record(paymentStatus, reserveID string) error {
+	p.PaymentStatus = paymentStatus
+	p.ReserveID = reserveID
+
+	_, err := dbx.Exec("UPDATE `payments` SET `payment_status` = ?, `reserve_id` = ? WHERE `id` = ?",
+		p.PaymentStatus,
+		p.ReserveID,
+		p.ID,
+	)
+	return err
+}
+
+// capture marks the payment as settled inside the buy transaction, so it only
+// becomes captured if the purchase itself is committed. It returns
+// ErrPaymentNotPending when the compensator has already taken the payment
+// over; the purchase must then be rolled back, as the charge is being
+// refunded.
+func (p *Payment) capture(tx *sqlx.Tx, transactionEvidenceID int64) error {
+	result, err := tx.Exec("UPDATE `payments` SET `state` = ?, `transaction_evidence_id` = ? WHERE `id` = ? AND `state` = ?",
+		PaymentStateCaptured,
+		transactionEvidenceID,
+		p.ID,
+		PaymentStatePending,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPaymentNotPending
+	}
+
+	p.TransactionEvidenceID = transactionEvidenceID
+	p.State = PaymentStateCaptured
+	return nil
+}
+
+// abort hands the payment over to the compensator after the buy transaction
+// has been given up. The first attempt runs right away in the background.
+func (p *Payment) abort(reason string) {
+	err := markPaymentCompensating(dbx, p.ID, reason)
+	if err != nil {
+		// the row stays pending and is picked up once PaymentPendingTimeout passes
+		log.Print(err)
+		return
+	}
+
+	go compensatePayment(p.ID)
+}
+
+func markPaymentCompensating(e sqlx.Execer, paymentID int64, reason string) error {
+	_, err := e.Exec("UPDATE `payments` SET `state` = ?, `last_error` = ?, `next_attempt_at` = ? WHERE `id` = ? AND `state` IN (?, ?)",
+		PaymentStateCompensating,
+		truncateError(reason),
+		time.Now(),
+		paymentID,
+		PaymentStatePending,
+		PaymentStateCaptured,
+	)
+	return err
+}
+
+// compensatePayment refunds the charge and cancels the shipment reservation of
+// a payment in compensating. Steps that already succeeded are not repeated.
+func compensatePayment(paymentID int64) {
+	p := Payment{}
+	err := dbx.Get(&p, "SELECT * FROM `payments` WHERE `id` = ?", paymentID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if p.State != PaymentStateCompensating {
+		return
+	}
+
+	errs := []string{}
+
+	// an empty payment_status means we crashed before hearing back, so the
+	// charge may or may not exist
+	needsRefund := p.PaymentStatus == PaymentStatusOK || p.PaymentStatus == ""
+	if needsRefund && p.RefundStatus == "" {
+		prr, err := paymentService.Refund(&APIPaymentServiceRefundReq{
+			ShopID: PaymentServiceIsucariShopID,
+			Token:  p.Token,
+			APIKey: PaymentServiceIsucariAPIKey,
+			Price:  p.Price,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("refund: %v", err))
+		} else if prr.Status != PaymentRefundStatusOK && prr.Status != PaymentRefundStatusNotFound {
+			errs = append(errs, fmt.Sprintf("refund: unexpected status %q", prr.Status))
+		} else {
+			p.RefundStatus = prr.Status
+		}
+	}
+
+	if p.ReserveID != "" && !p.ShipmentCancelled {
+		err := shipmentService.Cancel(&APIShipmentCancelReq{
+			ReserveID: p.ReserveID,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("shipment cancel: %v", err))
+		} else {
+			p.ShipmentCancelled = true
+		}
+	}
+
+	state := PaymentStateCompensated
+	lastError := ""
+	nextAttemptAt := time.Now()
+	if len(errs) > 0 {
+		state = PaymentStateCompensating
+		lastError = strings.Join(errs, "; ")
+		nextAttemptAt = nextAttemptAt.Add(compensationBackoff(p.Attempts + 1))
+		log.Printf("compensation of payment %d failed: %s", p.ID, lastError)
+	}
+
+	_, err = dbx.Exec("UPDATE `payments` SET `state` = ?, `refund_status` = ?, `shipment_cancelled` = ?, `attempts` = `attempts` + 1, `last_error` = ?, `next_attempt_at` = ? WHERE `id` = ? AND `state` = ?",
+		state,
+		p.RefundStatus,
+		p.ShipmentCancelled,
+		truncateError(lastError),
+		nextAttemptAt,
+		p.ID,
+		PaymentStateCompensating,
+	)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func compensationBackoff(attempts int) time.Duration {
+	d := CompensationMinBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= CompensationMaxBackoff {
+			return CompensationMaxBackoff
+		}
+	}
+	return d
+}
+
+// runPaymentCompensator retries unresolved compensations, including the ones
+// left pending by a crash in the middle of postBuy.
+func runPaymentCompensator() {
+	for {
+		_, err := dbx.Exec("UPDATE `payments` SET `state` = ?, `last_error` = ?, `next_attempt_at` = ? WHERE `state` = ? AND `created_at` < ?",
+			PaymentStateCompensating,
+			"abandoned while pending",
+			time.Now(),
+			PaymentStatePending,
+			time.Now().Add(-PaymentPendingTimeout),
+		)
+		if err != nil {
+			log.Print(err)
+		}
+
+		ids := []int64{}
+		err = dbx.Select(&ids, "SELECT `id` FROM `payments` WHERE `state` = ? AND `next_attempt_at` <= ? ORDER BY `next_attempt_at` LIMIT ?",
+			PaymentStateCompensating,
+			time.Now(),
+			CompensationBatchSize,
+		)
+		if err != nil {
+			log.Print(err)
+		}
+		for _, id := range ids {
+			compensatePayment(id)
+		}
+
+		time.Sleep(CompensationInterval)
+	}
+}
+
+func truncateError(msg string) string {
+	r := []rune(msg)
+	if len(r) > 1024 {
+		return string(r[:1024])
+	}
+	return msg
+}
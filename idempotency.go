@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+	IdempotencyKeyMaxLength   = 191
+
+	IdempotencyStateProcessing = "processing"
+	IdempotencyStateCompleted  = "completed"
+
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// a request still processing after this long was lost with its server
+	IdempotencyProcessingTimeout = 1 * time.Minute
+	IdempotencyCleanupInterval   = 10 * time.Minute
+)
+
+var idempotencyTTL = DefaultIdempotencyTTL
+
+type IdempotencyKey struct {
+	UserID       int64     `db:"user_id"`
+	Key          string    `db:"idempotency_key"`
+	Method       string    `db:"method"`
+	Path         string    `db:"path"`
+	Fingerprint  string    `db:"fingerprint"`
+	State        string    `db:"state"`
+	StatusCode   int       `db:"status_code"`
+	ContentType  string    `db:"content_type"`
+	ResponseBody []byte    `db:"response_body"`
+	ExpiresAt    time.Time `db:"expires_at"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// withIdempotency stores the response of a request carrying an
+// Idempotency-Key and replays it for retries with the same key and body.
+// Keys are scoped per user; requests without a key or a session pass through.
+func withIdempotency(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > IdempotencyKeyMaxLength {
+			outputErrorMsg(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+
+		userID, ok := getSession(r).Values["user_id"].(int64)
+		if !ok {
+			h(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			outputErrorMsg(w, http.StatusBadRequest, "read body error")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.New()
+		sum.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		acquired, stored, err := acquireIdempotencyKey(userID, key, r, fingerprint)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		if !acquired {
+			if stored.Fingerprint != fingerprint || stored.Method != r.Method || stored.Path != r.URL.Path {
+				outputErrorMsg(w, http.StatusUnprocessableEntity, "Idempotency-Key is already used for a different request")
+				return
+			}
+			if stored.State != IdempotencyStateCompleted {
+				outputErrorMsg(w, http.StatusConflict, "a request with the same Idempotency-Key is in progress")
+				return
+			}
+
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(IdempotencyReplayedHeader, "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.ResponseBody)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// server errors are not stored so that the client can retry them
+		if rec.status >= http.StatusInternalServerError {
+			_, err = dbx.Exec("DELETE FROM `idempotency_keys` WHERE `user_id` = ? AND `idempotency_key` = ?", userID, key)
+			if err != nil {
+				log.Print(err)
+			}
+			return
+		}
+
+		_, err = dbx.Exec("UPDATE `idempotency_keys` SET `state` = ?, `status_code` = ?, `content_type` = ?, `response_body` = ? WHERE `user_id` = ? AND `idempotency_key` = ?",
+			IdempotencyStateCompleted,
+			rec.status,
+			w.Header().Get("Content-Type"),
+			rec.body.Bytes(),
+			userID,
+			key,
+		)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// acquireIdempotencyKey claims the key for this request. If someone else holds
+// it, the stored entry is returned instead.
+func acquireIdempotencyKey(userID int64, key string, r *http.Request, fingerprint string) (bool, *IdempotencyKey, error) {
+	for retry := 0; retry < 2; retry++ {
+		now := time.Now()
+		result, err := dbx.Exec("INSERT IGNORE INTO `idempotency_keys` (`user_id`, `idempotency_key`, `method`, `path`, `fingerprint`, `state`, `expires_at`, `created_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			userID,
+			key,
+			r.Method,
+			r.URL.Path,
+			fingerprint,
+			IdempotencyStateProcessing,
+			now.Add(idempotencyTTL),
+			now,
+		)
+		if err != nil {
+			return false, nil, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return false, nil, err
+		}
+		if affected == 1 {
+			return true, nil, nil
+		}
+
+		stored := IdempotencyKey{}
+		err = dbx.Get(&stored, "SELECT * FROM `idempotency_keys` WHERE `user_id` = ? AND `idempotency_key` = ?", userID, key)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return false, nil, err
+		}
+
+		expired := stored.ExpiresAt.Before(now)
+		abandoned := stored.State == IdempotencyStateProcessing && stored.CreatedAt.Before(now.Add(-IdempotencyProcessingTimeout))
+		if !expired && !abandoned {
+			return false, &stored, nil
+		}
+
+		_, err = dbx.Exec("DELETE FROM `idempotency_keys` WHERE `user_id` = ? AND `idempotency_key` = ? AND `created_at` = ?",
+			userID,
+			key,
+			stored.CreatedAt,
+		)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	stored := IdempotencyKey{}
+	err := dbx.Get(&stored, "SELECT * FROM `idempotency_keys` WHERE `user_id` = ? AND `idempotency_key` = ?", userID, key)
+	if err != nil {
+		return false, nil, err
+	}
+	return false, &stored, nil
+}
+
+func runIdempotencyKeyCleaner() {
+	for {
+		_, err := dbx.Exec("DELETE FROM `idempotency_keys` WHERE `expires_at` < ?", time.Now())
+		if err != nil {
+			log.Print(err)
+		}
+
+		time.Sleep(IdempotencyCleanupInterval)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	ItemImagesMax = 10
+	// thumbnails are square and cropped from the center
+	ThumbnailSize = 300
+	// guards against decompression bombs: the header is checked before the
+	// pixels are decoded
+	ImageMaxPixels = 50000000
+
+	ImageJPEGQuality     = 90
+	ThumbnailJPEGQuality = 80
+	ThumbnailExt         = ".jpg"
+)
+
+var (
+	ErrUnsupportedImage = errors.New("unsupported image format error")
+	ErrImageTooLarge    = errors.New("image is too large")
+)
+
+type ItemImage struct {
+	ID            int64     `db:"id"`
+	ItemID        int64     `db:"item_id"`
+	Position      int       `db:"position"`
+	ImageName     string    `db:"image_name"`
+	ThumbnailName string    `db:"thumbnail_name"`
+	Width         int       `db:"width"`
+	Height        int       `db:"height"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+type ItemImageURL struct {
+	Position     int    `json:"position"`
+	ImageURL     string `json:"image_url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
+
+func (i *ItemImage) URL() ItemImageURL {
+	return ItemImageURL{
+		Position:     i.Position,
+		ImageURL:     getImageURL(i.ImageName),
+		ThumbnailURL: getImageURL(i.ThumbnailName),
+		Width:        i.Width,
+		Height:       i.Height,
+	}
+}
+
+// getThumbnailURL falls back to the full image for items listed before
+// thumbnails were generated.
+func getThumbnailURL(item Item) string {
+	if item.ThumbnailName == "" {
+		return getImageURL(item.ImageName)
+	}
+	return getImageURL(item.ThumbnailName)
+}
+
+// itemImageFiles returns the uploaded images in the order the form lists
+// them. Older clients send a single "image".
+func itemImageFiles(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		files = r.MultipartForm.File["image"]
+	}
+	return files
+}
+
+type processedImage struct {
+	Data        []byte
+	Ext         string
+	ContentType string
+	Width       int
+	Height      int
+	Thumbnail   []byte
+}
+
+// processImage decodes the upload to learn its real format and encodes it
+// again, which leaves EXIF and any other metadata behind. JPEG orientation is
+// applied to the pixels first so that photos are not shown sideways.
+func processImage(b []byte) (*processedImage, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrUnsupportedImage
+	}
+	if cfg.Width*cfg.Height > ImageMaxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	var img image.Image
+	p := &processedImage{}
+	buf := &bytes.Buffer{}
+	switch format {
+	case "jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, ErrUnsupportedImage
+		}
+		img = applyOrientation(img, jpegOrientation(b))
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: ImageJPEGQuality})
+		p.Ext = ".jpg"
+		p.ContentType = "image/jpeg"
+	case "png":
+		img, err = png.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, ErrUnsupportedImage
+		}
+		err = png.Encode(buf, img)
+		p.Ext = ".png"
+		p.ContentType = "image/png"
+	case "gif":
+		// every frame is kept; the thumbnail is made from the first one
+		var g *gif.GIF
+		g, err = gif.DecodeAll(bytes.NewReader(b))
+		if err != nil || len(g.Image) == 0 {
+			return nil, ErrUnsupportedImage
+		}
+		first := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+		draw.Draw(first, first.Bounds(), g.Image[0], image.Point{}, draw.Src)
+		img = first
+		err = gif.EncodeAll(buf, g)
+		p.Ext = ".gif"
+		p.ContentType = "image/gif"
+	default:
+		return nil, ErrUnsupportedImage
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Data = buf.Bytes()
+	p.Width = img.Bounds().Dx()
+	p.Height = img.Bounds().Dy()
+
+	buf = &bytes.Buffer{}
+	err = jpeg.Encode(buf, makeThumbnail(img, ThumbnailSize), &jpeg.Options{Quality: ThumbnailJPEGQuality})
+	if err != nil {
+		return nil, err
+	}
+	p.Thumbnail = buf.Bytes()
+
+	return p, nil
+}
+
+// jpegOrientation reads the EXIF orientation tag, 1 to 8. It returns 1 when
+// there is none.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return 1
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// the image data starts; metadata comes before it
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(b[i+2:]))
+		if size < 2 || i+2+size > len(b) {
+			return 1
+		}
+		seg := b[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e+12 <= len(tiff) && n > 0; e, n = e+12, n-1 {
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			o := int(order.Uint16(tiff[e+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// applyOrientation turns the pixels the way the EXIF orientation says the
+// image is meant to be shown.
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for sy := 0; sy < h; sy++ {
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-sx, sy
+			case 3:
+				dx, dy = w-1-sx, h-1-sy
+			case 4:
+				dx, dy = sx, h-1-sy
+			case 5:
+				dx, dy = sy, sx
+			case 6:
+				dx, dy = h-1-sy, sx
+			case 7:
+				dx, dy = h-1-sy, w-1-sx
+			case 8:
+				dx, dy = sy, w-1-sx
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// makeThumbnail crops the center square of src and scales it to size by
+// averaging the pixels each thumbnail pixel covers. Transparent areas turn
+// white since thumbnails are JPEG.
+func makeThumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	offset := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	draw.Draw(square, square.Bounds(), src, offset, draw.Over)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, n int
+			for sy := y0; sy < y1; sy++ {
+				i := square.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx, i = sx+1, i+4 {
+					r += int(square.Pix[i])
+					g += int(square.Pix[i+1])
+					bl += int(square.Pix[i+2])
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(bl / n)
+			dst.Pix[j+3] = 0xFF
+		}
+	}
+	return dst
+}
+
+// saveItemImage processes one upload and stores the image and its thumbnail.
+// They are garbage until insertItemImages refers to them.
+func saveItemImage(fh *multipart.FileHeader) (*ItemImage, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := processImage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &ItemImage{
+		Width:  p.Width,
+		Height: p.Height,
+	}
+	img.ImageName, err = putImageBlob(p.Data, p.Ext, p.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	img.ThumbnailName, err = putImageBlob(p.Thumbnail, ThumbnailExt, "image/jpeg")
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func saveItemImages(files []*multipart.FileHeader) ([]*ItemImage, error) {
+	images := make([]*ItemImage, 0, len(files))
+	for _, fh := range files {
+		img, err := saveItemImage(fh)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func insertItemImages(tx *sqlx.Tx, itemID int64, images []*ItemImage) error {
+	for i, img := range images {
+		img.ItemID = itemID
+		img.Position = i
+		_, err := tx.Exec("INSERT INTO `item_images` (`item_id`, `position`, `image_name`, `thumbnail_name`, `width`, `height`) VALUES (?, ?, ?, ?, ?, ?)",
+			img.ItemID,
+			img.Position,
+			img.ImageName,
+			img.ThumbnailName,
+			img.Width,
+			img.Height,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return addBlobRefs(tx, 1, itemImageBlobKeys(images)...)
+}
+
+// copyItemImages gives a relisted item the gallery of the original.
+func copyItemImages(tx *sqlx.Tx, fromItemID, toItemID int64) error {
+	images := []*ItemImage{}
+	err := tx.Select(&images, "SELECT * FROM `item_images` WHERE `item_id` = ?", fromItemID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO `item_images` (`item_id`, `position`, `image_name`, `thumbnail_name`, `width`, `height`) "+
+		"SELECT ?, `position`, `image_name`, `thumbnail_name`, `width`, `height` FROM `item_images` WHERE `item_id` = ?",
+		toItemID,
+		fromItemID,
+	)
+	if err != nil {
+		return err
+	}
+	return addBlobRefs(tx, 1, itemImageBlobKeys(images)...)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+const ItemEditHistoryLimit = 100
+
+var (
+	ErrItemParamsRequired = errors.New("all parameters are required")
+	ErrItemPrice          = errors.New(ItemPriceErrMsg)
+	ErrItemCategory       = errors.New("Incorrect category ID")
+	ErrItemNothingToEdit  = errors.New("nothing to edit")
+)
+
+// validateItem holds the rules postSell and postItemEdit share.
+func validateItem(name, description string, price, categoryID int) (Category, error) {
+	if name == "" || description == "" || price == 0 || categoryID == 0 {
+		return Category{}, ErrItemParamsRequired
+	}
+
+	if price < ItemMinPrice || price > ItemMaxPrice {
+		return Category{}, ErrItemPrice
+	}
+
+	category, err := getCategoryByID(categoryID)
+	if err != nil || category.ParentID == 0 {
+		return Category{}, ErrItemCategory
+	}
+	return category, nil
+}
+
+// itemETag changes with every edit, since postItemEdit always moves
+// updated_at forward by at least a second.
+func itemETag(item Item) string {
+	return fmt.Sprintf("\"%d\"", item.UpdatedAt.Unix())
+}
+
+// itemPrecondition returns the ETag the client last saw: If-Match, or
+// item_updated_at from an earlier response. Clients that send neither edit
+// unconditionally, as before.
+func itemPrecondition(r *http.Request, updatedAt int64) string {
+	if v := strings.TrimSpace(r.Header.Get("If-Match")); v != "" {
+		return strings.TrimPrefix(v, "W/")
+	}
+	if updatedAt > 0 {
+		return fmt.Sprintf("\"%d\"", updatedAt)
+	}
+	return ""
+}
+
+// parseItemEdit reads the JSON body, or the form when new images are
+// uploaded along with the edit.
+func parseItemEdit(r *http.Request) (*reqItemEdit, error) {
+	rie := &reqItemEdit{}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err := json.NewDecoder(r.Body).Decode(rie)
+		if err != nil {
+			return nil, errors.New("json decode error")
+		}
+		return rie, nil
+	}
+
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		return nil, errors.New("form parse error")
+	}
+	form := r.MultipartForm.Value
+	formInt := func(key string) (*int, error) {
+		if len(form[key]) == 0 {
+			return nil, nil
+		}
+		v, err := strconv.Atoi(form[key][0])
+		if err != nil {
+			return nil, fmt.Errorf("%s param error", key)
+		}
+		return &v, nil
+	}
+	formString := func(key string) *string {
+		if len(form[key]) == 0 {
+			return nil
+		}
+		return &form[key][0]
+	}
+
+	rie.CSRFToken = r.FormValue("csrf_token")
+	rie.ItemID, err = strconv.ParseInt(r.FormValue("item_id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("item_id param error")
+	}
+	if v := r.FormValue("item_updated_at"); v != "" {
+		rie.ItemUpdatedAt, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("item_updated_at param error")
+		}
+	}
+	rie.ItemName = formString("item_name")
+	rie.ItemDescription = formString("item_description")
+	rie.ItemPrice, err = formInt("item_price")
+	if err != nil {
+		return nil, err
+	}
+	rie.ItemCategoryID, err = formInt("item_category_id")
+	if err != nil {
+		return nil, err
+	}
+	return rie, nil
+}
+
+type ItemEditHistory struct {
+	ID        int64     `json:"id" db:"id"`
+	ItemID    int64     `json:"item_id" db:"item_id"`
+	UserID    int64     `json:"user_id" db:"user_id"`
+	Changes   string    `json:"-" db:"changes"`
+	CreatedAt time.Time `json:"-" db:"created_at"`
+}
+
+type itemEditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// resItemEdited is the item after /items/edit, with every field an edit can
+// change.
+type resItemEdited struct {
+	ItemID          int64  `json:"item_id"`
+	ItemName        string `json:"item_name"`
+	ItemDescription string `json:"item_description"`
+	ItemPrice       int    `json:"item_price"`
+	ItemCategoryID  int    `json:"item_category_id"`
+	ItemCreatedAt   int64  `json:"item_created_at"`
+	ItemUpdatedAt   int64  `json:"item_updated_at"`
+}
+
+type resItemEditHistory struct {
+	ID        int64                     `json:"id"`
+	UserID    int64                     `json:"user_id"`
+	Changes   map[string]itemEditChange `json:"changes"`
+	CreatedAt int64                     `json:"created_at"`
+}
+
+// postItemEdit updates the fields present in the request and leaves the
+// others alone. Uploaded images replace the whole gallery.
+func postItemEdit(w http.ResponseWriter, r *http.Request) {
+	rie, err := parseItemEdit(r)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if rie.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+
+		return
+	}
+
+	files := itemImageFiles(r)
+	if len(files) > ItemImagesMax {
+		outputErrorMsg(w, http.StatusBadRequest, fmt.Sprintf("up to %d images can be uploaded", ItemImagesMax))
+		return
+	}
+	if rie.ItemName == nil && rie.ItemDescription == nil && rie.ItemPrice == nil && rie.ItemCategoryID == nil && len(files) == 0 {
+		outputErrorMsg(w, http.StatusBadRequest, ErrItemNothingToEdit.Error())
+		return
+	}
+
+	seller, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	targetItem := Item{}
+	err = dbx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", rie.ItemID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if targetItem.SellerID != seller.ID {
+		outputErrorMsg(w, http.StatusForbidden, "自分の商品以外は編集できません")
+		return
+	}
+
+	images, err := saveItemImages(files)
+	if err == ErrUnsupportedImage || err == ErrImageTooLarge {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "Saving image failed")
+		return
+	}
+
+	tx := dbx.MustBegin()
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", rie.ItemID)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if targetItem.Status != ItemStatusOnSale {
+		outputErrorMsg(w, http.StatusForbidden, "販売中の商品以外編集できません")
+		tx.Rollback()
+		return
+	}
+
+	if etag := itemPrecondition(r, rie.ItemUpdatedAt); etag != "" && etag != "*" && etag != itemETag(targetItem) {
+		w.Header().Set("ETag", itemETag(targetItem))
+		outputErrorMsg(w, http.StatusPreconditionFailed, "item has been updated by another request")
+		tx.Rollback()
+		return
+	}
+
+	edited := targetItem
+	if rie.ItemName != nil {
+		edited.Name = *rie.ItemName
+	}
+	if rie.ItemDescription != nil {
+		edited.Description = *rie.ItemDescription
+	}
+	if rie.ItemPrice != nil {
+		edited.Price = *rie.ItemPrice
+	}
+	if rie.ItemCategoryID != nil {
+		edited.CategoryID = *rie.ItemCategoryID
+	}
+	if len(images) > 0 {
+		edited.ImageName = images[0].ImageName
+		edited.ThumbnailName = images[0].ThumbnailName
+	}
+
+	_, err = validateItem(edited.Name, edited.Description, edited.Price, edited.CategoryID)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		tx.Rollback()
+		return
+	}
+
+	changes := map[string]itemEditChange{}
+	if edited.Name != targetItem.Name {
+		changes["name"] = itemEditChange{targetItem.Name, edited.Name}
+	}
+	if edited.Description != targetItem.Description {
+		changes["description"] = itemEditChange{targetItem.Description, edited.Description}
+	}
+	if edited.Price != targetItem.Price {
+		changes["price"] = itemEditChange{targetItem.Price, edited.Price}
+	}
+	if edited.CategoryID != targetItem.CategoryID {
+		changes["category_id"] = itemEditChange{targetItem.CategoryID, edited.CategoryID}
+	}
+
+	if len(images) > 0 {
+		oldNames, err := replaceItemImages(tx, targetItem, images)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+		newNames := make([]string, 0, len(images))
+		for _, img := range images {
+			newNames = append(newNames, img.ImageName)
+		}
+		changes["images"] = itemEditChange{oldNames, newNames}
+	}
+
+	_, err = tx.Exec("UPDATE `items` SET `name` = ?, `description` = ?, `price` = ?, `category_id` = ?, `image_name` = ?, `thumbnail_name` = ?, `updated_at` = GREATEST(?, `updated_at` + INTERVAL 1 SECOND) WHERE `id` = ?",
+		edited.Name,
+		edited.Description,
+		edited.Price,
+		edited.CategoryID,
+		edited.ImageName,
+		edited.ThumbnailName,
+		time.Now(),
+		rie.ItemID,
+	)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	if len(changes) > 0 {
+		b, _ := json.Marshal(changes)
+		_, err = tx.Exec("INSERT INTO `item_edit_histories` (`item_id`, `user_id`, `changes`) VALUES (?, ?, ?)",
+			rie.ItemID,
+			seller.ID,
+			string(b),
+		)
+		if err == nil {
+			err = writeAudit(tx, requestAuditActor(r, seller.ID, string(TradeRoleSeller)), AuditEvent{
+				Action:       "edit",
+				EntityType:   AuditEntityItem,
+				EntityID:     rie.ItemID,
+				ItemID:       rie.ItemID,
+				UserID:       seller.ID,
+				StatusBefore: targetItem.Status,
+				StatusAfter:  targetItem.Status,
+			}, changes)
+		}
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			tx.Rollback()
+			return
+		}
+	}
+
+	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", rie.ItemID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+	searchIndex.Put(targetItem)
+
+	w.Header().Set("ETag", itemETag(targetItem))
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(&resItemEdited{
+		ItemID:          targetItem.ID,
+		ItemName:        targetItem.Name,
+		ItemDescription: targetItem.Description,
+		ItemPrice:       targetItem.Price,
+		ItemCategoryID:  targetItem.CategoryID,
+		ItemCreatedAt:   targetItem.CreatedAt.Unix(),
+		ItemUpdatedAt:   targetItem.UpdatedAt.Unix(),
+	})
+}
+
+// replaceItemImages swaps the gallery of the item and returns the names of
+// the images it had. Items listed before galleries only had image_name.
+func replaceItemImages(tx *sqlx.Tx, item Item, images []*ItemImage) ([]string, error) {
+	old := []*ItemImage{}
+	err := tx.Select(&old, "SELECT * FROM `item_images` WHERE `item_id` = ? ORDER BY `position`", item.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	oldNames := make([]string, 0, len(old))
+	for _, img := range old {
+		oldNames = append(oldNames, img.ImageName)
+	}
+	if len(old) == 0 {
+		oldNames = append(oldNames, item.ImageName)
+	}
+
+	_, err = tx.Exec("DELETE FROM `item_images` WHERE `item_id` = ?", item.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = addBlobRefs(tx, -1, itemImageBlobKeys(old)...)
+	if err != nil {
+		return nil, err
+	}
+	return oldNames, insertItemImages(tx, item.ID, images)
+}
+
+// getItemEditHistories lists the edits of an item, newest first, to its
+// seller.
+func getItemEditHistories(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.ParseInt(pat.Param(r, "item_id"), 10, 64)
+	if err != nil || itemID <= 0 {
+		outputErrorMsg(w, http.StatusBadRequest, "incorrect item id")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	item := Item{}
+	err = dbx.Get(&item, "SELECT * FROM `items` WHERE `id` = ?", itemID)
+	if err == sql.ErrNoRows {
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if item.SellerID != user.ID {
+		outputErrorMsg(w, http.StatusForbidden, "自分の商品以外は編集履歴を見られません")
+		return
+	}
+
+	histories := []ItemEditHistory{}
+	err = dbx.Select(&histories, "SELECT * FROM `item_edit_histories` WHERE `item_id` = ? ORDER BY `id` DESC LIMIT ?", itemID, ItemEditHistoryLimit)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	res := make([]resItemEditHistory, 0, len(histories))
+	for _, h := range histories {
+		rh := resItemEditHistory{
+			ID:        h.ID,
+			UserID:    h.UserID,
+			CreatedAt: h.CreatedAt.Unix(),
+		}
+		err = json.Unmarshal([]byte(h.Changes), &rh.Changes)
+		if err != nil {
+			log.Print(err)
+		}
+		res = append(res, rh)
+	}
+
+	w.Header().Set("ETag", itemETag(item))
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
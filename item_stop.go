@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrTradeItemNotStoppable = &TradeError{http.StatusForbidden, "販売中の商品以外は出品停止できません"}
+	ErrTradeItemNotStopped   = &TradeError{http.StatusForbidden, "出品停止中の商品ではありません"}
+
+	// TradeStop withdraws an item from sale. It locks the item like TradeBuy,
+	// so exactly one of a stop and a purchase racing each other succeeds.
+	TradeStop = &TradeTransition{
+		Name:     "stop",
+		Roles:    []TradeRole{TradeRoleSeller, TradeRoleSystem},
+		ItemFrom: []string{ItemStatusOnSale},
+		ItemTo:   ItemStatusStop,
+		RoleErr:  ErrTradeForbidden,
+		ItemErr:  ErrTradeItemNotStoppable,
+	}
+	TradeResume = &TradeTransition{
+		Name:     "resume",
+		Roles:    []TradeRole{TradeRoleSeller, TradeRoleSystem},
+		ItemFrom: []string{ItemStatusStop},
+		ItemTo:   ItemStatusOnSale,
+		RoleErr:  ErrTradeForbidden,
+		ItemErr:  ErrTradeItemNotStopped,
+	}
+)
+
+type reqItemStop struct {
+	CSRFToken string `json:"csrf_token"`
+	ItemID    int64  `json:"item_id"`
+}
+
+type resItemStop struct {
+	ItemID     int64  `json:"item_id"`
+	ItemStatus string `json:"item_status"`
+}
+
+// applyStop runs TradeStop or TradeResume and moves num_sell_items of the
+// seller along, so that stopped items are not counted as listed. The users
+// row is locked after the item, as in relistItem. Only a moderator can
+// resume an item a moderator stopped.
+func applyStop(tx *sqlx.Tx, t *TradeTransition, st *TradeState, role TradeRole, actor AuditActor) error {
+	err := t.Check(st, role)
+	if err != nil {
+		return err
+	}
+	if t == TradeResume && role != TradeRoleSystem && st.Item.StopReason != "" {
+		return ErrTradeItemForceStopped
+	}
+	err = t.Apply(tx, st, "", actor)
+	if err != nil {
+		return err
+	}
+	if t == TradeResume && st.Item.StopReason != "" {
+		_, err = tx.Exec("UPDATE `items` SET `stop_reason` = '' WHERE `id` = ?", st.Item.ID)
+		if err != nil {
+			log.Print(err)
+			return ErrTradeDB
+		}
+		st.Item.StopReason = ""
+	}
+
+	delta := 1
+	if t == TradeStop {
+		delta = -1
+	}
+	_, err = tx.Exec("UPDATE `users` SET `num_sell_items` = GREATEST(CAST(`num_sell_items` AS SIGNED) + ?, 0) WHERE `id` = ?",
+		delta,
+		st.Item.SellerID,
+	)
+	if err != nil {
+		log.Print(err)
+		return ErrTradeDB
+	}
+	return nil
+}
+
+func postItemStop(w http.ResponseWriter, r *http.Request) {
+	changeItemListing(w, r, TradeStop)
+}
+
+func postItemResume(w http.ResponseWriter, r *http.Request) {
+	changeItemListing(w, r, TradeResume)
+}
+
+func changeItemListing(w http.ResponseWriter, r *http.Request, t *TradeTransition) {
+	ris := reqItemStop{}
+	err := json.NewDecoder(r.Body).Decode(&ris)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if ris.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, err := lockTrade(tx, ris.ItemID)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	role := st.Role(user.ID)
+	err = applyStop(tx, t, st, role, requestAuditActor(r, user.ID, string(role)))
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	invalidateUser(st.Item.SellerID)
+	searchIndex.Put(st.Item)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resItemStop{
+		ItemID:     st.Item.ID,
+		ItemStatus: st.Item.Status,
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DefaultItemViewFlushInterval = 1 * time.Second
+	ItemViewFlushBatchSize       = 500
+
+	DefaultItemViewRankingInterval = 5 * time.Minute
+	// how long a ranking is kept after it was taken, and so about how long
+	// the cursors of the popular sort stay valid
+	ItemViewRankingRetention = 1 * time.Hour
+)
+
+var itemViews = NewItemViewCounter()
+
+// ItemViewCounter buffers the views of item pages, so that getItem does not
+// write and popular items do not contend on their item_views row. Views not
+// flushed yet are lost when the process stops.
+type ItemViewCounter struct {
+	mu     sync.Mutex
+	counts map[int64]int64
+}
+
+func NewItemViewCounter() *ItemViewCounter {
+	return &ItemViewCounter{counts: map[int64]int64{}}
+}
+
+// recordItemView counts a view of the item page for the popular sort.
+func recordItemView(itemID int64) {
+	itemViews.Add(itemID, 1)
+}
+
+func (c *ItemViewCounter) Add(itemID, views int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[itemID] += views
+}
+
+// Flush adds the buffered views to item_views, a batch of rows per statement
+// in item order so that instances flushing at once do not deadlock. The views
+// of a batch that fails are kept for the next flush.
+func (c *ItemViewCounter) Flush(e sqlx.Execer) error {
+	c.mu.Lock()
+	counts := c.counts
+	c.counts = map[int64]int64{}
+	c.mu.Unlock()
+
+	itemIDs := make([]int64, 0, len(counts))
+	for id := range counts {
+		itemIDs = append(itemIDs, id)
+	}
+	sort.Slice(itemIDs, func(i, j int) bool { return itemIDs[i] < itemIDs[j] })
+
+	var firstErr error
+	for len(itemIDs) > 0 {
+		batch := itemIDs
+		if len(batch) > ItemViewFlushBatchSize {
+			batch = batch[:ItemViewFlushBatchSize]
+		}
+		itemIDs = itemIDs[len(batch):]
+
+		values := make([]string, 0, len(batch))
+		args := make([]interface{}, 0, len(batch)*2)
+		for _, id := range batch {
+			values = append(values, "(?, ?)")
+			args = append(args, id, counts[id])
+		}
+		_, err := e.Exec("INSERT INTO `item_views` (`item_id`, `views`) VALUES "+strings.Join(values, ", ")+
+			" ON DUPLICATE KEY UPDATE `views` = `views` + VALUES(`views`)", args...)
+		if err != nil {
+			for _, id := range batch {
+				c.Add(id, counts[id])
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func runItemViewFlusher(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		err := itemViews.Flush(dbx)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// The popular sort pages over a ranking, a snapshot of item_views taken every
+// few minutes. The cursor names the ranking of its first page, so the sort
+// key of every item stays put while the client pages, however the views
+// change in the meantime.
+type ItemViewRanking struct {
+	ID        int64     `db:"id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// latestItemViewRanking returns the ID of the newest ranking, or 0 before the
+// first one is taken, which ranks every item at 0 views.
+func latestItemViewRanking(q sqlx.Queryer) (int64, error) {
+	var id sql.NullInt64
+	err := sqlx.Get(q, &id, "SELECT MAX(`id`) FROM `item_view_rankings`")
+	if err != nil {
+		return 0, err
+	}
+	return id.Int64, nil
+}
+
+func itemViewRankingExists(q sqlx.Queryer, id int64) (bool, error) {
+	if id == 0 {
+		return true, nil
+	}
+	var n int
+	err := sqlx.Get(q, &n, "SELECT COUNT(*) FROM `item_view_rankings` WHERE `id` = ?", id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func runItemViewRanker(interval time.Duration) {
+	for {
+		err := rankItemViews(interval)
+		if err != nil {
+			log.Print(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// rankItemViews takes a ranking unless one is less than interval old, which
+// another instance may have taken, and drops those past the retention.
+// Instances racing here take one extra ranking at worst.
+func rankItemViews(interval time.Duration) error {
+	now := time.Now()
+
+	var n int
+	err := dbx.Get(&n, "SELECT COUNT(*) FROM `item_view_rankings` WHERE `created_at` > ?", now.Add(-interval))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	tx, err := dbx.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO `item_view_rankings` (`created_at`) VALUES (?)", now)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO `item_view_ranks` (`ranking_id`, `item_id`, `views`) SELECT ?, `item_id`, `views` FROM `item_views`", id)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	expired := []int64{}
+	err = dbx.Select(&expired, "SELECT `id` FROM `item_view_rankings` WHERE `created_at` < ? AND `id` < ?", now.Add(-ItemViewRankingRetention), id)
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		_, err = dbx.Exec("DELETE FROM `item_view_rankings` WHERE `id` = ?", id)
+		if err != nil {
+			return err
+		}
+		_, err = dbx.Exec("DELETE FROM `item_view_ranks` WHERE `ranking_id` = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
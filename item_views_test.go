@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+type failingExecer struct{}
+
+func (failingExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return nil, errors.New("connection lost")
+}
+
+func testItemViews(t *testing.T, itemID int64) int64 {
+	t.Helper()
+
+	var views int64
+	err := dbx.Get(&views, "SELECT `views` FROM `item_views` WHERE `item_id` = ?", itemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return views
+}
+
+func TestItemViewCounterFlush(t *testing.T) {
+	setupTestDB(t)
+	c := NewItemViewCounter()
+
+	c.Add(1, 1)
+	c.Add(1, 1)
+	c.Add(2, 3)
+	err := c.Flush(dbx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1, v2 := testItemViews(t, 1), testItemViews(t, 2); v1 != 2 || v2 != 3 {
+		t.Errorf("views %d and %d, want 2 and 3", v1, v2)
+	}
+
+	// a failed flush keeps the views for the next one
+	c.Add(1, 5)
+	if err = c.Flush(failingExecer{}); err == nil {
+		t.Fatal("flush to a failing database succeeded")
+	}
+	c.Add(1, 1)
+	err = c.Flush(dbx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1 := testItemViews(t, 1); v1 != 8 {
+		t.Errorf("views %d, want 8", v1)
+	}
+
+	// nothing is left to write twice
+	err = c.Flush(dbx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1 := testItemViews(t, 1); v1 != 8 {
+		t.Errorf("views %d after an empty flush, want 8", v1)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	ListingSortCreated   = "created"
+	ListingSortPriceAsc  = "price_asc"
+	ListingSortPriceDesc = "price_desc"
+	ListingSortPopular   = "popular"
+)
+
+var (
+	listingStatuses = []string{ItemStatusOnSale, ItemStatusSoldOut}
+	// lower bounds of the price buckets after the first one, which starts at 0
+	listingPriceBucketEdges = []int{1000, 5000, 10000, 50000}
+)
+
+// ListingQuery holds the filters, the sort order and the page for
+// /new_items.json and /new_items/:root_category_id.json.
+type ListingQuery struct {
+	PriceMin int
+	PriceMax int
+	Statuses []string
+	SellerID int64
+	Sort     string
+	Page     *Page
+	// the ranking the popular sort pages over, set by SelectItems
+	RankingID int64
+}
+
+// listedItem is an item with the number of times its page has been viewed,
+// which is what popular sorts by.
+type listedItem struct {
+	Item
+	ViewCount int64 `db:"view_count"`
+}
+
+type ListingFacets struct {
+	Categories   []CategoryFacet    `json:"categories"`
+	PriceBuckets []PriceBucketFacet `json:"price_buckets"`
+}
+
+type CategoryFacet struct {
+	CategoryID   int    `json:"category_id"`
+	CategoryName string `json:"category_name"`
+	Count        int    `json:"count"`
+}
+
+type PriceBucketFacet struct {
+	Min   int `json:"min"`
+	Max   int `json:"max,omitempty"`
+	Count int `json:"count"`
+}
+
+func parseListingQuery(query url.Values, scope string) (*ListingQuery, error) {
+	lq := &ListingQuery{
+		Statuses: listingStatuses,
+		Sort:     ListingSortCreated,
+	}
+
+	var err error
+	if v := query.Get("price_min"); v != "" {
+		lq.PriceMin, err = strconv.Atoi(v)
+		if err != nil || lq.PriceMin < 0 {
+			return nil, errors.New("price_min param error")
+		}
+	}
+	if v := query.Get("price_max"); v != "" {
+		lq.PriceMax, err = strconv.Atoi(v)
+		if err != nil || lq.PriceMax < 0 {
+			return nil, errors.New("price_max param error")
+		}
+	}
+	if lq.PriceMax > 0 && lq.PriceMin > lq.PriceMax {
+		return nil, errors.New("price_min must not exceed price_max")
+	}
+	if v := query.Get("status"); v != "" {
+		lq.Statuses = strings.Split(v, ",")
+		for _, status := range lq.Statuses {
+			if !containsStatus(listingStatuses, status) {
+				return nil, errors.New("status param error")
+			}
+		}
+	}
+	if v := query.Get("seller_id"); v != "" {
+		lq.SellerID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || lq.SellerID <= 0 {
+			return nil, errors.New("seller_id param error")
+		}
+	}
+	if v := query.Get("sort"); v != "" {
+		switch v {
+		case ListingSortCreated, ListingSortPriceAsc, ListingSortPriceDesc, ListingSortPopular:
+			lq.Sort = v
+		default:
+			return nil, errors.New("sort param error")
+		}
+	}
+
+	lq.Page, err = parsePage(query, scope, ItemsPerPage)
+	if err != nil {
+		return nil, err
+	}
+	if lq.Page.Cursor != nil && lq.Page.Cursor.Sort != lq.Sort {
+		return nil, ErrCursorMismatch
+	}
+
+	return lq, nil
+}
+
+// IsFirstPage tells whether the request carries no cursor; facets are only
+// computed then.
+func (lq *ListingQuery) IsFirstPage() bool {
+	return lq.Page.Cursor == nil
+}
+
+// NextCursor returns the token for the page after item.
+func (lq *ListingQuery) NextCursor(item listedItem) string {
+	return lq.Page.NextCursor(Cursor{
+		Sort:      lq.Sort,
+		ID:        item.ID,
+		CreatedAt: item.CreatedAt.Unix(),
+		Price:     item.Price,
+		ViewCount: item.ViewCount,
+		RankingID: lq.RankingID,
+	})
+}
+
+// filter appends the conditions every query of the listing shares. conds may
+// already hold the conditions of the endpoint itself.
+func (lq *ListingQuery) filter(conds []string, args []interface{}) ([]string, []interface{}) {
+	conds = append(conds, "`items`.`status` IN (?)")
+	args = append(args, lq.Statuses)
+	if lq.PriceMin > 0 {
+		conds = append(conds, "`items`.`price` >= ?")
+		args = append(args, lq.PriceMin)
+	}
+	if lq.PriceMax > 0 {
+		conds = append(conds, "`items`.`price` <= ?")
+		args = append(args, lq.PriceMax)
+	}
+	if lq.SellerID > 0 {
+		conds = append(conds, "`items`.`seller_id` = ?")
+		args = append(args, lq.SellerID)
+	}
+	return conds, args
+}
+
+// SelectItems returns up to one item more than the page size, so that callers
+// can tell whether there is a next page. It returns ErrCursorExpired when the
+// ranking of a popular cursor has been dropped.
+func (lq *ListingQuery) SelectItems(q sqlx.Queryer, conds []string, args []interface{}) ([]listedItem, error) {
+	conds, args = lq.filter(conds, args)
+	c := lq.Page.Cursor
+
+	viewCount := "0"
+	join := ""
+	if lq.Sort == ListingSortPopular {
+		err := lq.selectRanking(q)
+		if err != nil {
+			return nil, err
+		}
+		viewCount = "COALESCE(`item_view_ranks`.`views`, 0)"
+		join = " LEFT JOIN `item_view_ranks` ON `item_view_ranks`.`ranking_id` = ? AND `item_view_ranks`.`item_id` = `items`.`id`"
+		args = append([]interface{}{lq.RankingID}, args...)
+	}
+
+	var order string
+	switch lq.Sort {
+	case ListingSortPriceAsc:
+		order = "`items`.`price` ASC, `items`.`id` DESC"
+		if c != nil {
+			conds = append(conds, "(`items`.`price` > ? OR (`items`.`price` = ? AND `items`.`id` < ?))")
+			args = append(args, c.Price, c.Price, c.ID)
+		}
+	case ListingSortPriceDesc:
+		order = "`items`.`price` DESC, `items`.`id` DESC"
+		if c != nil {
+			conds = append(conds, "(`items`.`price` < ? OR (`items`.`price` = ? AND `items`.`id` < ?))")
+			args = append(args, c.Price, c.Price, c.ID)
+		}
+	case ListingSortPopular:
+		// the counts of a ranking never change, so paging neither skips nor
+		// repeats items
+		order = viewCount + " DESC, `items`.`id` DESC"
+		if c != nil {
+			conds = append(conds, "("+viewCount+" < ? OR ("+viewCount+" = ? AND `items`.`id` < ?))")
+			args = append(args, c.ViewCount, c.ViewCount, c.ID)
+		}
+	default:
+		order = "`items`.`created_at` DESC, `items`.`id` DESC"
+		if c != nil {
+			cond, condArgs := lq.Page.createdKeyset("items")
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+	}
+	args = append(args, lq.Page.Limit+1)
+
+	inQuery, inArgs, err := sqlx.In(
+		"SELECT `items`.*, "+viewCount+" AS `view_count` FROM `items`"+join+
+			" WHERE "+strings.Join(conds, " AND ")+
+			" ORDER BY "+order+" LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []listedItem{}
+	err = sqlx.Select(q, &items, inQuery, inArgs...)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// selectRanking picks the ranking of the cursor, or the newest one for a
+// first page.
+func (lq *ListingQuery) selectRanking(q sqlx.Queryer) error {
+	c := lq.Page.Cursor
+	if c == nil {
+		id, err := latestItemViewRanking(q)
+		lq.RankingID = id
+		return err
+	}
+	ok, err := itemViewRankingExists(q, c.RankingID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCursorExpired
+	}
+	lq.RankingID = c.RankingID
+	return nil
+}
+
+// Facets counts the items matching the filters per category and per price
+// bucket. facetCategory maps the category of an item to the one it is
+// counted under, or returns false to leave the item out.
+func (lq *ListingQuery) Facets(q sqlx.Queryer, conds []string, args []interface{}, facetCategory func(categoryID int) (Category, bool)) (*ListingFacets, error) {
+	conds, args = lq.filter(conds, args)
+	where := " WHERE " + strings.Join(conds, " AND ")
+
+	type categoryCount struct {
+		CategoryID int `db:"category_id"`
+		Count      int `db:"count"`
+	}
+	categoryCounts := []categoryCount{}
+	inQuery, inArgs, err := sqlx.In("SELECT `items`.`category_id`, COUNT(*) AS `count` FROM `items`"+where+" GROUP BY `items`.`category_id`", args...)
+	if err != nil {
+		return nil, err
+	}
+	err = sqlx.Select(q, &categoryCounts, inQuery, inArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	facets := &ListingFacets{
+		Categories:   []CategoryFacet{},
+		PriceBuckets: []PriceBucketFacet{},
+	}
+
+	byCategory := map[int]*CategoryFacet{}
+	for _, cc := range categoryCounts {
+		c, ok := facetCategory(cc.CategoryID)
+		if !ok {
+			continue
+		}
+		f, ok := byCategory[c.ID]
+		if !ok {
+			f = &CategoryFacet{CategoryID: c.ID, CategoryName: c.CategoryName}
+			byCategory[c.ID] = f
+		}
+		f.Count += cc.Count
+	}
+	for _, f := range byCategory {
+		facets.Categories = append(facets.Categories, *f)
+	}
+	sort.Slice(facets.Categories, func(i, j int) bool {
+		return facets.Categories[i].CategoryID < facets.Categories[j].CategoryID
+	})
+
+	// INTERVAL(price, e1, e2, ...) is the index of the bucket
+	edges := make([]string, 0, len(listingPriceBucketEdges))
+	for _, e := range listingPriceBucketEdges {
+		edges = append(edges, strconv.Itoa(e))
+	}
+	type bucketCount struct {
+		Bucket int `db:"bucket"`
+		Count  int `db:"count"`
+	}
+	bucketCounts := []bucketCount{}
+	inQuery, inArgs, err = sqlx.In(fmt.Sprintf("SELECT INTERVAL(`items`.`price`, %s) AS `bucket`, COUNT(*) AS `count` FROM `items`%s GROUP BY `bucket`", strings.Join(edges, ", "), where), args...)
+	if err != nil {
+		return nil, err
+	}
+	err = sqlx.Select(q, &bucketCounts, inQuery, inArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int, len(listingPriceBucketEdges)+1)
+	for _, bc := range bucketCounts {
+		if bc.Bucket >= 0 && bc.Bucket < len(counts) {
+			counts[bc.Bucket] = bc.Count
+		}
+	}
+	for i, count := range counts {
+		b := PriceBucketFacet{Count: count}
+		if i > 0 {
+			b.Min = listingPriceBucketEdges[i-1]
+		}
+		if i < len(listingPriceBucketEdges) {
+			b.Max = listingPriceBucketEdges[i] - 1
+		}
+		facets.PriceBuckets = append(facets.PriceBuckets, b)
+	}
+
+	return facets, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func setTestItemViews(t *testing.T, itemID, views int64) {
+	t.Helper()
+
+	_, err := dbx.Exec("INSERT INTO `item_views` (`item_id`, `views`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `views` = VALUES(`views`)", itemID, views)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// selectTestPopular returns the IDs of a page of two items in the popular
+// sort and the cursor for the next one, empty on the last page.
+func selectTestPopular(t *testing.T, cursor string) ([]int64, string, error) {
+	t.Helper()
+
+	query := url.Values{"sort": {ListingSortPopular}, "limit": {"2"}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	lq, err := parseListingQuery(query, "new_items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := lq.SelectItems(dbx, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(items) > lq.Page.Limit {
+		items = items[:lq.Page.Limit]
+		next = lq.NextCursor(items[lq.Page.Limit-1])
+	}
+	ids := []int64{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids, next, nil
+}
+
+func TestPopularPagesOverFrozenRanking(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	items := []Item{}
+	for i := 0; i < 5; i++ {
+		items = append(items, insertTestItem(t, seller.User.ID, 100))
+	}
+	for i, views := range []int64{50, 40, 30, 20, 10} {
+		setTestItemViews(t, items[i].ID, views)
+	}
+	err := rankItemViews(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen, cursor, err := selectTestPopular(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondPage := cursor
+
+	// the last item overtakes the first page before the next ones are
+	// loaded, in a ranking taken meanwhile too
+	setTestItemViews(t, items[4].ID, 100)
+	err = rankItemViews(time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cursor != "" {
+		var ids []int64
+		ids, cursor, err = selectTestPopular(t, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, ids...)
+	}
+	if len(seen) != len(items) {
+		t.Fatalf("pages hold %v", seen)
+	}
+	for i, id := range seen {
+		if id != items[i].ID {
+			t.Errorf("item %d of the pages is %d, want %d", i, id, items[i].ID)
+		}
+	}
+
+	fresh, _, err := selectTestPopular(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh[0] != items[4].ID {
+		t.Errorf("a new first page starts with %d, want %d", fresh[0], items[4].ID)
+	}
+
+	_, err = dbx.Exec("DELETE FROM `item_view_rankings`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = selectTestPopular(t, secondPage); err != ErrCursorExpired {
+		t.Errorf("cursor of a dropped ranking: %v", err)
+	}
+}
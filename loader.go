@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const QueryCountHeader = "X-Query-Count"
+
+type loaderContextKey struct{}
+
+// countingQueryer counts the queries sent through it.
+type countingQueryer struct {
+	q sqlx.Queryer
+	n int64
+}
+
+func (c *countingQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	atomic.AddInt64(&c.n, 1)
+	return c.q.Query(query, args...)
+}
+
+func (c *countingQueryer) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	atomic.AddInt64(&c.n, 1)
+	return c.q.Queryx(query, args...)
+}
+
+func (c *countingQueryer) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	atomic.AddInt64(&c.n, 1)
+	return c.q.QueryRowx(query, args...)
+}
+
+// TradeSummary is what item responses show of a trade.
+type TradeSummary struct {
+	TransactionEvidence
+	ShippingStatus     string `db:"shipping_status"`
+	CancellationStatus string `db:"cancellation_status"`
+	CancelRequestedBy  int64  `db:"cancel_requested_by"`
+}
+
+// Loader collects the users and trades one response needs and fetches them
+// with one IN query each. It lives for a single request and only counts the
+// queries made through DB().
+type Loader struct {
+	db *countingQueryer
+
+	users  map[int64]*UserSimple
+	trades map[int64]*TradeSummary
+	images map[int64][]ItemImageURL
+}
+
+func NewLoader(q sqlx.Queryer) *Loader {
+	return &Loader{
+		db:     &countingQueryer{q: q},
+		users:  map[int64]*UserSimple{},
+		trades: map[int64]*TradeSummary{},
+		images: map[int64][]ItemImageURL{},
+	}
+}
+
+func (l *Loader) DB() sqlx.Queryer {
+	return l.db
+}
+
+func (l *Loader) QueryCount() int64 {
+	return atomic.LoadInt64(&l.db.n)
+}
+
+// LoadUsers fetches the users not loaded yet that userSimpleCache does not
+// have either.
+func (l *Loader) LoadUsers(userIDs ...int64) error {
+	missing := []int64{}
+	for _, id := range userIDs {
+		if _, ok := l.users[id]; ok || id == 0 {
+			continue
+		}
+		if v, ok := userSimpleCache.Get(id); ok {
+			l.users[id] = v
+			continue
+		}
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	inQuery, inArgs, err := sqlx.In("SELECT * FROM `users` WHERE `id` IN (?)", missing)
+	if err != nil {
+		return err
+	}
+	users := []User{}
+	err = sqlx.Select(l.db, &users, inQuery, inArgs...)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		userSimple := &UserSimple{
+			ID:           u.ID,
+			AccountName:  u.AccountName,
+			NumSellItems: u.NumSellItems,
+		}
+		l.users[u.ID] = userSimple
+		userSimpleCache.Set(u.ID, userSimple)
+	}
+	return nil
+}
+
+func (l *Loader) User(userID int64) (*UserSimple, bool) {
+	u, ok := l.users[userID]
+	return u, ok
+}
+
+// LoadTrades fetches the transaction evidence, the shipping status and the
+// latest cancellation of the items in one query.
+func (l *Loader) LoadTrades(itemIDs ...int64) error {
+	missing := []int64{}
+	for _, id := range itemIDs {
+		if _, ok := l.trades[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	inQuery, inArgs, err := sqlx.In("SELECT `te`.*, IFNULL(`s`.`status`, '') AS `shipping_status`, IFNULL(`c`.`status`, '') AS `cancellation_status`, IFNULL(`c`.`requested_by`, 0) AS `cancel_requested_by` "+
+		"FROM `transaction_evidences` `te` "+
+		"LEFT JOIN `shippings` `s` ON `s`.`transaction_evidence_id` = `te`.`id` "+
+		"LEFT JOIN `trade_cancellations` `c` ON `c`.`id` = (SELECT MAX(`id`) FROM `trade_cancellations` WHERE `transaction_evidence_id` = `te`.`id`) "+
+		"WHERE `te`.`item_id` IN (?)", missing)
+	if err != nil {
+		return err
+	}
+	trades := []*TradeSummary{}
+	err = sqlx.Select(l.db, &trades, inQuery, inArgs...)
+	if err != nil {
+		return err
+	}
+	for _, t := range trades {
+		l.trades[t.ItemID] = t
+	}
+	return nil
+}
+
+func (l *Loader) Trade(itemID int64) (*TradeSummary, bool) {
+	t, ok := l.trades[itemID]
+	return t, ok
+}
+
+// LoadImages fetches the galleries of the items.
+func (l *Loader) LoadImages(itemIDs ...int64) error {
+	missing := []int64{}
+	for _, id := range itemIDs {
+		if _, ok := l.images[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	inQuery, inArgs, err := sqlx.In("SELECT * FROM `item_images` WHERE `item_id` IN (?) ORDER BY `item_id`, `position`", missing)
+	if err != nil {
+		return err
+	}
+	images := []ItemImage{}
+	err = sqlx.Select(l.db, &images, inQuery, inArgs...)
+	if err != nil {
+		return err
+	}
+	for _, id := range missing {
+		l.images[id] = []ItemImageURL{}
+	}
+	for _, img := range images {
+		l.images[img.ItemID] = append(l.images[img.ItemID], img.URL())
+	}
+	return nil
+}
+
+// Images returns the gallery of the item. Items listed before galleries
+// existed get their single image, at imageURL.
+func (l *Loader) Images(itemID int64, imageURL string) []ItemImageURL {
+	if images := l.images[itemID]; len(images) > 0 {
+		return images
+	}
+	return []ItemImageURL{{ImageURL: imageURL, ThumbnailURL: imageURL}}
+}
+
+// Category needs no query; categories are kept in memory.
+func (l *Loader) Category(categoryID int) (Category, error) {
+	return getCategoryByID(categoryID)
+}
+
+// withLoader gives the handler a Loader and reports its query count in the
+// X-Query-Count response header.
+func withLoader(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := NewLoader(dbx)
+		lw := &loaderResponseWriter{ResponseWriter: w, loader: l}
+		h(lw, r.WithContext(context.WithValue(r.Context(), loaderContextKey{}, l)))
+	}
+}
+
+// requestLoader returns the Loader of the request, or a fresh one for
+// handlers that are not wrapped with withLoader.
+func requestLoader(r *http.Request) *Loader {
+	if l, ok := r.Context().Value(loaderContextKey{}).(*Loader); ok {
+		return l
+	}
+	return NewLoader(dbx)
+}
+
+type loaderResponseWriter struct {
+	http.ResponseWriter
+	loader      *Loader
+	wroteHeader bool
+}
+
+func (w *loaderResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(QueryCountHeader, strconv.FormatInt(w.loader.QueryCount(), 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loaderResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// insertTestTrade puts the item in trading with a transaction evidence and a
+// shipping, the rows getTransactions joins.
+func insertTestTrade(t *testing.T, item Item, buyerID int64) {
+	t.Helper()
+
+	_, err := dbx.Exec("UPDATE `items` SET `status` = ?, `buyer_id` = ? WHERE `id` = ?", ItemStatusTrading, buyerID, item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := dbx.Exec("INSERT INTO `transaction_evidences` (`seller_id`, `buyer_id`, `status`, `item_id`, `item_name`, `item_price`, `item_description`, `item_category_id`, `item_root_category_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		item.SellerID, buyerID, TransactionEvidenceStatusWaitShipping, item.ID, item.Name, item.Price, item.Description, item.CategoryID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teID, _ := result.LastInsertId()
+	_, err = dbx.Exec("INSERT INTO `shippings` (`transaction_evidence_id`, `status`, `item_name`, `item_id`, `reserve_id`, `reserve_time`, `to_address`, `to_name`, `from_address`, `from_name`, `img_binary`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		teID, ShippingsStatusInitial, item.Name, item.ID, fmt.Sprintf("%010d", teID), 0, "to address", "to", "from address", "from", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testQueryCount runs a withLoader handler with a cold user cache and returns
+// its X-Query-Count and the number of items on the page.
+func testQueryCount(t *testing.T, c *testClient, h http.HandlerFunc, target string) (int, int) {
+	t.Helper()
+
+	userSimpleCache.Purge()
+	w := c.do(withLoader(h), http.MethodGet, target, nil)
+	n, err := strconv.Atoi(w.Header().Get(QueryCountHeader))
+	if err != nil {
+		t.Fatalf("%s: %s header: %v", target, QueryCountHeader, err)
+	}
+	res := struct {
+		Items []json.RawMessage `json:"items"`
+	}{}
+	decodeTestResponse(t, w, http.StatusOK, &res)
+	return n, len(res.Items)
+}
+
+// TestQueryCountDoesNotGrowWithPageSize checks that the users, trades and
+// images of a page are loaded in batches rather than one query per row.
+func TestQueryCountDoesNotGrowWithPageSize(t *testing.T) {
+	setupTestDB(t)
+	user := registerTestUser(t, "user")
+	// every row has its own seller or buyer, so no user is shared
+	for i := 0; i < 20; i++ {
+		seller := registerTestUser(t, fmt.Sprintf("seller%d", i))
+		buyer := registerTestUser(t, fmt.Sprintf("buyer%d", i))
+		insertTestItem(t, seller.User.ID, 100)
+		insertTestTrade(t, insertTestItem(t, seller.User.ID, 200), user.User.ID)
+		insertTestTrade(t, insertTestItem(t, user.User.ID, 300), buyer.User.ID)
+	}
+
+	// the first page of new items also counts facets, a fixed number of
+	// queries; start after a cursor from the future to leave them out
+	after := url.QueryEscape(encodeCursor(&Cursor{
+		Scope:     "new_items",
+		Sort:      ListingSortCreated,
+		ID:        math.MaxInt64,
+		CreatedAt: time.Now().Add(time.Hour).Unix(),
+	}))
+
+	tests := []struct {
+		name   string
+		h      http.HandlerFunc
+		target string
+	}{
+		{"getNewItems", getNewItems, "/new_items.json?cursor=" + after + "&limit=%d"},
+		{"getTransactions", getTransactions, "/users/transactions.json?limit=%d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, _ := testQueryCount(t, user, tt.h, fmt.Sprintf(tt.target, 1))
+			for _, limit := range []int{5, 10, 20} {
+				n, items := testQueryCount(t, user, tt.h, fmt.Sprintf(tt.target, limit))
+				if items != limit {
+					t.Fatalf("limit %d: %d items", limit, items)
+				}
+				if n != base {
+					t.Errorf("limit %d: %d queries, %d with limit 1", limit, n, base)
+				}
+			}
+		})
+	}
+}
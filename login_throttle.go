@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	LoginFailureScopeAccount = "account"
+	LoginFailureScopeIP      = "ip"
+
+	// failures allowed before the first lockout
+	LoginFreeFailuresAccount = 5
+	LoginFreeFailuresIP      = 20
+
+	LoginLockoutBase = 30 * time.Second
+	LoginLockoutMax  = 1 * time.Hour
+	// a counter left alone this long starts over
+	LoginFailureWindow = 24 * time.Hour
+)
+
+type LoginFailure struct {
+	Scope       string       `json:"scope" db:"scope"`
+	Key         string       `json:"key" db:"key"`
+	Failures    int          `json:"failures" db:"failures"`
+	LockedUntil sql.NullTime `json:"-" db:"locked_until"`
+	UpdatedAt   time.Time    `json:"-" db:"updated_at"`
+}
+
+type reqUnlockLogin struct {
+	AccountName string `json:"account_name"`
+	IP          string `json:"ip"`
+}
+
+type resUnlockLogin struct {
+	Unlocked int64 `json:"unlocked"`
+}
+
+// loginRetryAfter returns how long the account or the address is still locked
+// out, or zero.
+func loginRetryAfter(accountName, ip string) (time.Duration, error) {
+	failures := []LoginFailure{}
+	err := dbx.Select(&failures, "SELECT * FROM `login_failures` WHERE (`scope` = ? AND `key` = ?) OR (`scope` = ? AND `key` = ?)",
+		LoginFailureScopeAccount,
+		accountName,
+		LoginFailureScopeIP,
+		ip,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, f := range failures {
+		if f.LockedUntil.Valid && f.LockedUntil.Time.After(now) {
+			if d := f.LockedUntil.Time.Sub(now); d > retryAfter {
+				retryAfter = d
+			}
+		}
+	}
+	return retryAfter, nil
+}
+
+func recordLoginFailure(accountName, ip string) {
+	for _, f := range []LoginFailure{
+		{Scope: LoginFailureScopeAccount, Key: accountName},
+		{Scope: LoginFailureScopeIP, Key: ip},
+	} {
+		err := incrementLoginFailure(f.Scope, f.Key)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func incrementLoginFailure(scope, key string) error {
+	tx := dbx.MustBegin()
+	defer tx.Rollback()
+
+	now := time.Now()
+	f := LoginFailure{}
+	err := tx.Get(&f, "SELECT * FROM `login_failures` WHERE `scope` = ? AND `key` = ? FOR UPDATE", scope, key)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || f.UpdatedAt.Before(now.Add(-LoginFailureWindow)) {
+		f.Failures = 0
+	}
+	f.Failures++
+
+	free := LoginFreeFailuresAccount
+	if scope == LoginFailureScopeIP {
+		free = LoginFreeFailuresIP
+	}
+	var lockedUntil sql.NullTime
+	if f.Failures > free {
+		lockedUntil = sql.NullTime{Time: now.Add(loginLockout(f.Failures - free)), Valid: true}
+	}
+
+	_, err = tx.Exec("INSERT INTO `login_failures` (`scope`, `key`, `failures`, `locked_until`, `updated_at`) VALUES (?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE `failures` = VALUES(`failures`), `locked_until` = VALUES(`locked_until`), `updated_at` = VALUES(`updated_at`)",
+		scope,
+		key,
+		f.Failures,
+		lockedUntil,
+		now,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// loginLockout doubles with every failure past the free ones.
+func loginLockout(excess int) time.Duration {
+	d := LoginLockoutBase
+	for i := 1; i < excess && d < LoginLockoutMax; i++ {
+		d *= 2
+	}
+	if d > LoginLockoutMax {
+		d = LoginLockoutMax
+	}
+	return d
+}
+
+// resetLoginFailures only clears the account counter; a successful login
+// from an address says nothing about the other accounts tried from it.
+func resetLoginFailures(accountName string) {
+	_, err := dbx.Exec("DELETE FROM `login_failures` WHERE `scope` = ? AND `key` = ?", LoginFailureScopeAccount, accountName)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func outputTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	outputErrorMsg(w, http.StatusTooManyRequests, "ログイン試行回数が多すぎます。しばらくしてからお試しください")
+}
+
+func postAdminUnlockLogin(w http.ResponseWriter, r *http.Request) {
+	rul := reqUnlockLogin{}
+	err := json.NewDecoder(r.Body).Decode(&rul)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rul.AccountName == "" && rul.IP == "" {
+		outputErrorMsg(w, http.StatusBadRequest, "account_name or ip is required")
+		return
+	}
+
+	result, err := dbx.Exec("DELETE FROM `login_failures` WHERE (`scope` = ? AND `key` = ?) OR (`scope` = ? AND `key` = ?)",
+		LoginFailureScopeAccount,
+		rul.AccountName,
+		LoginFailureScopeIP,
+		rul.IP,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	unlocked, _ := result.RowsAffected()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resUnlockLogin{Unlocked: unlocked})
+}
@@ -3,27 +3,26 @@ package main
 import (
 	crand "crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	goji "goji.io"
 	"goji.io/pat"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -48,24 +47,28 @@ const (
 	TransactionEvidenceStatusWaitShipping = "wait_shipping"
 	TransactionEvidenceStatusWaitDone     = "wait_done"
 	TransactionEvidenceStatusDone         = "done"
+	TransactionEvidenceStatusCancel       = "cancel"
 
 	ShippingsStatusInitial    = "initial"
 	ShippingsStatusWaitPickup = "wait_pickup"
 	ShippingsStatusShipping   = "shipping"
 	ShippingsStatusDone       = "done"
+	ShippingsStatusCancel     = "cancel"
 
 	BumpChargeSeconds = 3 * time.Second
 
 	ItemsPerPage        = 48
 	TransactionsPerPage = 10
 
-	BcryptCost = 4
+	BcryptCost = 10
 )
 
 var (
-	templates *template.Template
-	dbx       *sqlx.DB
-	store     sessions.Store
+	templates       *template.Template
+	dbx             *sqlx.DB
+	store           sessions.Store
+	paymentService  PaymentService
+	shipmentService ShipmentService
 )
 
 type Config struct {
@@ -74,13 +77,16 @@ type Config struct {
 }
 
 type User struct {
-	ID             int64     `json:"id" db:"id"`
-	AccountName    string    `json:"account_name" db:"account_name"`
-	HashedPassword []byte    `json:"-" db:"hashed_password"`
-	Address        string    `json:"address,omitempty" db:"address"`
-	NumSellItems   int       `json:"num_sell_items" db:"num_sell_items"`
-	LastBump       time.Time `json:"-" db:"last_bump"`
-	CreatedAt      time.Time `json:"-" db:"created_at"`
+	ID             int64      `json:"id" db:"id"`
+	AccountName    string     `json:"account_name" db:"account_name"`
+	HashedPassword []byte     `json:"-" db:"hashed_password"`
+	Address        string     `json:"address,omitempty" db:"address"`
+	NumSellItems   int        `json:"num_sell_items" db:"num_sell_items"`
+	LastBump       time.Time  `json:"-" db:"last_bump"`
+	CreatedAt      time.Time  `json:"-" db:"created_at"`
+	Role           string     `json:"-" db:"role"`
+	BannedAt       *time.Time `json:"-" db:"banned_at"`
+	BanReason      string     `json:"-" db:"ban_reason"`
 }
 
 type UserSimple struct {
@@ -101,38 +107,47 @@ type Item struct {
 	CategoryID  int       `json:"category_id" db:"category_id"`
 	CreatedAt   time.Time `json:"-" db:"created_at"`
 	UpdatedAt   time.Time `json:"-" db:"updated_at"`
+	// thumbnail of the first image; empty for items listed before thumbnails
+	ThumbnailName string `json:"thumbnail_name" db:"thumbnail_name"`
+	// set when a moderator stopped the item
+	StopReason string `json:"-" db:"stop_reason"`
 }
 
 type ItemSimple struct {
-	ID         int64       `json:"id"`
-	SellerID   int64       `json:"seller_id"`
-	Seller     *UserSimple `json:"seller"`
-	Status     string      `json:"status"`
-	Name       string      `json:"name"`
-	Price      int         `json:"price"`
-	ImageURL   string      `json:"image_url"`
-	CategoryID int         `json:"category_id"`
-	Category   *Category   `json:"category"`
-	CreatedAt  int64       `json:"created_at"`
+	ID           int64       `json:"id"`
+	SellerID     int64       `json:"seller_id"`
+	Seller       *UserSimple `json:"seller"`
+	Status       string      `json:"status"`
+	Name         string      `json:"name"`
+	Price        int         `json:"price"`
+	ImageURL     string      `json:"image_url"`
+	ThumbnailURL string      `json:"thumbnail_url"`
+	CategoryID   int         `json:"category_id"`
+	Category     *Category   `json:"category"`
+	CreatedAt    int64       `json:"created_at"`
 }
 
 type ItemDetail struct {
-	ID                        int64       `json:"id"`
-	SellerID                  int64       `json:"seller_id"`
-	Seller                    *UserSimple `json:"seller"`
-	BuyerID                   int64       `json:"buyer_id,omitempty"`
-	Buyer                     *UserSimple `json:"buyer,omitempty"`
-	Status                    string      `json:"status"`
-	Name                      string      `json:"name"`
-	Price                     int         `json:"price"`
-	Description               string      `json:"description"`
-	ImageURL                  string      `json:"image_url"`
-	CategoryID                int         `json:"category_id"`
-	Category                  *Category   `json:"category"`
-	TransactionEvidenceID     int64       `json:"transaction_evidence_id,omitempty"`
-	TransactionEvidenceStatus string      `json:"transaction_evidence_status,omitempty"`
-	ShippingStatus            string      `json:"shipping_status,omitempty"`
-	CreatedAt                 int64       `json:"created_at"`
+	ID                        int64          `json:"id"`
+	SellerID                  int64          `json:"seller_id"`
+	Seller                    *UserSimple    `json:"seller"`
+	BuyerID                   int64          `json:"buyer_id,omitempty"`
+	Buyer                     *UserSimple    `json:"buyer,omitempty"`
+	Status                    string         `json:"status"`
+	Name                      string         `json:"name"`
+	Price                     int            `json:"price"`
+	Description               string         `json:"description"`
+	ImageURL                  string         `json:"image_url"`
+	Images                    []ItemImageURL `json:"images"`
+	CategoryID                int            `json:"category_id"`
+	Category                  *Category      `json:"category"`
+	TransactionEvidenceID     int64          `json:"transaction_evidence_id,omitempty"`
+	TransactionEvidenceStatus string         `json:"transaction_evidence_status,omitempty"`
+	ShippingStatus            string         `json:"shipping_status,omitempty"`
+	CancellationStatus        string         `json:"cancellation_status,omitempty"`
+	CancelRequestedBy         int64          `json:"cancel_requested_by,omitempty"`
+	StopReason                string         `json:"stop_reason,omitempty"`
+	CreatedAt                 int64          `json:"created_at"`
 }
 
 type TransactionEvidence struct {
@@ -148,22 +163,27 @@ type TransactionEvidence struct {
 	ItemRootCategoryID int       `json:"item_root_category_id" db:"item_root_category_id"`
 	CreatedAt          time.Time `json:"-" db:"created_at"`
 	UpdatedAt          time.Time `json:"-" db:"updated_at"`
+	// when the trade reached wait_done; NULL for older trades
+	ShippedAt *time.Time `json:"-" db:"shipped_at"`
 }
 
 type Shipping struct {
-	TransactionEvidenceID int64     `json:"transaction_evidence_id" db:"transaction_evidence_id"`
-	Status                string    `json:"status" db:"status"`
-	ItemName              string    `json:"item_name" db:"item_name"`
-	ItemID                int64     `json:"item_id" db:"item_id"`
-	ReserveID             string    `json:"reserve_id" db:"reserve_id"`
-	ReserveTime           int64     `json:"reserve_time" db:"reserve_time"`
-	ToAddress             string    `json:"to_address" db:"to_address"`
-	ToName                string    `json:"to_name" db:"to_name"`
-	FromAddress           string    `json:"from_address" db:"from_address"`
-	FromName              string    `json:"from_name" db:"from_name"`
-	ImgBinary             []byte    `json:"-" db:"img_binary"`
-	CreatedAt             time.Time `json:"-" db:"created_at"`
-	UpdatedAt             time.Time `json:"-" db:"updated_at"`
+	TransactionEvidenceID int64  `json:"transaction_evidence_id" db:"transaction_evidence_id"`
+	Status                string `json:"status" db:"status"`
+	ItemName              string `json:"item_name" db:"item_name"`
+	ItemID                int64  `json:"item_id" db:"item_id"`
+	ReserveID             string `json:"reserve_id" db:"reserve_id"`
+	ReserveTime           int64  `json:"reserve_time" db:"reserve_time"`
+	ToAddress             string `json:"to_address" db:"to_address"`
+	ToName                string `json:"to_name" db:"to_name"`
+	FromAddress           string `json:"from_address" db:"from_address"`
+	FromName              string `json:"from_name" db:"from_name"`
+	ImgBinary             []byte `json:"-" db:"img_binary"`
+	// key of the QR code in qrCodeStore; shippings from before it existed
+	// have the image in ImgBinary instead
+	ImgKey    string    `json:"-" db:"img_key"`
+	CreatedAt time.Time `json:"-" db:"created_at"`
+	UpdatedAt time.Time `json:"-" db:"updated_at"`
 }
 
 type Category struct {
@@ -184,21 +204,25 @@ type resInitialize struct {
 }
 
 type resNewItems struct {
-	RootCategoryID   int          `json:"root_category_id,omitempty"`
-	RootCategoryName string       `json:"root_category_name,omitempty"`
-	HasNext          bool         `json:"has_next"`
-	Items            []ItemSimple `json:"items"`
+	RootCategoryID   int            `json:"root_category_id,omitempty"`
+	RootCategoryName string         `json:"root_category_name,omitempty"`
+	HasNext          bool           `json:"has_next"`
+	NextCursor       string         `json:"next_cursor,omitempty"`
+	Items            []ItemSimple   `json:"items"`
+	Facets           *ListingFacets `json:"facets,omitempty"`
 }
 
 type resUserItems struct {
-	User    *UserSimple  `json:"user"`
-	HasNext bool         `json:"has_next"`
-	Items   []ItemSimple `json:"items"`
+	User       *UserSimple  `json:"user"`
+	HasNext    bool         `json:"has_next"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Items      []ItemSimple `json:"items"`
 }
 
 type resTransactions struct {
-	HasNext bool          `json:"has_next"`
-	Items   []*ItemDetail `json:"items"`
+	HasNext    bool          `json:"has_next"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Items      []*ItemDetail `json:"items"`
 }
 
 type reqRegister struct {
@@ -212,10 +236,17 @@ type reqLogin struct {
 	Password    string `json:"password"`
 }
 
+// reqItemEdit leaves the fields that are nil unchanged.
 type reqItemEdit struct {
-	CSRFToken string `json:"csrf_token"`
-	ItemID    int64  `json:"item_id"`
-	ItemPrice int    `json:"item_price"`
+	CSRFToken       string  `json:"csrf_token"`
+	ItemID          int64   `json:"item_id"`
+	ItemName        *string `json:"item_name"`
+	ItemDescription *string `json:"item_description"`
+	ItemPrice       *int    `json:"item_price"`
+	ItemCategoryID  *int    `json:"item_category_id"`
+	// item_updated_at of the response the client edits from, when it does
+	// not send If-Match
+	ItemUpdatedAt int64 `json:"item_updated_at"`
 }
 
 type resItemEdit struct {
@@ -272,8 +303,6 @@ type resSetting struct {
 }
 
 func init() {
-	store = sessions.NewCookieStore([]byte("abc"))
-
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
 	templates = template.Must(template.ParseFiles(
@@ -322,9 +351,213 @@ func main() {
 	}
 	defer dbx.Close()
 
+	err = ensureSchema(dbx)
+	if err != nil {
+		log.Fatalf("failed to prepare DB schema: %s.", err.Error())
+	}
+
+	adminToken = os.Getenv("ISUCARI_ADMIN_TOKEN")
+
+	if v := os.Getenv("ISUCARI_PASSWORD_ALGO"); v != "" {
+		passwordPolicy.Algorithm = v
+	}
+	if v := os.Getenv("ISUCARI_BCRYPT_COST"); v != "" {
+		passwordPolicy.BcryptCost, err = strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("failed to read bcrypt cost from an environment variable ISUCARI_BCRYPT_COST.\nError: %v", err)
+		}
+	}
+	if v := os.Getenv("ISUCARI_ARGON2ID_PARAMS"); v != "" {
+		passwordPolicy.Argon2id, err = parseArgon2idParams(v)
+		if err != nil {
+			log.Fatalf("failed to read argon2id parameters from an environment variable ISUCARI_ARGON2ID_PARAMS.\nError: %v", err)
+		}
+	}
+	err = passwordPolicy.Validate()
+	if err != nil {
+		log.Fatalf("invalid password policy: %v", err)
+	}
+
+	var sessionKeys [][]byte
+	if v := os.Getenv("ISUCARI_SESSION_KEYS"); v != "" {
+		sessionKeys, err = parseSessionKeys(v)
+		if err != nil {
+			log.Fatalf("failed to read session keys from an environment variable ISUCARI_SESSION_KEYS.\nError: %v", err)
+		}
+	} else {
+		log.Print("ISUCARI_SESSION_KEYS is not set; using random session keys, sessions will not survive a restart")
+		sessionKeys = [][]byte{securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)}
+	}
+	if v := os.Getenv("ISUCARI_CURSOR_KEY"); v != "" {
+		cursorKey, err = hex.DecodeString(v)
+		if err != nil || len(cursorKey) < 32 {
+			log.Fatalf("failed to read cursor key from an environment variable ISUCARI_CURSOR_KEY.\nError: %v", err)
+		}
+	} else {
+		log.Print("ISUCARI_CURSOR_KEY is not set; using a random cursor key, next_cursor will not survive a restart")
+		cursorKey = securecookie.GenerateRandomKey(32)
+	}
+
+	if v := os.Getenv("ISUCARI_TRUSTED_PROXIES"); v != "" {
+		trustedProxies, err = parseTrustedProxies(v)
+		if err != nil {
+			log.Fatalf("failed to read trusted proxies from an environment variable ISUCARI_TRUSTED_PROXIES.\nError: %v", err)
+		}
+	}
+
+	var sessionBackend SessionBackend
+	if os.Getenv("ISUCARI_SESSION_BACKEND") == "memory" {
+		sessionBackend = NewMemorySessionBackend()
+	} else {
+		sessionBackend = NewMySQLSessionBackend(dbx)
+	}
+	store = NewServerSessionStore(sessionBackend, sessionKeys...)
+
+	if v := os.Getenv("ISUCARI_IDEMPOTENCY_TTL"); v != "" {
+		idempotencyTTL, err = time.ParseDuration(v)
+		if err != nil || idempotencyTTL <= 0 {
+			log.Fatalf("failed to read idempotency key TTL from an environment variable ISUCARI_IDEMPOTENCY_TTL.\nError: %v", err)
+		}
+	}
+
+	if os.Getenv("ISUCARI_EXTERNAL_SERVICE") == "fake" {
+		log.Print("using in-process fake payment and shipment services")
+		paymentService = NewFakePaymentService()
+		shipmentService = NewFakeShipmentService()
+	} else {
+		paymentService = NewHTTPPaymentService(getPaymentServiceURL)
+		shipmentService = NewHTTPShipmentService(getShipmentServiceURL)
+	}
+
+	switch backend := os.Getenv("ISUCARI_BLOB_BACKEND"); backend {
+	case "", BlobBackendLocal:
+		if v := os.Getenv("ISUCARI_UPLOAD_DIR"); v != "" {
+			imageStore = NewLocalBlobStore(v, DefaultUploadURL)
+		}
+		if v := os.Getenv("ISUCARI_QRCODE_DIR"); v != "" {
+			qrCodeStore = NewLocalBlobStore(v, "")
+		}
+	case BlobBackendS3:
+		endpoint := os.Getenv("ISUCARI_S3_ENDPOINT")
+		bucket := os.Getenv("ISUCARI_S3_BUCKET")
+		if endpoint == "" || bucket == "" {
+			log.Fatalf("ISUCARI_S3_ENDPOINT and ISUCARI_S3_BUCKET are required for the s3 blob backend")
+		}
+		region := os.Getenv("ISUCARI_S3_REGION")
+		accessKey := os.Getenv("ISUCARI_S3_ACCESS_KEY")
+		secretKey := os.Getenv("ISUCARI_S3_SECRET_KEY")
+		publicURL := os.Getenv("ISUCARI_S3_PUBLIC_URL")
+		if publicURL == "" {
+			publicURL = strings.TrimSuffix(endpoint, "/") + "/" + bucket
+		}
+		imageStore = NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey, S3ImagePrefix, publicURL)
+		qrCodeStore = NewS3BlobStore(endpoint, region, bucket, accessKey, secretKey, S3QRCodePrefix, "")
+	default:
+		log.Fatalf("failed to read blob backend from an environment variable ISUCARI_BLOB_BACKEND.\nError: unknown backend %q", backend)
+	}
+
 	mux := goji.NewMux()
 
-	prepareCategory(dbx)
+	err = prepareCategory(dbx)
+	if err != nil {
+		log.Fatalf("failed to load the categories: %s.", err.Error())
+	}
+
+	err = searchIndex.Rebuild(dbx)
+	if err != nil {
+		log.Fatalf("failed to build the search index: %s.", err.Error())
+	}
+
+	go runPaymentCompensator()
+	go runIdempotencyKeyCleaner()
+	go runSessionCleaner(sessionBackend)
+
+	userCacheSize := DefaultUserCacheSize
+	if v := os.Getenv("ISUCARI_USER_CACHE_SIZE"); v != "" {
+		userCacheSize, err = strconv.Atoi(v)
+		if err != nil || userCacheSize <= 0 {
+			log.Fatalf("failed to read user cache size from an environment variable ISUCARI_USER_CACHE_SIZE.\nError: %v", err)
+		}
+	}
+	userCacheTTL := DefaultUserCacheTTL
+	if v := os.Getenv("ISUCARI_USER_CACHE_TTL"); v != "" {
+		userCacheTTL, err = time.ParseDuration(v)
+		if err != nil || userCacheTTL <= 0 {
+			log.Fatalf("failed to read user cache TTL from an environment variable ISUCARI_USER_CACHE_TTL.\nError: %v", err)
+		}
+	}
+	userSimpleCache = NewUserCache(userCacheSize, userCacheTTL)
+
+	cacheInvalidationInterval := DefaultCacheInvalidationInterval
+	if v := os.Getenv("ISUCARI_CACHE_INVALIDATION_INTERVAL"); v != "" {
+		cacheInvalidationInterval, err = time.ParseDuration(v)
+		if err != nil || cacheInvalidationInterval <= 0 {
+			log.Fatalf("failed to read cache invalidation interval from an environment variable ISUCARI_CACHE_INVALIDATION_INTERVAL.\nError: %v", err)
+		}
+	}
+	go runCacheInvalidationListener(cacheInvalidationInterval)
+
+	shipmentSyncInterval := DefaultShipmentSyncInterval
+	if v := os.Getenv("ISUCARI_SHIPMENT_SYNC_INTERVAL"); v != "" {
+		shipmentSyncInterval, err = time.ParseDuration(v)
+		if err != nil || shipmentSyncInterval <= 0 {
+			log.Fatalf("failed to read shipment sync interval from an environment variable ISUCARI_SHIPMENT_SYNC_INTERVAL.\nError: %v", err)
+		}
+	}
+	shipmentSyncConcurrency := DefaultShipmentSyncConcurrency
+	if v := os.Getenv("ISUCARI_SHIPMENT_SYNC_CONCURRENCY"); v != "" {
+		shipmentSyncConcurrency, err = strconv.Atoi(v)
+		if err != nil || shipmentSyncConcurrency <= 0 {
+			log.Fatalf("failed to read shipment sync concurrency from an environment variable ISUCARI_SHIPMENT_SYNC_CONCURRENCY.\nError: %v", err)
+		}
+	}
+	go NewShipmentSyncer(shipmentSyncInterval, shipmentSyncConcurrency).Run()
+
+	blobGCInterval := DefaultBlobGCInterval
+	if v := os.Getenv("ISUCARI_BLOB_GC_INTERVAL"); v != "" {
+		blobGCInterval, err = time.ParseDuration(v)
+		if err != nil || blobGCInterval <= 0 {
+			log.Fatalf("failed to read blob gc interval from an environment variable ISUCARI_BLOB_GC_INTERVAL.\nError: %v", err)
+		}
+	}
+	go runBlobGC(blobGCInterval)
+
+	tradeScheduler := &TradeScheduler{
+		Interval:         DefaultTradeSchedulerInterval,
+		ShipDeadline:     DefaultShipDeadline,
+		CompleteDeadline: DefaultCompleteDeadline,
+	}
+	for env, d := range map[string]*time.Duration{
+		"ISUCARI_TRADE_SCHEDULER_INTERVAL": &tradeScheduler.Interval,
+		"ISUCARI_SHIP_DEADLINE":            &tradeScheduler.ShipDeadline,
+		"ISUCARI_COMPLETE_DEADLINE":        &tradeScheduler.CompleteDeadline,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*d, err = time.ParseDuration(v)
+			if err != nil || *d <= 0 {
+				log.Fatalf("failed to read a duration from an environment variable %s.\nError: %v", env, err)
+			}
+		}
+	}
+	go tradeScheduler.Run()
+
+	itemViewFlushInterval := DefaultItemViewFlushInterval
+	if v := os.Getenv("ISUCARI_ITEM_VIEW_FLUSH_INTERVAL"); v != "" {
+		itemViewFlushInterval, err = time.ParseDuration(v)
+		if err != nil || itemViewFlushInterval <= 0 {
+			log.Fatalf("failed to read item view flush interval from an environment variable ISUCARI_ITEM_VIEW_FLUSH_INTERVAL.\nError: %v", err)
+		}
+	}
+	go runItemViewFlusher(itemViewFlushInterval)
+
+	itemViewRankingInterval := DefaultItemViewRankingInterval
+	if v := os.Getenv("ISUCARI_ITEM_VIEW_RANKING_INTERVAL"); v != "" {
+		itemViewRankingInterval, err = time.ParseDuration(v)
+		if err != nil || itemViewRankingInterval <= 0 {
+			log.Fatalf("failed to read item view ranking interval from an environment variable ISUCARI_ITEM_VIEW_RANKING_INTERVAL.\nError: %v", err)
+		}
+	}
+	go runItemViewRanker(itemViewRankingInterval)
 
 	// -----pprof----
 	//mux.HandleFunc(pat.Get("/debug/pprof/*"), http.HandlerFunc(pprof.Index))
@@ -340,23 +573,50 @@ func main() {
 
 	// API
 	mux.HandleFunc(pat.Post("/initialize"), postInitialize)
-	mux.HandleFunc(pat.Get("/new_items.json"), getNewItems)
-	mux.HandleFunc(pat.Get("/new_items/:root_category_id.json"), getNewCategoryItems)
-	mux.HandleFunc(pat.Get("/users/transactions.json"), getTransactions)
-	mux.HandleFunc(pat.Get("/users/:user_id.json"), getUserItems)
-	mux.HandleFunc(pat.Get("/items/:item_id.json"), getItem)
+	mux.HandleFunc(pat.Get("/new_items.json"), withLoader(getNewItems))
+	mux.HandleFunc(pat.Get("/new_items/:root_category_id.json"), withLoader(getNewCategoryItems))
+	mux.HandleFunc(pat.Get("/users/transactions.json"), withLoader(getTransactions))
+	mux.HandleFunc(pat.Get("/users/me/stats.json"), getSellerStats)
+	mux.HandleFunc(pat.Get("/users/:user_id.json"), withLoader(getUserItems))
+	mux.HandleFunc(pat.Get("/items/:item_id.json"), withLoader(getItem))
+	mux.HandleFunc(pat.Get("/search.json"), withLoader(getSearch))
+	mux.HandleFunc(pat.Get("/categories/:category_id.json"), getCategory)
 	mux.HandleFunc(pat.Post("/items/edit"), postItemEdit)
-	mux.HandleFunc(pat.Post("/buy"), postBuy)
+	mux.HandleFunc(pat.Get("/items/:item_id/edits.json"), getItemEditHistories)
+	mux.HandleFunc(pat.Post("/items/stop"), postItemStop)
+	mux.HandleFunc(pat.Post("/items/resume"), postItemResume)
+	mux.HandleFunc(pat.Post("/buy"), withIdempotency(postBuy))
 	mux.HandleFunc(pat.Post("/sell"), postSell)
-	mux.HandleFunc(pat.Post("/ship"), postShip)
-	mux.HandleFunc(pat.Post("/ship_done"), postShipDone)
-	mux.HandleFunc(pat.Post("/complete"), postComplete)
+	mux.HandleFunc(pat.Post("/ship"), withIdempotency(postShip))
+	mux.HandleFunc(pat.Post("/ship_done"), withIdempotency(postShipDone))
+	mux.HandleFunc(pat.Post("/complete"), withIdempotency(postComplete))
+	mux.HandleFunc(pat.Post("/cancel"), withIdempotency(postCancel))
+	mux.HandleFunc(pat.Post("/cancel/accept"), withIdempotency(postCancelAccept))
+	mux.HandleFunc(pat.Post("/cancel/reject"), withIdempotency(postCancelReject))
 	mux.HandleFunc(pat.Get("/transactions/:transaction_evidence_id.png"), getQRCode)
 	mux.HandleFunc(pat.Post("/bump"), postBump)
 	mux.HandleFunc(pat.Get("/settings"), getSettings)
 	mux.HandleFunc(pat.Post("/login"), postLogin)
 	mux.HandleFunc(pat.Post("/register"), postRegister)
-	mux.HandleFunc(pat.Get("/reports.json"), getReports)
+	mux.HandleFunc(pat.Get("/sessions"), getSessions)
+	mux.HandleFunc(pat.Delete("/sessions/:session_id"), deleteSession)
+	mux.HandleFunc(pat.Post("/admin/login/unlock"), withRole(RoleAdmin, postAdminUnlockLogin))
+	mux.HandleFunc(pat.Get("/admin/cache/stats"), withRole(RoleAdmin, getAdminCacheStats))
+	mux.HandleFunc(pat.Get("/admin/categories"), withRole(RoleAdmin, getAdminCategories))
+	mux.HandleFunc(pat.Post("/admin/categories"), withRole(RoleAdmin, postAdminCategory))
+	mux.HandleFunc(pat.Put("/admin/categories/:category_id"), withRole(RoleAdmin, putAdminCategory))
+	mux.HandleFunc(pat.Delete("/admin/categories/:category_id"), withRole(RoleAdmin, deleteAdminCategory))
+	mux.HandleFunc(pat.Get("/admin/users"), withRole(RoleModerator, getAdminUsers))
+	mux.HandleFunc(pat.Post("/admin/users/:user_id/ban"), withRole(RoleAdmin, postAdminBanUser))
+	mux.HandleFunc(pat.Post("/admin/users/:user_id/unban"), withRole(RoleAdmin, postAdminUnbanUser))
+	mux.HandleFunc(pat.Put("/admin/users/:user_id/role"), withRole(RoleAdmin, putAdminUserRole))
+	mux.HandleFunc(pat.Get("/admin/items"), withRole(RoleModerator, getAdminItems))
+	mux.HandleFunc(pat.Post("/admin/items/:item_id/stop"), withRole(RoleModerator, postAdminStopItem))
+	mux.HandleFunc(pat.Post("/admin/items/:item_id/resume"), withRole(RoleModerator, postAdminResumeItem))
+	mux.HandleFunc(pat.Get("/admin/trades/:item_id"), withRole(RoleModerator, getAdminTrade))
+	mux.HandleFunc(pat.Get("/admin/audit"), withRole(RoleModerator, getAdminAudit))
+	mux.HandleFunc(pat.Get("/admin/reports.jsonl"), withRole(RoleAdmin, getReportsJSONL))
+	mux.HandleFunc(pat.Get("/admin/reports.csv"), withRole(RoleAdmin, getReportsCSV))
 	// Frontend
 	mux.HandleFunc(pat.Get("/"), getIndex)
 	mux.HandleFunc(pat.Get("/login"), getIndex)
@@ -373,6 +633,7 @@ func main() {
 	mux.HandleFunc(pat.Get("/users/setting"), getIndex)
 	// Assets
 	mux.Handle(pat.Get("/*"), http.FileServer(http.Dir("../public")))
+	mux.Use(withRequestID)
 	log.Fatal(http.ListenAndServe(":8000", mux))
 }
 
@@ -408,40 +669,14 @@ func getUser(r *http.Request) (user User, errCode int, errMsg string) {
 		log.Print(err)
 		return user, http.StatusInternalServerError, "db error"
 	}
-
-	return user, http.StatusOK, ""
-}
-
-/////////////////////////////////////////////
-type UserSimpleCahce struct {
-	sync.RWMutex
-	userId2User map[int64]*UserSimple
-}
-
-func NewUserCache() *UserSimpleCahce {
-	m := make(map[int64]*UserSimple)
-	c := &UserSimpleCahce{
-		userId2User: m,
+	if user.BannedAt != nil {
+		return user, http.StatusForbidden, BannedErrMsg
 	}
-	return c
-}
 
-func (c *UserSimpleCahce) Set(key int64, value *UserSimple) {
-	c.Lock()
-	c.userId2User[key] = value
-	c.Unlock()
-}
-
-func (c *UserSimpleCahce) Get(key int64) (*UserSimple, bool) {
-	c.RLock()
-	v, found := c.userId2User[key]
-	c.RUnlock()
-	return v, found
+	return user, http.StatusOK, ""
 }
 
-/////////////////////////////////////////////
-
-var userSimpleCache = NewUserCache()
+var userSimpleCache = NewUserCache(DefaultUserCacheSize, DefaultUserCacheTTL)
 
 func getUserSimpleByID(q sqlx.Queryer, userID int64) (userSimple UserSimple, err error) {
 
@@ -462,46 +697,6 @@ func getUserSimpleByID(q sqlx.Queryer, userID int64) (userSimple UserSimple, err
 	return userSimple, err
 }
 
-var (
-	categoryId2category map[int]Category
-	cachedCategories    []Category
-)
-
-func prepareCategory(q sqlx.Queryer) {
-	categoryId2category = map[int]Category{}
-	cachedCategories := []Category{}
-
-	sqlx.Select(q, &cachedCategories, "SELECT * FROM `categories`")
-
-	for _, cat := range cachedCategories {
-		categoryId2category[cat.ID] = cat
-	}
-}
-
-func getCategoryByID(q sqlx.Queryer, categoryID int) (Category, error) {
-	v, ok := categoryId2category[categoryID]
-
-	if ok && v.ParentID != 0 {
-		parentCategory, err := getCategoryByID(q, v.ParentID)
-		if err != nil {
-			return v, err
-		}
-		v.ParentCategoryName = parentCategory.CategoryName
-
-		return v, nil
-	}
-
-	if ok && v.ParentID == 0 {
-		return v, nil
-	}
-
-	if !ok {
-		return Category{}, errors.New("hoge")
-	}
-
-	return v, nil
-}
-
 var (
 	name2config map[string]string
 	name2error  map[string]error
@@ -572,6 +767,42 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = ensureSchema(dbx)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	err = prepareCategory(dbx)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	err = searchIndex.Rebuild(dbx)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	userSimpleCache.Purge()
+
+	err = recountBlobRefs(dbx)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	err = rebuildSellerStats(dbx)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
 	_, err = dbx.Exec(
 		"INSERT INTO `configs` (`name`, `val`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `val` = VALUES(`val`)",
 		"payment_service_url",
@@ -605,53 +836,29 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 }
 
 func getNewItems(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	itemIDStr := query.Get("item_id")
-	var itemID int64
-	var err error
-	if itemIDStr != "" {
-		itemID, err = strconv.ParseInt(itemIDStr, 10, 64)
-		if err != nil || itemID <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "item_id param error")
-			return
-		}
+	ld := requestLoader(r)
+
+	lq, err := parseListingQuery(r.URL.Query(), "new_items")
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	createdAtStr := query.Get("created_at")
-	var createdAt int64
-	if createdAtStr != "" {
-		createdAt, err = strconv.ParseInt(createdAtStr, 10, 64)
-		if err != nil || createdAt <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "created_at param error")
-			return
-		}
+	items, err := lq.SelectItems(ld.DB(), nil, nil)
+	if err == ErrCursorExpired {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
 	}
 
-	items := []Item{}
-	if itemID > 0 && createdAt > 0 {
-		// paging
-		err := dbx.Select(&items,
-			"SELECT * FROM `items` WHERE `status` IN (?,?) AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
-			ItemStatusOnSale,
-			ItemStatusSoldOut,
-			time.Unix(createdAt, 0),
-			time.Unix(createdAt, 0),
-			itemID,
-			ItemsPerPage+1,
-		)
-		if err != nil {
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
-	} else {
-		// 1st page
-		err := dbx.Select(&items,
-			"SELECT * FROM `items` WHERE `status` IN (?,?) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
-			ItemStatusOnSale,
-			ItemStatusSoldOut,
-			ItemsPerPage+1,
-		)
+	var facets *ListingFacets
+	if lq.IsFirstPage() {
+		// counted under the root category
+		facets, err = lq.Facets(ld.DB(), nil, nil, currentCategoryTree().Root)
 		if err != nil {
 			log.Print(err)
 			outputErrorMsg(w, http.StatusInternalServerError, "db error")
@@ -659,41 +866,57 @@ func getNewItems(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	sellerIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		sellerIDs = append(sellerIDs, item.SellerID)
+	}
+	err = ld.LoadUsers(sellerIDs...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
 	itemSimples := []ItemSimple{}
 	for _, item := range items {
-		seller, err := getUserSimpleByID(dbx, item.SellerID)
-		if err != nil {
+		seller, ok := ld.User(item.SellerID)
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "seller not found")
 			return
 		}
-		category, err := getCategoryByID(dbx, item.CategoryID)
+		category, err := ld.Category(item.CategoryID)
 		if err != nil {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			return
 		}
 		itemSimples = append(itemSimples, ItemSimple{
-			ID:         item.ID,
-			SellerID:   item.SellerID,
-			Seller:     &seller,
-			Status:     item.Status,
-			Name:       item.Name,
-			Price:      item.Price,
-			ImageURL:   getImageURL(item.ImageName),
-			CategoryID: item.CategoryID,
-			Category:   &category,
-			CreatedAt:  item.CreatedAt.Unix(),
+			ID:           item.ID,
+			SellerID:     item.SellerID,
+			Seller:       seller,
+			Status:       item.Status,
+			Name:         item.Name,
+			Price:        item.Price,
+			ImageURL:     getImageURL(item.ImageName),
+			ThumbnailURL: getThumbnailURL(item.Item),
+			CategoryID:   item.CategoryID,
+			Category:     &category,
+			CreatedAt:    item.CreatedAt.Unix(),
 		})
 	}
 
 	hasNext := false
-	if len(itemSimples) > ItemsPerPage {
+	nextCursor := ""
+	if len(itemSimples) > lq.Page.Limit {
 		hasNext = true
-		itemSimples = itemSimples[0:ItemsPerPage]
+		itemSimples = itemSimples[0:lq.Page.Limit]
+		nextCursor = lq.NextCursor(items[lq.Page.Limit-1])
 	}
 
 	rni := resNewItems{
-		Items:   itemSimples,
-		HasNext: hasNext,
+		Items:      itemSimples,
+		HasNext:    hasNext,
+		NextCursor: nextCursor,
+		Facets:     facets,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -708,69 +931,43 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rootCategory, err := getCategoryByID(dbx, rootCategoryID)
+	ld := requestLoader(r)
+
+	rootCategory, err := ld.Category(rootCategoryID)
 	if err != nil || rootCategory.ParentID != 0 {
 		outputErrorMsg(w, http.StatusNotFound, "category not found")
 		return
 	}
 
-	var categoryIDs []int
-	err = dbx.Select(&categoryIDs, "SELECT id FROM `categories` WHERE parent_id=?", rootCategory.ID)
+	tree := currentCategoryTree()
+	categoryIDs := tree.Descendants(rootCategory.ID)
+
+	lq, err := parseListingQuery(r.URL.Query(), "new_items/"+strconv.Itoa(rootCategory.ID))
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	query := r.URL.Query()
-	itemIDStr := query.Get("item_id")
-	var itemID int64
-	if itemIDStr != "" {
-		itemID, err = strconv.ParseInt(itemIDStr, 10, 64)
-		if err != nil || itemID <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "item_id param error")
-			return
-		}
-	}
+	conds := []string{"`items`.`category_id` IN (?)"}
+	args := []interface{}{categoryIDs}
 
-	createdAtStr := query.Get("created_at")
-	var createdAt int64
-	if createdAtStr != "" {
-		createdAt, err = strconv.ParseInt(createdAtStr, 10, 64)
-		if err != nil || createdAt <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "created_at param error")
-			return
-		}
+	items, err := lq.SelectItems(ld.DB(), conds, args)
+	if err == ErrCursorExpired {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
 	}
 
-	var inQuery string
-	var inArgs []interface{}
-	if itemID > 0 && createdAt > 0 {
-		// paging
-		inQuery, inArgs, err = sqlx.In(
-			"SELECT * FROM `items` WHERE `status` IN (?,?) AND category_id IN (?) AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
-			ItemStatusOnSale,
-			ItemStatusSoldOut,
-			categoryIDs,
-			time.Unix(createdAt, 0),
-			time.Unix(createdAt, 0),
-			itemID,
-			ItemsPerPage+1,
-		)
-		if err != nil {
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
-	} else {
-		// 1st page
-		inQuery, inArgs, err = sqlx.In(
-			"SELECT * FROM `items` WHERE `status` IN (?,?) AND category_id IN (?) ORDER BY created_at DESC, id DESC LIMIT ?",
-			ItemStatusOnSale,
-			ItemStatusSoldOut,
-			categoryIDs,
-			ItemsPerPage+1,
-		)
+	var facets *ListingFacets
+	if lq.IsFirstPage() {
+		// counted under the children of the root category
+		facets, err = lq.Facets(ld.DB(), conds, args, func(categoryID int) (Category, bool) {
+			return tree.ChildOn(categoryID, rootCategory.ID)
+		})
 		if err != nil {
 			log.Print(err)
 			outputErrorMsg(w, http.StatusInternalServerError, "db error")
@@ -778,9 +975,11 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	items := []Item{}
-	err = dbx.Select(&items, inQuery, inArgs...)
-
+	sellerIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		sellerIDs = append(sellerIDs, item.SellerID)
+	}
+	err = ld.LoadUsers(sellerIDs...)
 	if err != nil {
 		log.Print(err)
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
@@ -789,34 +988,37 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 
 	itemSimples := []ItemSimple{}
 	for _, item := range items {
-		seller, err := getUserSimpleByID(dbx, item.SellerID)
-		if err != nil {
+		seller, ok := ld.User(item.SellerID)
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "seller not found")
 			return
 		}
-		category, err := getCategoryByID(dbx, item.CategoryID)
+		category, err := ld.Category(item.CategoryID)
 		if err != nil {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			return
 		}
 		itemSimples = append(itemSimples, ItemSimple{
-			ID:         item.ID,
-			SellerID:   item.SellerID,
-			Seller:     &seller,
-			Status:     item.Status,
-			Name:       item.Name,
-			Price:      item.Price,
-			ImageURL:   getImageURL(item.ImageName),
-			CategoryID: item.CategoryID,
-			Category:   &category,
-			CreatedAt:  item.CreatedAt.Unix(),
+			ID:           item.ID,
+			SellerID:     item.SellerID,
+			Seller:       seller,
+			Status:       item.Status,
+			Name:         item.Name,
+			Price:        item.Price,
+			ImageURL:     getImageURL(item.ImageName),
+			ThumbnailURL: getThumbnailURL(item.Item),
+			CategoryID:   item.CategoryID,
+			Category:     &category,
+			CreatedAt:    item.CreatedAt.Unix(),
 		})
 	}
 
 	hasNext := false
-	if len(itemSimples) > ItemsPerPage {
+	nextCursor := ""
+	if len(itemSimples) > lq.Page.Limit {
 		hasNext = true
-		itemSimples = itemSimples[0:ItemsPerPage]
+		itemSimples = itemSimples[0:lq.Page.Limit]
+		nextCursor = lq.NextCursor(items[lq.Page.Limit-1])
 	}
 
 	rni := resNewItems{
@@ -824,6 +1026,8 @@ func getNewCategoryItems(w http.ResponseWriter, r *http.Request) {
 		RootCategoryName: rootCategory.CategoryName,
 		Items:            itemSimples,
 		HasNext:          hasNext,
+		NextCursor:       nextCursor,
+		Facets:           facets,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -839,100 +1043,85 @@ func getUserItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userSimple, err := getUserSimpleByID(dbx, userID)
+	ld := requestLoader(r)
+
+	userSimple, err := getUserSimpleByID(ld.DB(), userID)
 	if err != nil {
 		outputErrorMsg(w, http.StatusNotFound, "user not found")
 		return
 	}
 
-	query := r.URL.Query()
-	itemIDStr := query.Get("item_id")
-	var itemID int64
-	if itemIDStr != "" {
-		itemID, err = strconv.ParseInt(itemIDStr, 10, 64)
-		if err != nil || itemID <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "item_id param error")
-			return
-		}
+	page, err := parsePage(r.URL.Query(), "users/"+strconv.FormatInt(userSimple.ID, 10), ItemsPerPage)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	createdAtStr := query.Get("created_at")
-	var createdAt int64
-	if createdAtStr != "" {
-		createdAt, err = strconv.ParseInt(createdAtStr, 10, 64)
-		if err != nil || createdAt <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "created_at param error")
-			return
-		}
+	conds := "`seller_id` = ? AND `status` IN (?,?,?)"
+	args := []interface{}{
+		userSimple.ID,
+		ItemStatusOnSale,
+		ItemStatusTrading,
+		ItemStatusSoldOut,
 	}
+	if page.Cursor != nil {
+		cond, condArgs := page.createdKeyset("items")
+		conds += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	args = append(args, page.Limit+1)
 
 	items := []Item{}
-	if itemID > 0 && createdAt > 0 {
-		// paging
-		err := dbx.Select(&items,
-			"SELECT * FROM `items` WHERE `seller_id` = ? AND `status` IN (?,?,?) AND (`created_at` < ?  OR (`created_at` <= ? AND `id` < ?)) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
-			userSimple.ID,
-			ItemStatusOnSale,
-			ItemStatusTrading,
-			ItemStatusSoldOut,
-			time.Unix(createdAt, 0),
-			time.Unix(createdAt, 0),
-			itemID,
-			ItemsPerPage+1,
-		)
-		if err != nil {
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
-	} else {
-		// 1st page
-		err := dbx.Select(&items,
-			"SELECT * FROM `items` WHERE `seller_id` = ? AND `status` IN (?,?,?) ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
-			userSimple.ID,
-			ItemStatusOnSale,
-			ItemStatusTrading,
-			ItemStatusSoldOut,
-			ItemsPerPage+1,
-		)
-		if err != nil {
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
+	err = sqlx.Select(ld.DB(), &items,
+		"SELECT * FROM `items` WHERE "+conds+" ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
 	}
 
 	itemSimples := []ItemSimple{}
 	for _, item := range items {
-		category, err := getCategoryByID(dbx, item.CategoryID)
+		category, err := ld.Category(item.CategoryID)
 		if err != nil {
 			outputErrorMsg(w, http.StatusNotFound, "category not found")
 			return
 		}
 		itemSimples = append(itemSimples, ItemSimple{
-			ID:         item.ID,
-			SellerID:   item.SellerID,
-			Seller:     &userSimple,
-			Status:     item.Status,
-			Name:       item.Name,
-			Price:      item.Price,
-			ImageURL:   getImageURL(item.ImageName),
-			CategoryID: item.CategoryID,
-			Category:   &category,
-			CreatedAt:  item.CreatedAt.Unix(),
+			ID:           item.ID,
+			SellerID:     item.SellerID,
+			Seller:       &userSimple,
+			Status:       item.Status,
+			Name:         item.Name,
+			Price:        item.Price,
+			ImageURL:     getImageURL(item.ImageName),
+			ThumbnailURL: getThumbnailURL(item),
+			CategoryID:   item.CategoryID,
+			Category:     &category,
+			CreatedAt:    item.CreatedAt.Unix(),
 		})
 	}
 
 	hasNext := false
-	if len(itemSimples) > ItemsPerPage {
+	nextCursor := ""
+	if len(itemSimples) > page.Limit {
 		hasNext = true
-		itemSimples = itemSimples[0:ItemsPerPage]
+		itemSimples = itemSimples[0:page.Limit]
+		last := items[page.Limit-1]
+		nextCursor = page.NextCursor(Cursor{
+			Sort:      ListingSortCreated,
+			ID:        last.ID,
+			CreatedAt: last.CreatedAt.Unix(),
+		})
 	}
 
 	rui := resUserItems{
-		User:    &userSimple,
-		Items:   itemSimples,
-		HasNext: hasNext,
+		User:       &userSimple,
+		Items:      itemSimples,
+		HasNext:    hasNext,
+		NextCursor: nextCursor,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -946,115 +1135,65 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := r.URL.Query()
-	itemIDStr := query.Get("item_id")
-	var err error
-	var itemID int64
-	if itemIDStr != "" {
-		itemID, err = strconv.ParseInt(itemIDStr, 10, 64)
-		if err != nil || itemID <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "item_id param error")
-			return
-		}
-	}
+	ld := requestLoader(r)
 
-	createdAtStr := query.Get("created_at")
-	var createdAt int64
-	if createdAtStr != "" {
-		createdAt, err = strconv.ParseInt(createdAtStr, 10, 64)
-		if err != nil || createdAt <= 0 {
-			outputErrorMsg(w, http.StatusBadRequest, "created_at param error")
-			return
-		}
+	page, err := parsePage(r.URL.Query(), "transactions/"+strconv.FormatInt(user.ID, 10), TransactionsPerPage)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	var rows *sql.Rows
-
-	if itemID > 0 && createdAt > 0 {
-		// paging
-		rows, err = dbx.Query(`
-			SELECT
-				items.id,
-				items.seller_id,
-				items.buyer_id,
-				items.status,
-				items.name,
-				items.price,
-				items.description,
-				CONCAT("/uploads/", items.image_name) AS image_url,
-				items.category_id,
-				items.created_at,
-				IFNULL(transaction_evidences.id, 0),
-				IFNULL(transaction_evidences.status, ""),
-				IFNULL(shippings.status, "")
-			FROM items
-			LEFT JOIN transaction_evidences ON transaction_evidences.item_id = items.id
-			LEFT JOIN shippings ON shippings.transaction_evidence_id = transaction_evidences.id
-			WHERE (items.seller_id = ? OR items.buyer_id = ?)
-			AND items.status IN (?,?,?,?,?)
-			AND (items.created_at < ?  OR (items.created_at <= ? AND items.id < ?))
-			ORDER BY items.created_at DESC, items.id DESC LIMIT ?
-			`,
-			user.ID,
-			user.ID,
-			ItemStatusOnSale,
-			ItemStatusTrading,
-			ItemStatusSoldOut,
-			ItemStatusCancel,
-			ItemStatusStop,
-			time.Unix(createdAt, 0),
-			time.Unix(createdAt, 0),
-			itemID,
-			TransactionsPerPage+1,
-		)
-		if err != nil {
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
-	} else {
-		// 1st page
-		rows, err = dbx.Query(`
-			SELECT
-				items.id,
-				items.seller_id,
-				items.buyer_id,
-				items.status,
-				items.name,
-				items.price,
-				items.description,
-				CONCAT("/uploads/", items.image_name) AS image_url,
-				items.category_id,
-				items.created_at,
-				IFNULL(transaction_evidences.id, 0),
-				IFNULL(transaction_evidences.status, ""),
-				IFNULL(shippings.status, "")
-			FROM items
-			LEFT JOIN transaction_evidences ON transaction_evidences.item_id = items.id
-			LEFT JOIN shippings ON shippings.transaction_evidence_id = transaction_evidences.id
-			WHERE (items.seller_id = ? OR items.buyer_id = ?)
-			AND items.status IN (?,?,?,?,?)
-			ORDER BY items.created_at DESC, items.id DESC LIMIT ?
-			`,
-			user.ID,
-			user.ID,
-			ItemStatusOnSale,
-			ItemStatusTrading,
-			ItemStatusSoldOut,
-			ItemStatusCancel,
-			ItemStatusStop,
-			TransactionsPerPage+1,
-		)
-		if err != nil {
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
+	conds := "(items.seller_id = ? OR items.buyer_id = ?) AND items.status IN (?,?,?,?,?)"
+	args := []interface{}{
+		user.ID,
+		user.ID,
+		ItemStatusOnSale,
+		ItemStatusTrading,
+		ItemStatusSoldOut,
+		ItemStatusCancel,
+		ItemStatusStop,
+	}
+	if page.Cursor != nil {
+		cond, condArgs := page.createdKeyset("items")
+		conds += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	args = append(args, page.Limit+1)
+
+	rows, err := ld.DB().Query(`
+		SELECT
+			items.id,
+			items.seller_id,
+			items.buyer_id,
+			items.status,
+			items.name,
+			items.price,
+			items.description,
+			items.image_name,
+			items.category_id,
+			items.created_at,
+			IFNULL(transaction_evidences.id, 0),
+			IFNULL(transaction_evidences.status, ""),
+			IFNULL(shippings.status, "")
+		FROM items
+		LEFT JOIN transaction_evidences ON transaction_evidences.item_id = items.id
+		LEFT JOIN shippings ON shippings.transaction_evidence_id = transaction_evidences.id
+		WHERE `+conds+`
+		ORDER BY items.created_at DESC, items.id DESC LIMIT ?
+		`,
+		args...,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
 	}
 
 	itemDetails := []*ItemDetail{}
+	createdAts := []time.Time{}
 	for rows.Next() {
 		var createdAt time.Time
+		var imageName string
 		itemDetail := &ItemDetail{}
 
 		err := rows.Scan(
@@ -1065,7 +1204,7 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 			&itemDetail.Name,
 			&itemDetail.Price,
 			&itemDetail.Description,
-			&itemDetail.ImageURL,
+			&imageName,
 			&itemDetail.CategoryID,
 			&createdAt,
 			&itemDetail.TransactionEvidenceID,
@@ -1077,47 +1216,76 @@ func getTransactions(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		itemDetail.ImageURL = getImageURL(imageName)
 		itemDetail.CreatedAt = createdAt.Unix()
-		if itemDetail.BuyerID == 0 {
-			itemDetail.Buyer = nil
-		}
+		createdAts = append(createdAts, createdAt)
 
-		seller, err := getUserSimpleByID(dbx, itemDetail.SellerID)
+		category, err := ld.Category(itemDetail.CategoryID)
 		if err != nil {
 			outputErrorMsg(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		itemDetail.Seller = &seller
+		itemDetail.Category = &category
 
-		category, err := getCategoryByID(dbx, itemDetail.CategoryID)
-		if err != nil {
-			outputErrorMsg(w, http.StatusInternalServerError, err.Error())
+		itemDetails = append(itemDetails, itemDetail)
+	}
+	rows.Close()
+
+	userIDs := make([]int64, 0, len(itemDetails)*2)
+	for _, itemDetail := range itemDetails {
+		userIDs = append(userIDs, itemDetail.SellerID, itemDetail.BuyerID)
+	}
+	err = ld.LoadUsers(userIDs...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	itemIDs := make([]int64, 0, len(itemDetails))
+	for _, itemDetail := range itemDetails {
+		itemIDs = append(itemIDs, itemDetail.ID)
+	}
+	err = ld.LoadImages(itemIDs...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for _, itemDetail := range itemDetails {
+		seller, ok := ld.User(itemDetail.SellerID)
+		if !ok {
+			outputErrorMsg(w, http.StatusInternalServerError, "seller not found")
 			return
 		}
-		itemDetail.Category = &category
+		itemDetail.Seller = seller
+		itemDetail.Images = ld.Images(itemDetail.ID, itemDetail.ImageURL)
 
 		if itemDetail.BuyerID != 0 {
-			buyer, err := getUserSimpleByID(dbx, itemDetail.BuyerID)
-			if err != nil {
-				outputErrorMsg(w, http.StatusInternalServerError, err.Error())
+			buyer, ok := ld.User(itemDetail.BuyerID)
+			if !ok {
+				outputErrorMsg(w, http.StatusInternalServerError, "buyer not found")
 				return
 			}
-			itemDetail.Buyer = &buyer
+			itemDetail.Buyer = buyer
 		}
-
-		itemDetails = append(itemDetails, itemDetail)
 	}
-	rows.Close()
 
 	hasNext := false
-	if len(itemDetails) > TransactionsPerPage {
+	nextCursor := ""
+	if len(itemDetails) > page.Limit {
 		hasNext = true
-		itemDetails = itemDetails[0:TransactionsPerPage]
+		itemDetails = itemDetails[0:page.Limit]
+		nextCursor = page.NextCursor(Cursor{
+			Sort:      ListingSortCreated,
+			ID:        itemDetails[page.Limit-1].ID,
+			CreatedAt: createdAts[page.Limit-1].Unix(),
+		})
 	}
 
 	rts := resTransactions{
-		Items:   itemDetails,
-		HasNext: hasNext,
+		Items:      itemDetails,
+		HasNext:    hasNext,
+		NextCursor: nextCursor,
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
@@ -1139,8 +1307,10 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ld := requestLoader(r)
+
 	item := Item{}
-	err = dbx.Get(&item, "SELECT * FROM `items` WHERE `id` = ?", itemID)
+	err = sqlx.Get(ld.DB(), &item, "SELECT * FROM `items` WHERE `id` = ?", itemID)
 	if err == sql.ErrNoRows {
 		outputErrorMsg(w, http.StatusNotFound, "item not found")
 		return
@@ -1151,22 +1321,60 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	category, err := getCategoryByID(dbx, item.CategoryID)
+	if item.Status == ItemStatusStop && user.ID != item.SellerID {
+		// withdrawn items are only shown to their seller
+		outputErrorMsg(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	recordItemView(item.ID)
+
+	category, err := ld.Category(item.CategoryID)
 	if err != nil {
 		outputErrorMsg(w, http.StatusNotFound, "category not found")
 		return
 	}
 
-	seller, err := getUserSimpleByID(dbx, item.SellerID)
+	isParty := (user.ID == item.SellerID || user.ID == item.BuyerID) && item.BuyerID != 0
+
+	userIDs := []int64{item.SellerID}
+	if isParty {
+		userIDs = append(userIDs, item.BuyerID)
+		err = ld.LoadTrades(item.ID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	err = ld.LoadUsers(userIDs...)
 	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	err = ld.LoadImages(item.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	seller, ok := ld.User(item.SellerID)
+	if !ok {
 		outputErrorMsg(w, http.StatusNotFound, "seller not found")
 		return
 	}
 
+	if user.ID == item.SellerID {
+		// for If-Match on /items/edit
+		w.Header().Set("ETag", itemETag(item))
+	}
+
 	itemDetail := ItemDetail{
 		ID:       item.ID,
 		SellerID: item.SellerID,
-		Seller:   &seller,
+		Seller:   seller,
 		// BuyerID
 		// Buyer
 		Status:      item.Status,
@@ -1174,6 +1382,7 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		Price:       item.Price,
 		Description: item.Description,
 		ImageURL:    getImageURL(item.ImageName),
+		Images:      ld.Images(item.ID, getImageURL(item.ImageName)),
 		CategoryID:  item.CategoryID,
 		// TransactionEvidenceID
 		// TransactionEvidenceStatus
@@ -1181,41 +1390,30 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 		Category:  &category,
 		CreatedAt: item.CreatedAt.Unix(),
 	}
+	if user.ID == item.SellerID {
+		itemDetail.StopReason = item.StopReason
+	}
 
-	if (user.ID == item.SellerID || user.ID == item.BuyerID) && item.BuyerID != 0 {
-		buyer, err := getUserSimpleByID(dbx, item.BuyerID)
-		if err != nil {
+	if isParty {
+		buyer, ok := ld.User(item.BuyerID)
+		if !ok {
 			outputErrorMsg(w, http.StatusNotFound, "buyer not found")
 			return
 		}
 		itemDetail.BuyerID = item.BuyerID
-		itemDetail.Buyer = &buyer
+		itemDetail.Buyer = buyer
 
-		transactionEvidence := TransactionEvidence{}
-		err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ?", item.ID)
-		if err != nil && err != sql.ErrNoRows {
-			// It's able to ignore ErrNoRows
-			log.Print(err)
-			outputErrorMsg(w, http.StatusInternalServerError, "db error")
-			return
-		}
-
-		if transactionEvidence.ID > 0 {
-			shipping := Shipping{}
-			err = dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidence.ID)
-			if err == sql.ErrNoRows {
+		if trade, ok := ld.Trade(item.ID); ok {
+			if trade.ShippingStatus == "" {
 				outputErrorMsg(w, http.StatusNotFound, "shipping not found")
 				return
 			}
-			if err != nil {
-				log.Print(err)
-				outputErrorMsg(w, http.StatusInternalServerError, "db error")
-				return
-			}
 
-			itemDetail.TransactionEvidenceID = transactionEvidence.ID
-			itemDetail.TransactionEvidenceStatus = transactionEvidence.Status
-			itemDetail.ShippingStatus = shipping.Status
+			itemDetail.TransactionEvidenceID = trade.ID
+			itemDetail.TransactionEvidenceStatus = trade.Status
+			itemDetail.ShippingStatus = trade.ShippingStatus
+			itemDetail.CancellationStatus = trade.CancellationStatus
+			itemDetail.CancelRequestedBy = trade.CancelRequestedBy
 		}
 	}
 
@@ -1223,101 +1421,6 @@ func getItem(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(itemDetail)
 }
 
-func postItemEdit(w http.ResponseWriter, r *http.Request) {
-	rie := reqItemEdit{}
-	err := json.NewDecoder(r.Body).Decode(&rie)
-	if err != nil {
-		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
-		return
-	}
-
-	csrfToken := rie.CSRFToken
-	itemID := rie.ItemID
-	price := rie.ItemPrice
-
-	if csrfToken != getCSRFToken(r) {
-		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
-
-		return
-	}
-
-	if price < ItemMinPrice || price > ItemMaxPrice {
-		outputErrorMsg(w, http.StatusBadRequest, ItemPriceErrMsg)
-		return
-	}
-
-	seller, errCode, errMsg := getUser(r)
-	if errMsg != "" {
-		outputErrorMsg(w, errCode, errMsg)
-		return
-	}
-
-	targetItem := Item{}
-	err = dbx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "item not found")
-		return
-	}
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		return
-	}
-
-	if targetItem.SellerID != seller.ID {
-		outputErrorMsg(w, http.StatusForbidden, "自分の商品以外は編集できません")
-		return
-	}
-
-	tx := dbx.MustBegin()
-	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", itemID)
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	if targetItem.Status != ItemStatusOnSale {
-		outputErrorMsg(w, http.StatusForbidden, "販売中の商品以外編集できません")
-		tx.Rollback()
-		return
-	}
-
-	_, err = tx.Exec("UPDATE `items` SET `price` = ?, `updated_at` = ? WHERE `id` = ?",
-		price,
-		time.Now(),
-		itemID,
-	)
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", itemID)
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	tx.Commit()
-
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	json.NewEncoder(w).Encode(&resItemEdit{
-		ItemID:        targetItem.ID,
-		ItemPrice:     targetItem.Price,
-		ItemCreatedAt: targetItem.CreatedAt.Unix(),
-		ItemUpdatedAt: targetItem.UpdatedAt.Unix(),
-	})
-}
-
 func getQRCode(w http.ResponseWriter, r *http.Request) {
 	transactionEvidenceIDStr := pat.Param(r, "transaction_evidence_id")
 	transactionEvidenceID, err := strconv.ParseInt(transactionEvidenceIDStr, 10, 64)
@@ -1365,13 +1468,23 @@ func getQRCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(shipping.ImgBinary) == 0 {
+	img := shipping.ImgBinary
+	if shipping.ImgKey != "" {
+		img, err = qrCodeStore.Get(shipping.ImgKey)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "failed to read qrcode image")
+			return
+		}
+	}
+
+	if len(img) == 0 {
 		outputErrorMsg(w, http.StatusInternalServerError, "empty qrcode image")
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/png")
-	w.Write(shipping.ImgBinary)
+	w.Header().Set("Content-Type", QRCodeContentType)
+	w.Write(img)
 }
 
 func postBuy(w http.ResponseWriter, r *http.Request) {
@@ -1397,29 +1510,26 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 
 	tx := dbx.MustBegin()
 
-	targetItem := Item{}
-	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", rb.ItemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "item not found")
+	st, err := lockTrade(tx, rb.ItemID)
+	if err != nil {
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
+	err = TradeBuy.Check(st, st.BuyerRole(buyer.ID))
 	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
+	targetItem := st.Item
 
-	if targetItem.Status != ItemStatusOnSale {
-		outputErrorMsg(w, http.StatusForbidden, "item is not for sale")
-		tx.Rollback()
-		return
-	}
+	// before the seller is locked, as the stats of other trades are
+	err = countTradeStatus(tx, targetItem.SellerID, "", TradeBuy.EvidenceTo)
+	if err != nil {
+		log.Print(err)
 
-	if targetItem.SellerID == buyer.ID {
-		outputErrorMsg(w, http.StatusForbidden, "自分の商品は買えません")
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
 		tx.Rollback()
 		return
 	}
@@ -1439,7 +1549,7 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	category, err := getCategoryByID(tx, targetItem.CategoryID)
+	category, err := getCategoryByID(targetItem.CategoryID)
 	if err != nil {
 		log.Print(err)
 
@@ -1447,17 +1557,18 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		tx.Rollback()
 		return
 	}
+	rootCategory, _ := currentCategoryTree().Root(category.ID)
 
 	result, err := tx.Exec("INSERT INTO `transaction_evidences` (`seller_id`, `buyer_id`, `status`, `item_id`, `item_name`, `item_price`, `item_description`,`item_category_id`,`item_root_category_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		targetItem.SellerID,
 		buyer.ID,
-		TransactionEvidenceStatusWaitShipping,
+		TradeBuy.EvidenceTo,
 		targetItem.ID,
 		targetItem.Name,
 		targetItem.Price,
 		targetItem.Description,
 		category.ID,
-		category.ParentID,
+		rootCategory.ID,
 	)
 	if err != nil {
 		log.Print(err)
@@ -1476,12 +1587,15 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.Exec("UPDATE `items` SET `buyer_id` = ?, `status` = ?, `updated_at` = ? WHERE `id` = ?",
-		buyer.ID,
-		ItemStatusTrading,
-		time.Now(),
-		targetItem.ID,
-	)
+	actor := requestAuditActor(r, buyer.ID, string(TradeRoleBuyer))
+	err = writeAudit(tx, actor, AuditEvent{
+		Action:      TradeBuy.Name,
+		EntityType:  AuditEntityTransactionEvidence,
+		EntityID:    transactionEvidenceID,
+		ItemID:      targetItem.ID,
+		UserID:      targetItem.SellerID,
+		StatusAfter: TradeBuy.EvidenceTo,
+	}, nil)
 	if err != nil {
 		log.Print(err)
 
@@ -1490,78 +1604,113 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chErr := make(chan int)
-	chScr := make(chan *APIShipmentCreateRes)
+	st.Item.BuyerID = buyer.ID
+	err = TradeBuy.Apply(tx, st, "", actor)
+	if err != nil {
+		outputTradeError(w, err)
+		tx.Rollback()
+		return
+	}
+
+	payment, err := beginPayment(targetItem, buyer.ID, rb.Token)
+	if err != nil {
+		log.Print(err)
 
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	var scr *APIShipmentCreateRes
+	var pstr *APIPaymentServiceTokenRes
+	var scrErr, pstrErr error
+
+	// both calls must finish before deciding anything, otherwise a charge
+	// could land after the transaction was already rolled back
+	wg := sync.WaitGroup{}
+	wg.Add(2)
 	go func() {
-		scr, err := APIShipmentCreate(getShipmentServiceURL(), &APIShipmentCreateReq{
+		defer wg.Done()
+		scr, scrErr = shipmentService.Create(&APIShipmentCreateReq{
 			ToAddress:   buyer.Address,
 			ToName:      buyer.AccountName,
 			FromAddress: seller.Address,
 			FromName:    seller.AccountName,
 		})
-		if err != nil {
-			log.Print("failed to request to shipment service:", err)
-			chErr <- http.StatusInternalServerError
-			return
-		}
-		chScr <- scr
-		chErr <- 0
 	}()
-
 	go func() {
-		pstr, err := APIPaymentToken(getPaymentServiceURL(), &APIPaymentServiceTokenReq{
+		defer wg.Done()
+		pstr, pstrErr = paymentService.Token(&APIPaymentServiceTokenReq{
 			ShopID: PaymentServiceIsucariShopID,
 			Token:  rb.Token,
 			APIKey: PaymentServiceIsucariAPIKey,
 			Price:  targetItem.Price,
 		})
-		if err != nil {
-			log.Print("payment service is failed:", err)
-			chErr <- http.StatusInternalServerError
-			return
-		}
-		if pstr.Status == "invalid" {
-			log.Print("カード情報に誤りがあります")
-			chErr <- http.StatusBadRequest
-			return
-		}
-		if pstr.Status == "fail" {
-			log.Print("カードの残高が足りません")
-			chErr <- http.StatusBadRequest
-			return
-		}
-		if pstr.Status != "ok" {
-			log.Print("想定外のエラー")
-			chErr <- http.StatusBadRequest
-			return
-		}
-		chErr <- 0
 	}()
+	wg.Wait()
 
-	var scr *APIShipmentCreateRes
-	apiCount := 2
-	for {
-		if apiCount == 0 {
-			break
+	reserveID := ""
+	if scrErr == nil {
+		reserveID = scr.ReserveID
+	}
+	paymentStatus := ""
+	if pstrErr == nil {
+		paymentStatus = pstr.Status
+	}
+	err = payment.record(paymentStatus, reserveID)
+	if err != nil {
+		log.Print(err)
+	}
+
+	errStatus := 0
+	if scrErr != nil {
+		log.Print("failed to request to shipment service:", scrErr)
+		errStatus = http.StatusInternalServerError
+	}
+	if pstrErr != nil {
+		log.Print("payment service is failed:", pstrErr)
+		errStatus = http.StatusInternalServerError
+	} else if pstr.Status == PaymentStatusInvalid {
+		log.Print("カード情報に誤りがあります")
+		errStatus = http.StatusBadRequest
+	} else if pstr.Status == PaymentStatusFail {
+		log.Print("カードの残高が足りません")
+		errStatus = http.StatusBadRequest
+	} else if pstr.Status != PaymentStatusOK {
+		log.Print("想定外のエラー")
+		errStatus = http.StatusBadRequest
+	}
+	if errStatus != 0 {
+		outputErrorMsg(w, errStatus, "なんかエラー")
+		tx.Rollback()
+		payment.abort("external service error")
+
+		// the purchase is rolled back, so this is the only trace of it
+		detail := map[string]string{"payment_status": paymentStatus, "reserve_id": reserveID}
+		if scrErr != nil {
+			detail["shipment_error"] = scrErr.Error()
 		}
-		select {
-		case errStatus := <-chErr:
-			if errStatus == 0 {
-				apiCount--
-				continue
-			}
-			outputErrorMsg(w, errStatus, "なんかエラー")
-			tx.Rollback()
-			return
-		case scr = <-chScr:
-			break
+		if pstrErr != nil {
+			detail["payment_error"] = pstrErr.Error()
 		}
+		err = writeAudit(dbx, actor, AuditEvent{
+			Action:       "buy_failed",
+			EntityType:   AuditEntityPayment,
+			EntityID:     payment.ID,
+			ItemID:       targetItem.ID,
+			UserID:       targetItem.SellerID,
+			StatusBefore: PaymentStatePending,
+			StatusAfter:  PaymentStateCompensating,
+		}, detail)
+		if err != nil {
+			log.Print(err)
+		}
+		return
 	}
 
 	_, err = tx.Exec("INSERT INTO `shippings` (`transaction_evidence_id`, `status`, `item_name`, `item_id`, `reserve_id`, `reserve_time`, `to_address`, `to_name`, `from_address`, `from_name`, `img_binary`) VALUES (?,?,?,?,?,?,?,?,?,?,?)",
 		transactionEvidenceID,
-		ShippingsStatusInitial,
+		TradeBuy.ShippingTo[0],
 		targetItem.Name,
 		targetItem.ID,
 		scr.ReserveID,
@@ -1577,10 +1726,59 @@ func postBuy(w http.ResponseWriter, r *http.Request) {
 
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
 		tx.Rollback()
+		payment.abort(err.Error())
 		return
 	}
 
-	tx.Commit()
+	err = payment.capture(tx, transactionEvidenceID)
+	if err == ErrPaymentNotPending {
+		// the buy took longer than PaymentPendingTimeout and the
+		// compensator is already refunding it
+		log.Printf("payment %d was taken over by the compensator", payment.ID)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "payment timed out")
+		tx.Rollback()
+		return
+	}
+	if err == nil {
+		err = writeAudit(tx, actor, AuditEvent{
+			Action:      TradeBuy.Name,
+			EntityType:  AuditEntityShipping,
+			EntityID:    transactionEvidenceID,
+			ItemID:      targetItem.ID,
+			UserID:      targetItem.SellerID,
+			StatusAfter: TradeBuy.ShippingTo[0],
+		}, map[string]interface{}{"reserve_id": scr.ReserveID, "reserve_time": scr.ReserveTime})
+	}
+	if err == nil {
+		err = writeAudit(tx, actor, AuditEvent{
+			Action:       TradeBuy.Name,
+			EntityType:   AuditEntityPayment,
+			EntityID:     payment.ID,
+			ItemID:       targetItem.ID,
+			UserID:       targetItem.SellerID,
+			StatusBefore: PaymentStatePending,
+			StatusAfter:  PaymentStateCaptured,
+		}, map[string]string{"payment_status": paymentStatus, "reserve_id": reserveID})
+	}
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		payment.abort(err.Error())
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		payment.abort(err.Error())
+		return
+	}
+	searchIndex.Put(st.Item)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: transactionEvidenceID})
@@ -1606,117 +1804,98 @@ func postShip(w http.ResponseWriter, r *http.Request) {
 
 	seller, errCode, errMsg := getUser(r)
 	if errMsg != "" {
-		outputErrorMsg(w, errCode, errMsg)
-		return
-	}
-
-	transactionEvidence := TransactionEvidence{}
-	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ?", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
-		return
-	}
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-
-		return
-	}
-
-	if transactionEvidence.SellerID != seller.ID {
-		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
+		outputErrorMsg(w, errCode, errMsg)
 		return
 	}
 
 	tx := dbx.MustBegin()
 
-	item := Item{}
-	err = tx.Get(&item, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "item not found")
-		tx.Rollback()
-		return
-	}
+	st, err := lockTrade(tx, itemID)
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
-
-	if item.Status != ItemStatusTrading {
-		outputErrorMsg(w, http.StatusForbidden, "商品が取引中ではありません")
+	err = TradeShip.Check(st, st.Role(seller.ID))
+	if err != nil {
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
 
-	err = tx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `id` = ? FOR UPDATE", transactionEvidence.ID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
-		tx.Rollback()
-		return
-	}
+	img, err := shipmentService.Request(&APIShipmentRequestReq{
+		ReserveID: st.Shipping.ReserveID,
+	})
 	if err != nil {
 		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputErrorMsg(w, http.StatusInternalServerError, "failed to request to shipment service")
 		tx.Rollback()
-		return
-	}
 
-	if transactionEvidence.Status != TransactionEvidenceStatusWaitShipping {
-		outputErrorMsg(w, http.StatusForbidden, "準備ができていません")
-		tx.Rollback()
 		return
 	}
 
-	shipping := Shipping{}
-	err = tx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ? FOR UPDATE", transactionEvidence.ID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "shippings not found")
+	// the key is not guessable so that a public bucket does not give the QR
+	// codes away
+	imgKey := fmt.Sprintf("%d-%s.png", st.TransactionEvidence.ID, secureRandomStr(16))
+	err = qrCodeStore.Put(imgKey, img, QRCodeContentType)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "failed to save qrcode image")
 		tx.Rollback()
 		return
 	}
+
+	// from here on the new QR code goes again when the row does not end up
+	// referring to it
+	_, err = tx.Exec("UPDATE `shippings` SET `img_key` = ? WHERE `transaction_evidence_id` = ?",
+		imgKey,
+		st.TransactionEvidence.ID,
+	)
 	if err != nil {
 		log.Print(err)
+
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
 		tx.Rollback()
+		deleteQRCode(imgKey)
 		return
 	}
 
-	img, err := APIShipmentRequest(getShipmentServiceURL(), &APIShipmentRequestReq{
-		ReserveID: shipping.ReserveID,
-	})
+	err = TradeShip.Apply(tx, st, "", requestAuditActor(r, seller.ID, string(TradeRoleSeller)))
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "failed to request to shipment service")
+		outputTradeError(w, err)
 		tx.Rollback()
-
+		deleteQRCode(imgKey)
 		return
 	}
 
-	_, err = tx.Exec("UPDATE `shippings` SET `status` = ?, `img_binary` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
-		ShippingsStatusWaitPickup,
-		img,
-		time.Now(),
-		transactionEvidence.ID,
-	)
+	err = tx.Commit()
 	if err != nil {
 		log.Print(err)
-
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
+		deleteQRCode(imgKey)
 		return
 	}
-
-	tx.Commit()
+	// a repeated /ship replaces the QR code of the previous one
+	if st.Shipping.ImgKey != "" {
+		deleteQRCode(st.Shipping.ImgKey)
+	}
 
 	rps := resPostShip{
-		Path:      fmt.Sprintf("/transactions/%d.png", transactionEvidence.ID),
-		ReserveID: shipping.ReserveID,
+		Path:      fmt.Sprintf("/transactions/%d.png", st.TransactionEvidence.ID),
+		ReserveID: st.Shipping.ReserveID,
 	}
 	json.NewEncoder(w).Encode(rps)
 }
 
+// deleteQRCode removes a QR code no shipping refers to. A failure only leaves
+// the object behind, so it is logged rather than returned.
+func deleteQRCode(key string) {
+	err := qrCodeStore.Delete(key)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
 func postShipDone(w http.ResponseWriter, r *http.Request) {
 	reqpsd := reqPostShipDone{}
 
@@ -1741,81 +1920,34 @@ func postShipDone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transactionEvidence := TransactionEvidence{}
-	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ?", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidence not found")
-		return
-	}
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-
-		return
-	}
-
-	if transactionEvidence.SellerID != seller.ID {
-		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
-		return
-	}
-
 	tx := dbx.MustBegin()
 
-	item := Item{}
-	err = tx.Get(&item, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "items not found")
-		tx.Rollback()
-		return
-	}
+	st, err := lockTrade(tx, itemID)
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	if item.Status != ItemStatusTrading {
-		outputErrorMsg(w, http.StatusForbidden, "商品が取引中ではありません")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
 
-	err = tx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `id` = ? FOR UPDATE", transactionEvidence.ID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
-		tx.Rollback()
-		return
-	}
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+	role := st.Role(seller.ID)
+	if role == TradeRoleSeller && st.TransactionEvidence != nil && st.TransactionEvidence.Status == TransactionEvidenceStatusWaitDone {
+		// the shipment synchronizer has already seen the parcel picked up
 		tx.Rollback()
-		return
-	}
 
-	if transactionEvidence.Status != TransactionEvidenceStatusWaitShipping {
-		outputErrorMsg(w, http.StatusForbidden, "準備ができていません")
-		tx.Rollback()
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: st.TransactionEvidence.ID})
 		return
 	}
 
-	shipping := Shipping{}
-	err = tx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ? FOR UPDATE", transactionEvidence.ID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "shippings not found")
-		tx.Rollback()
-		return
-	}
+	err = TradeShipDone.Check(st, role)
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
 
-	ssr, err := APIShipmentStatus(getShipmentServiceURL(), &APIShipmentStatusReq{
-		ReserveID: shipping.ReserveID,
+	ssr, err := shipmentService.Status(&APIShipmentStatusReq{
+		ReserveID: st.Shipping.ReserveID,
 	})
 	if err != nil {
 		log.Print(err)
@@ -1825,34 +1957,9 @@ func postShipDone(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !(ssr.Status == ShippingsStatusShipping || ssr.Status == ShippingsStatusDone) {
-		outputErrorMsg(w, http.StatusForbidden, "shipment service側で配送中か配送完了になっていません")
-		tx.Rollback()
-		return
-	}
-
-	_, err = tx.Exec("UPDATE `shippings` SET `status` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
-		ssr.Status,
-		time.Now(),
-		transactionEvidence.ID,
-	)
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	_, err = tx.Exec("UPDATE `transaction_evidences` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
-		TransactionEvidenceStatusWaitDone,
-		time.Now(),
-		transactionEvidence.ID,
-	)
+	err = TradeShipDone.Apply(tx, st, ssr.Status, requestAuditActor(r, seller.ID, string(role)))
 	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
@@ -1860,7 +1967,7 @@ func postShipDone(w http.ResponseWriter, r *http.Request) {
 	tx.Commit()
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: transactionEvidence.ID})
+	json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: st.TransactionEvidence.ID})
 }
 
 func postComplete(w http.ResponseWriter, r *http.Request) {
@@ -1887,75 +1994,23 @@ func postComplete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transactionEvidence := TransactionEvidence{}
-	err = dbx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ?", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidence not found")
-		return
-	}
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-
-		return
-	}
-
-	if transactionEvidence.BuyerID != buyer.ID {
-		outputErrorMsg(w, http.StatusForbidden, "権限がありません")
-		return
-	}
-
 	tx := dbx.MustBegin()
-	item := Item{}
-	err = tx.Get(&item, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "items not found")
-		tx.Rollback()
-		return
-	}
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	if item.Status != ItemStatusTrading {
-		outputErrorMsg(w, http.StatusForbidden, "商品が取引中ではありません")
-		tx.Rollback()
-		return
-	}
 
-	err = tx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ? FOR UPDATE", itemID)
-	if err == sql.ErrNoRows {
-		outputErrorMsg(w, http.StatusNotFound, "transaction_evidences not found")
-		tx.Rollback()
-		return
-	}
+	st, err := lockTrade(tx, itemID)
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	if transactionEvidence.Status != TransactionEvidenceStatusWaitDone {
-		outputErrorMsg(w, http.StatusForbidden, "準備ができていません")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
-
-	shipping := Shipping{}
-	err = tx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ? FOR UPDATE", transactionEvidence.ID)
+	err = TradeComplete.Check(st, st.Role(buyer.ID))
 	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
 
-	ssr, err := APIShipmentStatus(getShipmentServiceURL(), &APIShipmentStatusReq{
-		ReserveID: shipping.ReserveID,
+	ssr, err := shipmentService.Status(&APIShipmentStatusReq{
+		ReserveID: st.Shipping.ReserveID,
 	})
 	if err != nil {
 		log.Print(err)
@@ -1965,55 +2020,18 @@ func postComplete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !(ssr.Status == ShippingsStatusDone) {
-		outputErrorMsg(w, http.StatusBadRequest, "shipment service側で配送完了になっていません")
-		tx.Rollback()
-		return
-	}
-
-	_, err = tx.Exec("UPDATE `shippings` SET `status` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
-		ShippingsStatusDone,
-		time.Now(),
-		transactionEvidence.ID,
-	)
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	_, err = tx.Exec("UPDATE `transaction_evidences` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
-		TransactionEvidenceStatusDone,
-		time.Now(),
-		transactionEvidence.ID,
-	)
-	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		tx.Rollback()
-		return
-	}
-
-	_, err = tx.Exec("UPDATE `items` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
-		ItemStatusSoldOut,
-		time.Now(),
-		itemID,
-	)
+	err = TradeComplete.Apply(tx, st, ssr.Status, requestAuditActor(r, buyer.ID, string(TradeRoleBuyer)))
 	if err != nil {
-		log.Print(err)
-
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		outputTradeError(w, err)
 		tx.Rollback()
 		return
 	}
 
 	tx.Commit()
+	searchIndex.Put(st.Item)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: transactionEvidence.ID})
+	json.NewEncoder(w).Encode(resBuy{TransactionEvidenceID: st.TransactionEvidence.ID})
 }
 
 func postSell(w http.ResponseWriter, r *http.Request) {
@@ -2023,13 +2041,15 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 	priceStr := r.FormValue("price")
 	categoryIDStr := r.FormValue("category_id")
 
-	f, header, err := r.FormFile("image")
-	if err != nil {
-		log.Print(err)
+	files := itemImageFiles(r)
+	if len(files) == 0 {
 		outputErrorMsg(w, http.StatusBadRequest, "image error")
 		return
 	}
-	defer f.Close()
+	if len(files) > ItemImagesMax {
+		outputErrorMsg(w, http.StatusBadRequest, fmt.Sprintf("up to %d images can be uploaded", ItemImagesMax))
+		return
+	}
 
 	if csrfToken != getCSRFToken(r) {
 		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
@@ -2048,22 +2068,9 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if name == "" || description == "" || price == 0 || categoryID == 0 {
-		outputErrorMsg(w, http.StatusBadRequest, "all parameters are required")
-
-		return
-	}
-
-	if price < ItemMinPrice || price > ItemMaxPrice {
-		outputErrorMsg(w, http.StatusBadRequest, ItemPriceErrMsg)
-
-		return
-	}
-
-	category, err := getCategoryByID(dbx, categoryID)
-	if err != nil || category.ParentID == 0 {
-		log.Print(categoryID, category)
-		outputErrorMsg(w, http.StatusBadRequest, "Incorrect category ID")
+	category, err := validateItem(name, description, price, categoryID)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -2073,26 +2080,11 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	img, err := ioutil.ReadAll(f)
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "image error")
-		return
-	}
-
-	ext := filepath.Ext(header.Filename)
-
-	if !(ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".gif") {
-		outputErrorMsg(w, http.StatusBadRequest, "unsupported image format error")
+	images, err := saveItemImages(files)
+	if err == ErrUnsupportedImage || err == ErrImageTooLarge {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	if ext == ".jpeg" {
-		ext = ".jpg"
-	}
-
-	imgName := fmt.Sprintf("%s%s", secureRandomStr(16), ext)
-	err = ioutil.WriteFile(fmt.Sprintf("../public/upload/%s", imgName), img, 0644)
 	if err != nil {
 		log.Print(err)
 		outputErrorMsg(w, http.StatusInternalServerError, "Saving image failed")
@@ -2115,13 +2107,14 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := tx.Exec("INSERT INTO `items` (`seller_id`, `status`, `name`, `price`, `description`,`image_name`,`category_id`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+	result, err := tx.Exec("INSERT INTO `items` (`seller_id`, `status`, `name`, `price`, `description`,`image_name`,`thumbnail_name`,`category_id`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
 		seller.ID,
 		ItemStatusOnSale,
 		name,
 		price,
 		description,
-		imgName,
+		images[0].ImageName,
+		images[0].ThumbnailName,
 		category.ID,
 	)
 	if err != nil {
@@ -2139,13 +2132,13 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userSimple := UserSimple{}
-
-	userSimple.AccountName = seller.AccountName
-	userSimple.ID = seller.ID
-	userSimple.NumSellItems = seller.NumSellItems + 1
-
-	userSimpleCache.Set(userSimple.ID, &userSimple)
+	err = insertItemImages(tx, itemID, images)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
 
 	now := time.Now()
 	_, err = tx.Exec("UPDATE `users` SET `num_sell_items`=?, `last_bump`=? WHERE `id`=?",
@@ -2159,7 +2152,24 @@ func postSell(w http.ResponseWriter, r *http.Request) {
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
 		return
 	}
+
+	err = writeAudit(tx, requestAuditActor(r, seller.ID, string(TradeRoleSeller)), AuditEvent{
+		Action:      "sell",
+		EntityType:  AuditEntityItem,
+		EntityID:    itemID,
+		ItemID:      itemID,
+		UserID:      seller.ID,
+		StatusAfter: ItemStatusOnSale,
+	}, map[string]interface{}{"name": name, "price": price, "category_id": category.ID})
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
 	tx.Commit()
+	invalidateUser(seller.ID)
+	searchIndex.Refresh(dbx, itemID)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(resSell{ID: itemID})
@@ -2260,6 +2270,22 @@ func postBump(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = writeAudit(tx, requestAuditActor(r, user.ID, string(TradeRoleSeller)), AuditEvent{
+		Action:       "bump",
+		EntityType:   AuditEntityItem,
+		EntityID:     targetItem.ID,
+		ItemID:       targetItem.ID,
+		UserID:       seller.ID,
+		StatusBefore: targetItem.Status,
+		StatusAfter:  targetItem.Status,
+	}, map[string]int64{"created_at_before": targetItem.CreatedAt.Unix(), "created_at_after": now.Unix()})
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
 	err = tx.Get(&targetItem, "SELECT * FROM `items` WHERE `id` = ?", itemID)
 	if err != nil {
 		log.Print(err)
@@ -2269,6 +2295,7 @@ func postBump(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tx.Commit()
+	searchIndex.Put(targetItem)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(&resItemEdit{
@@ -2291,7 +2318,7 @@ func getSettings(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ress.PaymentServiceURL = getPaymentServiceURL()
-	ress.Categories = cachedCategories
+	ress.Categories = currentCategoryTree().All()
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	json.NewEncoder(w).Encode(ress)
@@ -2314,9 +2341,23 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	retryAfter, err := loginRetryAfter(accountName, ip)
+	if err != nil {
+		log.Print(err)
+
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if retryAfter > 0 {
+		outputTooManyRequests(w, retryAfter)
+		return
+	}
+
 	u := User{}
 	err = dbx.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ?", accountName)
 	if err == sql.ErrNoRows {
+		recordLoginFailure(accountName, ip)
 		outputErrorMsg(w, http.StatusUnauthorized, "アカウント名かパスワードが間違えています")
 		return
 	}
@@ -2327,8 +2368,9 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword(u.HashedPassword, []byte(password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
+	err = comparePassword(u.HashedPassword, []byte(password))
+	if err == ErrPasswordMismatch {
+		recordLoginFailure(accountName, ip)
 		outputErrorMsg(w, http.StatusUnauthorized, "アカウント名かパスワードが間違えています")
 		return
 	}
@@ -2338,8 +2380,15 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		outputErrorMsg(w, http.StatusInternalServerError, "crypt error")
 		return
 	}
+	if u.BannedAt != nil {
+		outputErrorMsg(w, http.StatusForbidden, BannedErrMsg)
+		return
+	}
+	resetLoginFailures(accountName)
+	upgradePasswordHash(&u, []byte(password))
 
 	session := getSession(r)
+	renewSession(session)
 
 	session.Values["user_id"] = u.ID
 	session.Values["csrf_token"] = secureRandomStr(20)
@@ -2372,7 +2421,7 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+	hashedPassword, err := passwordPolicy.Hash([]byte(password))
 	if err != nil {
 		log.Print(err)
 
@@ -2380,7 +2429,8 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := dbx.Exec("INSERT INTO `users` (`account_name`, `hashed_password`, `address`) VALUES (?, ?, ?)",
+	tx := dbx.MustBegin()
+	result, err := tx.Exec("INSERT INTO `users` (`account_name`, `hashed_password`, `address`) VALUES (?, ?, ?)",
 		accountName,
 		hashedPassword,
 		address,
@@ -2389,6 +2439,7 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
 		return
 	}
 
@@ -2398,6 +2449,24 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 
 		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
+		return
+	}
+
+	err = writeAudit(tx, requestAuditActor(r, userID, RoleUser), AuditEvent{
+		Action:      "register",
+		EntityType:  AuditEntityUser,
+		EntityID:    userID,
+		UserID:      userID,
+		StatusAfter: UserStatusActive,
+	}, map[string]string{"account_name": accountName})
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		tx.Rollback()
 		return
 	}
 
@@ -2408,6 +2477,7 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	session := getSession(r)
+	renewSession(session)
 	session.Values["user_id"] = u.ID
 	session.Values["csrf_token"] = secureRandomStr(20)
 	if err = session.Save(r, w); err != nil {
@@ -2420,19 +2490,6 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(u)
 }
 
-func getReports(w http.ResponseWriter, r *http.Request) {
-	transactionEvidences := make([]TransactionEvidence, 0)
-	err := dbx.Select(&transactionEvidences, "SELECT * FROM `transaction_evidences` WHERE `id` > 15007")
-	if err != nil {
-		log.Print(err)
-		outputErrorMsg(w, http.StatusInternalServerError, "db error")
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	json.NewEncoder(w).Encode(transactionEvidences)
-}
-
 func outputErrorMsg(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 
@@ -2444,5 +2501,5 @@ func outputErrorMsg(w http.ResponseWriter, status int, msg string) {
 }
 
 func getImageURL(imageName string) string {
-	return fmt.Sprintf("/upload/%s", imageName)
+	return imageStore.URL(imageName)
 }
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/jmoiron/sqlx"
+)
+
+// Tests that need MySQL run against the database in ISUCARI_TEST_DSN and are
+// skipped without it. The database is wiped, so do not point it at real data:
+//
+//	ISUCARI_TEST_DSN='isucari:isucari@tcp(127.0.0.1:3306)/isucari_test' go test .
+const testDSNEnv = "ISUCARI_TEST_DSN"
+
+const testPassword = "password"
+
+var (
+	testDBOnce sync.Once
+	testDBErr  error
+)
+
+// setupTestDB points the app at an empty test database, in-memory sessions
+// and the fake external services.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skip(testDSNEnv + " is not set")
+	}
+	testDBOnce.Do(func() {
+		testDBErr = openTestDB(dsn)
+	})
+	if testDBErr != nil {
+		t.Fatal(testDBErr)
+	}
+
+	tables := []string{}
+	err := dbx.Select(&tables, "SHOW TABLES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if table == "categories" {
+			continue
+		}
+		_, err = dbx.Exec("DELETE FROM `" + table + "`")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clearConfigCache()
+	userSimpleCache.Purge()
+	searchIndex = NewSearchIndex()
+
+	store = NewServerSessionStore(NewMemorySessionBackend(), securecookie.GenerateRandomKey(32))
+	paymentService = NewFakePaymentService()
+	shipmentService = NewFakeShipmentService()
+
+	dir, err := ioutil.TempDir("", "isucari-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	imageStore = NewLocalBlobStore(dir+"/upload", DefaultUploadURL)
+	qrCodeStore = NewLocalBlobStore(dir+"/qrcode", "")
+}
+
+func openTestDB(dsn string) error {
+	var err error
+	dbx, err = sqlx.Open("mysql", dsn+"?charset=utf8mb4&parseTime=true&loc=Local")
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile("testdata/schema.sql")
+	if err != nil {
+		return err
+	}
+	for _, stmt := range strings.Split(string(b), ";\n") {
+		if strings.TrimSpace(stripSQLComments(stmt)) == "" {
+			continue
+		}
+		_, err = dbx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"payments", "idempotency_keys", "trade_cancellations", "trade_auto_actions", "sessions", "login_failures",
+		"item_views", "item_view_rankings", "item_view_ranks", "cache_invalidations", "item_images", "blobs", "item_edit_histories", "audit_events",
+		"seller_stats", "seller_daily_sales", "seller_category_sales"} {
+		_, err = dbx.Exec("DROP TABLE IF EXISTS `" + table + "`")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ensureSchema(dbx)
+	if err != nil {
+		return err
+	}
+	return prepareCategory(dbx)
+}
+
+func stripSQLComments(s string) string {
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// testClient calls handlers with the cookies of one browser.
+type testClient struct {
+	t         *testing.T
+	cookies   map[string]*http.Cookie
+	User      User
+	CSRFToken string
+}
+
+func newTestClient(t *testing.T) *testClient {
+	return &testClient{t: t, cookies: map[string]*http.Cookie{}}
+}
+
+// registerTestUser signs a new user up and returns a client logged in as them.
+func registerTestUser(t *testing.T, accountName string) *testClient {
+	t.Helper()
+
+	c := newTestClient(t)
+	w := c.do(postRegister, http.MethodPost, "/register", reqRegister{
+		AccountName: accountName,
+		Address:     accountName + "'s address",
+		Password:    testPassword,
+	})
+	decodeTestResponse(t, w, http.StatusOK, &c.User)
+	c.loadCSRFToken()
+	return c
+}
+
+func (c *testClient) loadCSRFToken() {
+	c.t.Helper()
+
+	res := resSetting{}
+	decodeTestResponse(c.t, c.do(getSettings, http.MethodGet, "/settings", nil), http.StatusOK, &res)
+	c.CSRFToken = res.CSRFToken
+}
+
+func (c *testClient) do(h http.HandlerFunc, method, target string, body interface{}) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		rd = bytes.NewReader(b)
+	}
+	r := httptest.NewRequest(method, target, rd)
+	for _, ck := range c.cookies {
+		r.AddCookie(ck)
+	}
+
+	w := httptest.NewRecorder()
+	withRequestID(h).ServeHTTP(w, r)
+
+	for _, ck := range w.Result().Cookies() {
+		if ck.MaxAge < 0 {
+			delete(c.cookies, ck.Name)
+		} else {
+			c.cookies[ck.Name] = ck
+		}
+	}
+	return w
+}
+
+func decodeTestResponse(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	err := json.NewDecoder(w.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertTestItem(t *testing.T, sellerID int64, price int) Item {
+	t.Helper()
+
+	result, err := dbx.Exec("INSERT INTO `items` (`seller_id`, `status`, `name`, `price`, `description`, `image_name`, `category_id`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		sellerID, ItemStatusOnSale, "item", price, "description", "item.jpg", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+
+	item := Item{}
+	err = dbx.Get(&item, "SELECT * FROM `items` WHERE `id` = ?", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func getTestPayment(t *testing.T, itemID int64) Payment {
+	t.Helper()
+
+	p := Payment{}
+	err := dbx.Get(&p, "SELECT * FROM `payments` WHERE `item_id` = ? ORDER BY `id` DESC LIMIT 1", itemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// waitTestPayment waits for the compensation that abort starts in the
+// background.
+func waitTestPayment(t *testing.T, itemID int64, state string) Payment {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p := getTestPayment(t, itemID)
+		if p.State == state {
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("payment %d is %s, want %s", p.ID, p.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testItemStatus(t *testing.T, itemID int64) string {
+	t.Helper()
+
+	var status string
+	err := dbx.Get(&status, "SELECT `status` FROM `items` WHERE `id` = ?", itemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func issueTestPaymentToken(t *testing.T, cardNumber string) string {
+	t.Helper()
+
+	token, err := paymentService.(*FakePaymentService).IssueToken(PaymentServiceIsucariShopID, cardNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// buyTestItem buys the item through /buy and returns its transaction
+// evidence.
+func buyTestItem(t *testing.T, buyer *testClient, item Item) TransactionEvidence {
+	t.Helper()
+
+	res := resBuy{}
+	w := buyer.do(postBuy, http.MethodPost, "/buy", reqBuy{CSRFToken: buyer.CSRFToken, ItemID: item.ID, Token: issueTestPaymentToken(t, "AAAAAAAA")})
+	decodeTestResponse(t, w, http.StatusOK, &res)
+
+	te := TransactionEvidence{}
+	err := dbx.Get(&te, "SELECT * FROM `transaction_evidences` WHERE `id` = ?", res.TransactionEvidenceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return te
+}
+
+func getTestShipping(t *testing.T, transactionEvidenceID int64) Shipping {
+	t.Helper()
+
+	shipping := Shipping{}
+	err := dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", transactionEvidenceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shipping
+}
+
+func TestPostBuy(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	item := insertTestItem(t, seller.User.ID, 1000)
+	token := issueTestPaymentToken(t, "AAAAAAAA")
+
+	res := resBuy{}
+	w := buyer.do(postBuy, http.MethodPost, "/buy", reqBuy{CSRFToken: buyer.CSRFToken, ItemID: item.ID, Token: token})
+	decodeTestResponse(t, w, http.StatusOK, &res)
+
+	if got := testItemStatus(t, item.ID); got != ItemStatusTrading {
+		t.Errorf("item is %s, want %s", got, ItemStatusTrading)
+	}
+
+	te := TransactionEvidence{}
+	err := dbx.Get(&te, "SELECT * FROM `transaction_evidences` WHERE `id` = ?", res.TransactionEvidenceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if te.BuyerID != buyer.User.ID || te.Status != TransactionEvidenceStatusWaitShipping || te.ItemRootCategoryID != 1 {
+		t.Errorf("transaction evidence %+v", te)
+	}
+
+	shipping := Shipping{}
+	err = dbx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ?", te.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sres, err := shipmentService.Status(&APIShipmentStatusReq{ReserveID: shipping.ReserveID})
+	if err != nil || sres.Status != ShippingsStatusInitial {
+		t.Errorf("shipment %s: %v, %v", shipping.ReserveID, sres, err)
+	}
+
+	p := getTestPayment(t, item.ID)
+	if p.State != PaymentStateCaptured || p.TransactionEvidenceID != te.ID || p.ReserveID != shipping.ReserveID {
+		t.Errorf("payment %+v", p)
+	}
+	if price, ok := paymentService.(*FakePaymentService).Charged(token); !ok || price != item.Price {
+		t.Errorf("charged %d, %v; want %d", price, ok, item.Price)
+	}
+
+	var audits int
+	err = dbx.Get(&audits, "SELECT COUNT(*) FROM `audit_events` WHERE `item_id` = ? AND `action` = ?", item.ID, TradeBuy.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audits == 0 {
+		t.Error("no audit events for the buy")
+	}
+}
+
+func TestPostBuyCardFailure(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	item := insertTestItem(t, seller.User.ID, 1000)
+	paymentService.(*FakePaymentService).SetCardFailure("BBBBBBBB", true)
+	token := issueTestPaymentToken(t, "BBBBBBBB")
+
+	w := buyer.do(postBuy, http.MethodPost, "/buy", reqBuy{CSRFToken: buyer.CSRFToken, ItemID: item.ID, Token: token})
+	decodeTestResponse(t, w, http.StatusBadRequest, nil)
+
+	if got := testItemStatus(t, item.ID); got != ItemStatusOnSale {
+		t.Errorf("item is %s, want %s", got, ItemStatusOnSale)
+	}
+	var n int
+	dbx.Get(&n, "SELECT COUNT(*) FROM `transaction_evidences` WHERE `item_id` = ?", item.ID)
+	if n != 0 {
+		t.Errorf("%d transaction evidences left behind", n)
+	}
+
+	// nothing was charged, but the reserved shipment has to be cancelled
+	p := waitTestPayment(t, item.ID, PaymentStateCompensated)
+	if p.PaymentStatus != PaymentStatusFail || p.RefundStatus != "" || !p.ShipmentCancelled {
+		t.Errorf("payment %+v", p)
+	}
+	sres, err := shipmentService.Status(&APIShipmentStatusReq{ReserveID: p.ReserveID})
+	if err != nil || sres.Status != ShippingsStatusCancel {
+		t.Errorf("shipment %s: %v, %v", p.ReserveID, sres, err)
+	}
+
+	// the item can still be bought with another card
+	w = buyer.do(postBuy, http.MethodPost, "/buy", reqBuy{CSRFToken: buyer.CSRFToken, ItemID: item.ID, Token: issueTestPaymentToken(t, "AAAAAAAA")})
+	decodeTestResponse(t, w, http.StatusOK, nil)
+}
+
+func TestPostBuyShipmentFailureRefunds(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	item := insertTestItem(t, seller.User.ID, 1000)
+	token := issueTestPaymentToken(t, "AAAAAAAA")
+
+	// the shipment service rejects a seller without an address
+	_, err := dbx.Exec("UPDATE `users` SET `address` = '' WHERE `id` = ?", seller.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := buyer.do(postBuy, http.MethodPost, "/buy", reqBuy{CSRFToken: buyer.CSRFToken, ItemID: item.ID, Token: token})
+	decodeTestResponse(t, w, http.StatusInternalServerError, nil)
+
+	if got := testItemStatus(t, item.ID); got != ItemStatusOnSale {
+		t.Errorf("item is %s, want %s", got, ItemStatusOnSale)
+	}
+	p := waitTestPayment(t, item.ID, PaymentStateCompensated)
+	if p.RefundStatus != PaymentRefundStatusOK {
+		t.Errorf("payment %+v", p)
+	}
+	if price, ok := paymentService.(*FakePaymentService).Refunded(token); !ok || price != item.Price {
+		t.Errorf("refunded %d, %v; want %d", price, ok, item.Price)
+	}
+}
+
+// slowPaymentService answers only after the payment compensator has given the
+// payment up, as happens when the payment service is slower than
+// PaymentPendingTimeout.
+type slowPaymentService struct {
+	*FakePaymentService
+	itemID int64
+}
+
+func (s *slowPaymentService) Token(param *APIPaymentServiceTokenReq) (*APIPaymentServiceTokenRes, error) {
+	_, err := dbx.Exec("UPDATE `payments` SET `state` = ? WHERE `item_id` = ? AND `state` = ?",
+		PaymentStateCompensating, s.itemID, PaymentStatePending)
+	if err != nil {
+		return nil, err
+	}
+	return s.FakePaymentService.Token(param)
+}
+
+func TestPostBuyCompensatedWhilePending(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	item := insertTestItem(t, seller.User.ID, 1000)
+	token := issueTestPaymentToken(t, "AAAAAAAA")
+	fake := paymentService.(*FakePaymentService)
+	paymentService = &slowPaymentService{FakePaymentService: fake, itemID: item.ID}
+
+	w := buyer.do(postBuy, http.MethodPost, "/buy", reqBuy{CSRFToken: buyer.CSRFToken, ItemID: item.ID, Token: token})
+	decodeTestResponse(t, w, http.StatusInternalServerError, nil)
+
+	// the buyer must not get the item when the charge is refunded
+	if got := testItemStatus(t, item.ID); got != ItemStatusOnSale {
+		t.Errorf("item is %s, want %s", got, ItemStatusOnSale)
+	}
+	p := getTestPayment(t, item.ID)
+	if p.State != PaymentStateCompensating || p.TransactionEvidenceID != 0 {
+		t.Fatalf("payment %+v", p)
+	}
+
+	compensatePayment(p.ID)
+	p = getTestPayment(t, item.ID)
+	if p.State != PaymentStateCompensated || !p.ShipmentCancelled {
+		t.Errorf("payment %+v", p)
+	}
+	if price, ok := fake.Refunded(token); !ok || price != item.Price {
+		t.Errorf("refunded %d, %v; want %d", price, ok, item.Price)
+	}
+}
+
+func TestPostRegisterIsAudited(t *testing.T) {
+	setupTestDB(t)
+	c := registerTestUser(t, "user")
+
+	ev := AuditEvent{}
+	err := dbx.Get(&ev, "SELECT * FROM `audit_events` WHERE `entity_type` = ? AND `entity_id` = ?", AuditEntityUser, c.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Action != "register" || ev.ActorID != c.User.ID || ev.StatusAfter != UserStatusActive || ev.RequestID == "" {
+		t.Errorf("audit event %+v", ev)
+	}
+}
+
+func TestPostBumpResponse(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	item := insertTestItem(t, seller.User.ID, 1000)
+
+	res := map[string]interface{}{}
+	w := seller.do(postBump, http.MethodPost, "/bump", reqBump{CSRFToken: seller.CSRFToken, ItemID: item.ID})
+	decodeTestResponse(t, w, http.StatusOK, &res)
+
+	// a bump changes none of the fields an edit returns
+	for _, key := range []string{"item_id", "item_price", "item_created_at", "item_updated_at"} {
+		if _, ok := res[key]; !ok {
+			t.Errorf("no %s in %v", key, res)
+		}
+	}
+	if len(res) != 4 {
+		t.Errorf("response %v, want 4 fields", res)
+	}
+}
+
+func TestPostShipAgainReplacesQRCode(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	te := buyTestItem(t, buyer, insertTestItem(t, seller.User.ID, 1000))
+
+	ship := func() Shipping {
+		w := seller.do(postShip, http.MethodPost, "/ship", reqPostShip{CSRFToken: seller.CSRFToken, ItemID: te.ItemID})
+		decodeTestResponse(t, w, http.StatusOK, nil)
+		return getTestShipping(t, te.ID)
+	}
+	first := ship()
+	second := ship()
+	if first.ImgKey == "" || second.ImgKey == first.ImgKey {
+		t.Fatalf("QR code keys %q and %q", first.ImgKey, second.ImgKey)
+	}
+
+	if _, err := qrCodeStore.Get(first.ImgKey); err != ErrBlobNotFound {
+		t.Errorf("replaced QR code: %v", err)
+	}
+	if _, err := qrCodeStore.Get(second.ImgKey); err != nil {
+		t.Errorf("current QR code: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PageSizeMax = 100
+
+// cursorKey signs the cursors; every instance behind the same load balancer
+// needs the same one.
+var cursorKey []byte
+
+var (
+	ErrCursorInvalid  = errors.New("cursor param error")
+	ErrCursorMismatch = errors.New("cursor does not belong to this listing")
+	ErrCursorExpired  = errors.New("cursor has expired")
+)
+
+// Cursor is the full sort key of the last row of a page. Clients get it as an
+// opaque signed token in next_cursor and hand it back unchanged.
+type Cursor struct {
+	// which listing the cursor was issued for
+	Scope string `json:"scope"`
+	Sort  string `json:"sort,omitempty"`
+	ID    int64  `json:"id"`
+	// unix seconds, all the precision the datetime columns have; rows created
+	// within the same second are told apart by ID
+	CreatedAt int64 `json:"created_at,omitempty"`
+	Price     int   `json:"price,omitempty"`
+	ViewCount int64 `json:"view_count,omitempty"`
+	// the item_view_rankings row ViewCount was read from
+	RankingID int64 `json:"ranking_id,omitempty"`
+}
+
+func (c *Cursor) Time() time.Time {
+	return time.Unix(c.CreatedAt, 0)
+}
+
+func encodeCursor(c *Cursor) string {
+	b, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signCursor(payload))
+}
+
+func decodeCursor(token string) (*Cursor, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, ErrCursorInvalid
+	}
+	payload := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, signCursor(payload)) {
+		return nil, ErrCursorInvalid
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	c := &Cursor{}
+	err = json.Unmarshal(b, c)
+	if err != nil || c.ID <= 0 {
+		return nil, ErrCursorInvalid
+	}
+	return c, nil
+}
+
+func signCursor(payload string) []byte {
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Page is the requested slice of one listing: Cursor is nil on the first
+// page.
+type Page struct {
+	Scope  string
+	Limit  int
+	Cursor *Cursor
+}
+
+// parsePage reads limit and cursor. The item_id and created_at pair older
+// clients send is taken as a cursor in created_at order.
+func parsePage(query url.Values, scope string, defaultLimit int) (*Page, error) {
+	p := &Page{
+		Scope: scope,
+		Limit: defaultLimit,
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > PageSizeMax {
+			return nil, errors.New("limit param error")
+		}
+		p.Limit = limit
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		if c.Scope != scope {
+			return nil, ErrCursorMismatch
+		}
+		p.Cursor = c
+		return p, nil
+	}
+
+	var itemID, createdAt int64
+	var err error
+	if v := query.Get("item_id"); v != "" {
+		itemID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || itemID <= 0 {
+			return nil, errors.New("item_id param error")
+		}
+	}
+	if v := query.Get("created_at"); v != "" {
+		createdAt, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || createdAt <= 0 {
+			return nil, errors.New("created_at param error")
+		}
+	}
+	if itemID > 0 && createdAt > 0 {
+		p.Cursor = &Cursor{
+			Scope:     scope,
+			Sort:      ListingSortCreated,
+			ID:        itemID,
+			CreatedAt: createdAt,
+		}
+	}
+
+	return p, nil
+}
+
+// createdKeyset is the condition for rows after the cursor in
+// `created_at` DESC, `id` DESC order.
+func (p *Page) createdKeyset(table string) (string, []interface{}) {
+	t := p.Cursor.Time()
+	return "(`" + table + "`.`created_at` < ? OR (`" + table + "`.`created_at` = ? AND `" + table + "`.`id` < ?))",
+		[]interface{}{t, t, p.Cursor.ID}
+}
+
+// NextCursor returns the token for the page after the row c describes.
+func (p *Page) NextCursor(c Cursor) string {
+	c.Scope = p.Scope
+	return encodeCursor(&c)
+}
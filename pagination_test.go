@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	cursorKey = []byte("test cursor key")
+	valid := encodeCursor(&Cursor{Scope: "new_items", Sort: ListingSortCreated, ID: 10, CreatedAt: 1565000000})
+
+	// a cursor for another item, under the signature of the valid one
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"scope":"new_items","sort":"created","id":1,"created_at":1565000000}`)) +
+		valid[strings.IndexByte(valid, '.'):]
+
+	otherKey := func() string {
+		defer func(key []byte) { cursorKey = key }(cursorKey)
+		cursorKey = []byte("another key")
+		return encodeCursor(&Cursor{Scope: "new_items", ID: 10})
+	}()
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		limit  int
+		cursor *Cursor
+		err    string
+	}{
+		{name: "defaults", query: url.Values{}, limit: ItemsPerPage},
+		{name: "limit", query: url.Values{"limit": {"5"}}, limit: 5},
+		{name: "limit at PageSizeMax", query: url.Values{"limit": {strconv.Itoa(PageSizeMax)}}, limit: PageSizeMax},
+		{name: "limit over PageSizeMax", query: url.Values{"limit": {strconv.Itoa(PageSizeMax + 1)}}, err: "limit param error"},
+		{name: "zero limit", query: url.Values{"limit": {"0"}}, err: "limit param error"},
+		{name: "negative limit", query: url.Values{"limit": {"-1"}}, err: "limit param error"},
+		{name: "non-numeric limit", query: url.Values{"limit": {"ten"}}, err: "limit param error"},
+
+		{
+			name:   "cursor",
+			query:  url.Values{"cursor": {valid}},
+			limit:  ItemsPerPage,
+			cursor: &Cursor{Scope: "new_items", Sort: ListingSortCreated, ID: 10, CreatedAt: 1565000000},
+		},
+		{
+			name:   "cursor wins over legacy parameters",
+			query:  url.Values{"cursor": {valid}, "item_id": {"99"}, "created_at": {"1"}},
+			limit:  ItemsPerPage,
+			cursor: &Cursor{Scope: "new_items", Sort: ListingSortCreated, ID: 10, CreatedAt: 1565000000},
+		},
+		{name: "tampered payload", query: url.Values{"cursor": {forged}}, err: ErrCursorInvalid.Error()},
+		{name: "tampered signature", query: url.Values{"cursor": {valid[:len(valid)-2] + "AA"}}, err: ErrCursorInvalid.Error()},
+		{name: "signed with another key", query: url.Values{"cursor": {otherKey}}, err: ErrCursorInvalid.Error()},
+		{name: "unsigned", query: url.Values{"cursor": {valid[:strings.IndexByte(valid, '.')]}}, err: ErrCursorInvalid.Error()},
+		{name: "garbage", query: url.Values{"cursor": {"!!.!!"}}, err: ErrCursorInvalid.Error()},
+		{
+			name:  "cursor of another listing",
+			query: url.Values{"cursor": {encodeCursor(&Cursor{Scope: "transactions/1", ID: 10})}},
+			err:   ErrCursorMismatch.Error(),
+		},
+		{name: "cursor without id", query: url.Values{"cursor": {encodeCursor(&Cursor{Scope: "new_items"})}}, err: ErrCursorInvalid.Error()},
+
+		{
+			name:   "legacy item_id and created_at",
+			query:  url.Values{"item_id": {"10"}, "created_at": {"1565000000"}},
+			limit:  ItemsPerPage,
+			cursor: &Cursor{Scope: "new_items", Sort: ListingSortCreated, ID: 10, CreatedAt: 1565000000},
+		},
+		{name: "legacy item_id alone", query: url.Values{"item_id": {"10"}}, limit: ItemsPerPage},
+		{name: "legacy created_at alone", query: url.Values{"created_at": {"1565000000"}}, limit: ItemsPerPage},
+		{name: "invalid legacy item_id", query: url.Values{"item_id": {"0"}, "created_at": {"1565000000"}}, err: "item_id param error"},
+		{name: "invalid legacy created_at", query: url.Values{"item_id": {"10"}, "created_at": {"yesterday"}}, err: "created_at param error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parsePage(tt.query, "new_items", ItemsPerPage)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Limit != tt.limit {
+				t.Errorf("limit %d, want %d", p.Limit, tt.limit)
+			}
+			if (p.Cursor == nil) != (tt.cursor == nil) || p.Cursor != nil && *p.Cursor != *tt.cursor {
+				t.Errorf("cursor %+v, want %+v", p.Cursor, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestNextCursorRoundTrip(t *testing.T) {
+	cursorKey = []byte("test cursor key")
+	p := &Page{Scope: "transactions/1", Limit: TransactionsPerPage}
+
+	token := p.NextCursor(Cursor{Sort: ListingSortCreated, ID: 42, CreatedAt: 1565000000})
+	next, err := parsePage(url.Values{"cursor": {token}}, "transactions/1", TransactionsPerPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Cursor.ID != 42 || next.Cursor.Time().Unix() != 1565000000 {
+		t.Errorf("cursor %+v", next.Cursor)
+	}
+
+	cond, args := next.createdKeyset("items")
+	if !strings.Contains(cond, "`items`.`created_at` < ?") || len(args) != 3 || args[2] != int64(42) {
+		t.Errorf("keyset %s %v", cond, args)
+	}
+
+	if _, err := parsePage(url.Values{"cursor": {token}}, "transactions/2", TransactionsPerPage); err != ErrCursorMismatch {
+		t.Errorf("cursor of another user: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordAlgoBcrypt   = "bcrypt"
+	PasswordAlgoArgon2id = "argon2id"
+
+	argon2idSaltLen = 16
+	argon2idKeyLen  = 32
+)
+
+var (
+	ErrPasswordMismatch    = errors.New("password mismatch")
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+)
+
+// Argon2idParams are the tunables encoded in an argon2id hash as
+// "m=<KiB>,t=<iterations>,p=<threads>".
+type Argon2idParams struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+func (p Argon2idParams) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads)
+}
+
+func parseArgon2idParams(s string) (Argon2idParams, error) {
+	p := Argon2idParams{}
+	_, err := fmt.Sscanf(s, "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, err
+	}
+	if p.Memory == 0 || p.Time == 0 || p.Threads == 0 {
+		return p, fmt.Errorf("invalid argon2id parameters: %s", s)
+	}
+	return p, nil
+}
+
+// PasswordPolicy decides how new hashes are made. Hashes made under an older
+// policy still verify and are replaced on the next successful login.
+type PasswordPolicy struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2id   Argon2idParams
+}
+
+var passwordPolicy = PasswordPolicy{
+	Algorithm:  PasswordAlgoBcrypt,
+	BcryptCost: BcryptCost,
+	Argon2id:   Argon2idParams{Memory: 64 * 1024, Time: 1, Threads: 4},
+}
+
+func (p PasswordPolicy) Validate() error {
+	switch p.Algorithm {
+	case PasswordAlgoBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordAlgoArgon2id:
+	default:
+		return fmt.Errorf("unknown password algorithm: %s", p.Algorithm)
+	}
+	return nil
+}
+
+func (p PasswordPolicy) Hash(password []byte) ([]byte, error) {
+	if p.Algorithm == PasswordAlgoArgon2id {
+		salt := make([]byte, argon2idSaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		key := argon2.IDKey(password, salt, p.Argon2id.Time, p.Argon2id.Memory, p.Argon2id.Threads, argon2idKeyLen)
+		return []byte(fmt.Sprintf("$argon2id$v=%d$%s$%s$%s",
+			argon2.Version,
+			p.Argon2id,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		)), nil
+	}
+	return bcrypt.GenerateFromPassword(password, p.BcryptCost)
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or with
+// other parameters than the policy asks for now.
+func (p PasswordPolicy) NeedsRehash(hash []byte) bool {
+	if p.Algorithm == PasswordAlgoArgon2id {
+		params, _, _, err := decodeArgon2idHash(hash)
+		return err != nil || params != p.Argon2id
+	}
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != p.BcryptCost
+}
+
+func comparePassword(hash, password []byte) error {
+	if strings.HasPrefix(string(hash), "$argon2id$") {
+		params, salt, key, err := decodeArgon2idHash(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func decodeArgon2idHash(hash []byte) (params Argon2idParams, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgoArgon2id {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	params, err = parseArgon2idParams(parts[3])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if len(key) == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	return params, salt, key, nil
+}
+
+// upgradePasswordHash replaces the hash of a user who just logged in if it
+// no longer matches the policy. The login succeeds either way.
+func upgradePasswordHash(u *User, password []byte) {
+	if !passwordPolicy.NeedsRehash(u.HashedPassword) {
+		return
+	}
+
+	hashedPassword, err := passwordPolicy.Hash(password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// a concurrent login may have upgraded it already
+	_, err = dbx.Exec("UPDATE `users` SET `hashed_password` = ? WHERE `id` = ? AND `hashed_password` = ?",
+		hashedPassword,
+		u.ID,
+		u.HashedPassword,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	u.HashedPassword = hashedPassword
+}
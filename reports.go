@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	ReportBatchSize = 1000
+	// a page may be this long; without limit the whole range is exported
+	ReportPageMax = 100000
+
+	NextCursorHeader = "X-Next-Cursor"
+
+	reportCursorScope = "admin/reports"
+)
+
+var (
+	transactionEvidenceStatuses = []string{
+		TransactionEvidenceStatusWaitShipping,
+		TransactionEvidenceStatusWaitDone,
+		TransactionEvidenceStatusDone,
+		TransactionEvidenceStatusCancel,
+	}
+
+	reportCSVHeader = []string{
+		"transaction_evidence_id", "item_id", "seller_id", "buyer_id", "status", "shipping_status", "reserve_id",
+		"item_name", "item_price", "item_category_id", "item_root_category_id", "created_at", "updated_at",
+	}
+)
+
+// ReportRow is one trade in a report.
+type ReportRow struct {
+	ID                 int64     `json:"transaction_evidence_id" db:"id"`
+	ItemID             int64     `json:"item_id" db:"item_id"`
+	SellerID           int64     `json:"seller_id" db:"seller_id"`
+	BuyerID            int64     `json:"buyer_id" db:"buyer_id"`
+	Status             string    `json:"status" db:"status"`
+	ShippingStatus     string    `json:"shipping_status" db:"shipping_status"`
+	ReserveID          string    `json:"reserve_id" db:"reserve_id"`
+	ItemName           string    `json:"item_name" db:"item_name"`
+	ItemPrice          int       `json:"item_price" db:"item_price"`
+	ItemCategoryID     int       `json:"item_category_id" db:"item_category_id"`
+	ItemRootCategoryID int       `json:"item_root_category_id" db:"item_root_category_id"`
+	CreatedAt          time.Time `json:"-" db:"created_at"`
+	UpdatedAt          time.Time `json:"-" db:"updated_at"`
+}
+
+// reportWriter encodes rows for one output format.
+type reportWriter interface {
+	WriteRow(row ReportRow) error
+	Flush() error
+}
+
+type jsonlReportWriter struct {
+	enc *json.Encoder
+}
+
+func (rw *jsonlReportWriter) WriteRow(row ReportRow) error {
+	return rw.enc.Encode(struct {
+		ReportRow
+		CreatedAt int64 `json:"created_at"`
+		UpdatedAt int64 `json:"updated_at"`
+	}{row, row.CreatedAt.Unix(), row.UpdatedAt.Unix()})
+}
+
+func (rw *jsonlReportWriter) Flush() error {
+	return nil
+}
+
+type csvReportWriter struct {
+	w *csv.Writer
+}
+
+func (rw *csvReportWriter) WriteRow(row ReportRow) error {
+	return rw.w.Write([]string{
+		strconv.FormatInt(row.ID, 10),
+		strconv.FormatInt(row.ItemID, 10),
+		strconv.FormatInt(row.SellerID, 10),
+		strconv.FormatInt(row.BuyerID, 10),
+		row.Status,
+		row.ShippingStatus,
+		row.ReserveID,
+		csvText(row.ItemName),
+		strconv.Itoa(row.ItemPrice),
+		strconv.Itoa(row.ItemCategoryID),
+		strconv.Itoa(row.ItemRootCategoryID),
+		row.CreatedAt.UTC().Format(time.RFC3339),
+		row.UpdatedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// csvText keeps user input from being run as a formula when the CSV is opened
+// in a spreadsheet, by prefixing cells that would start one with '.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (rw *csvReportWriter) Flush() error {
+	rw.w.Flush()
+	return rw.w.Error()
+}
+
+// ReportQuery is the filter of a report, parsed from the query string.
+type ReportQuery struct {
+	conds []string
+	args  []interface{}
+
+	Limit  int
+	Cursor *Cursor
+}
+
+func parseReportQuery(r *http.Request) (*ReportQuery, error) {
+	query := r.URL.Query()
+	rq := &ReportQuery{conds: []string{"1 = 1"}, args: []interface{}{}}
+
+	for _, p := range []struct {
+		param string
+		cond  string
+	}{
+		{"seller_id", "`te`.`seller_id` = ?"},
+		{"buyer_id", "`te`.`buyer_id` = ?"},
+	} {
+		v := query.Get(p.param)
+		if v == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, errors.New(p.param + " param error")
+		}
+		rq.conds = append(rq.conds, p.cond)
+		rq.args = append(rq.args, id)
+	}
+
+	for _, p := range []struct {
+		param string
+		cond  string
+	}{
+		{"since", "`te`.`created_at` >= ?"},
+		{"until", "`te`.`created_at` < ?"},
+	} {
+		v := query.Get(p.param)
+		if v == "" {
+			continue
+		}
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sec < 0 {
+			return nil, errors.New(p.param + " param error")
+		}
+		rq.conds = append(rq.conds, p.cond)
+		rq.args = append(rq.args, time.Unix(sec, 0))
+	}
+
+	if v := query.Get("status"); v != "" {
+		statuses := strings.Split(v, ",")
+		for _, status := range statuses {
+			if !containsStatus(transactionEvidenceStatuses, status) {
+				return nil, errors.New("status param error")
+			}
+		}
+		rq.conds = append(rq.conds, "`te`.`status` IN (?)")
+		rq.args = append(rq.args, statuses)
+	}
+
+	if v := query.Get("category_id"); v != "" {
+		categoryID, err := strconv.Atoi(v)
+		if err != nil || categoryID <= 0 {
+			return nil, errors.New("category_id param error")
+		}
+		tree := currentCategoryTree()
+		if _, ok := tree.Get(categoryID); !ok {
+			return nil, errors.New("category_id param error")
+		}
+		rq.conds = append(rq.conds, "`te`.`item_category_id` IN (?)")
+		rq.args = append(rq.args, tree.Descendants(categoryID))
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > ReportPageMax {
+			return nil, errors.New("limit param error")
+		}
+		rq.Limit = limit
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		if c.Scope != reportCursorScope {
+			return nil, ErrCursorMismatch
+		}
+		rq.Cursor = c
+	}
+
+	return rq, nil
+}
+
+// selectRows builds the query for up to limit rows with afterID < id <= lastID.
+// lastID 0 means no upper bound.
+func (rq *ReportQuery) selectRows(afterID, lastID int64, limit int) (string, []interface{}, error) {
+	conds := append([]string{"`te`.`id` > ?"}, rq.conds...)
+	args := append([]interface{}{afterID}, rq.args...)
+	if lastID > 0 {
+		conds = append(conds, "`te`.`id` <= ?")
+		args = append(args, lastID)
+	}
+	args = append(args, limit)
+
+	return sqlx.In("SELECT `te`.`id`, `te`.`item_id`, `te`.`seller_id`, `te`.`buyer_id`, `te`.`status`, "+
+		"IFNULL(`s`.`status`, '') AS `shipping_status`, IFNULL(`s`.`reserve_id`, '') AS `reserve_id`, "+
+		"`te`.`item_name`, `te`.`item_price`, `te`.`item_category_id`, `te`.`item_root_category_id`, `te`.`created_at`, `te`.`updated_at` "+
+		"FROM `transaction_evidences` `te` LEFT JOIN `shippings` `s` ON `s`.`transaction_evidence_id` = `te`.`id` "+
+		"WHERE "+strings.Join(conds, " AND ")+" ORDER BY `te`.`id` LIMIT ?", args...)
+}
+
+// pageEnd finds the id of the last row of a limited page, and whether any row
+// follows it. It runs before streaming, so the next cursor can go in a header.
+// The id is 0 when fewer rows than the limit are left.
+func (rq *ReportQuery) pageEnd(afterID int64) (int64, bool, error) {
+	conds := append([]string{"`te`.`id` > ?"}, rq.conds...)
+	args := append([]interface{}{afterID}, rq.args...)
+	args = append(args, rq.Limit-1)
+
+	q, qargs, err := sqlx.In("SELECT `te`.`id` FROM `transaction_evidences` `te` WHERE "+strings.Join(conds, " AND ")+" ORDER BY `te`.`id` LIMIT 2 OFFSET ?", args...)
+	if err != nil {
+		return 0, false, err
+	}
+	ids := []int64{}
+	err = dbx.Select(&ids, q, qargs...)
+	if err != nil || len(ids) == 0 {
+		return 0, false, err
+	}
+	return ids[0], len(ids) > 1, nil
+}
+
+func getReportsJSONL(w http.ResponseWriter, r *http.Request) {
+	streamReport(w, r, "application/x-ndjson;charset=utf-8", func(out io.Writer) reportWriter {
+		return &jsonlReportWriter{enc: json.NewEncoder(out)}
+	})
+}
+
+func getReportsCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Disposition", `attachment; filename="reports.csv"`)
+	streamReport(w, r, "text/csv;charset=utf-8", func(out io.Writer) reportWriter {
+		cw := csv.NewWriter(out)
+		cw.Write(reportCSVHeader)
+		return &csvReportWriter{w: cw}
+	})
+}
+
+// streamReport writes the trades matching the query in id order, fetching
+// ReportBatchSize rows at a time and flushing after each batch. With limit,
+// the cursor of the next page is sent in X-Next-Cursor. Once rows are sent the
+// status cannot change any more, so a failure midway only cuts the output
+// short and is logged.
+func streamReport(w http.ResponseWriter, r *http.Request, contentType string, newWriter func(io.Writer) reportWriter) {
+	rq, err := parseReportQuery(r)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var afterID, lastID int64
+	if rq.Cursor != nil {
+		afterID = rq.Cursor.ID
+	}
+	if rq.Limit > 0 {
+		var hasNext bool
+		lastID, hasNext, err = rq.pageEnd(afterID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		if hasNext {
+			w.Header().Set(NextCursorHeader, encodeCursor(&Cursor{Scope: reportCursorScope, ID: lastID}))
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	rw := newWriter(w)
+	flusher, _ := w.(http.Flusher)
+
+	for lastID == 0 || afterID < lastID {
+		q, args, err := rq.selectRows(afterID, lastID, ReportBatchSize)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		rows := []ReportRow{}
+		err = dbx.Select(&rows, q, args...)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		for _, row := range rows {
+			err = rw.WriteRow(row)
+			if err != nil {
+				// the client went away
+				return
+			}
+			afterID = row.ID
+		}
+		err = rw.Flush()
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if len(rows) < ReportBatchSize {
+			break
+		}
+	}
+	rw.Flush()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestCSVReportWriterEscapesFormulas(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"chair", "chair"},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1+1", "'+1+1"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"a=1", "a=1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		buf := bytes.Buffer{}
+		rw := &csvReportWriter{w: csv.NewWriter(&buf)}
+		err := rw.WriteRow(ReportRow{ItemName: tt.name, CreatedAt: time.Unix(0, 0), UpdatedAt: time.Unix(0, 0)})
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		record, err := csv.NewReader(&buf).Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := record[7]; got != tt.want {
+			t.Errorf("item_name %q written as %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// schemaStatements extend the schema from ../sql with what this app adds. They must
+// be idempotent because they run at startup and again after init.sh resets the
+// database in /initialize.
+var schemaStatements = []string{
+	"ALTER TABLE `transaction_evidences` MODIFY `status` enum('wait_shipping', 'wait_done', 'done', 'cancel') NOT NULL",
+	"ALTER TABLE `shippings` MODIFY `status` enum('initial', 'wait_pickup', 'shipping', 'done', 'cancel') NOT NULL",
+	"CREATE TABLE IF NOT EXISTS `payments` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`item_id` bigint NOT NULL," +
+		"`seller_id` bigint NOT NULL," +
+		"`buyer_id` bigint NOT NULL," +
+		"`transaction_evidence_id` bigint NOT NULL DEFAULT 0," +
+		"`token` varchar(255) NOT NULL," +
+		"`price` int unsigned NOT NULL," +
+		"`payment_status` varchar(50) NOT NULL DEFAULT ''," +
+		"`reserve_id` varchar(191) NOT NULL DEFAULT ''," +
+		"`state` enum('pending', 'captured', 'compensating', 'compensated') NOT NULL," +
+		"`refund_status` varchar(50) NOT NULL DEFAULT ''," +
+		"`shipment_cancelled` tinyint(1) NOT NULL DEFAULT 0," +
+		"`attempts` int NOT NULL DEFAULT 0," +
+		"`last_error` varchar(1024) NOT NULL DEFAULT ''," +
+		"`next_attempt_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
+		"INDEX idx_state_next_attempt_at (`state`, `next_attempt_at`)," +
+		"INDEX idx_transaction_evidence_id (`transaction_evidence_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `idempotency_keys` (" +
+		"`user_id` bigint NOT NULL," +
+		"`idempotency_key` varchar(191) NOT NULL," +
+		"`method` varchar(16) NOT NULL," +
+		"`path` varchar(191) NOT NULL," +
+		"`fingerprint` char(64) NOT NULL," +
+		"`state` enum('processing', 'completed') NOT NULL," +
+		"`status_code` int NOT NULL DEFAULT 0," +
+		"`content_type` varchar(191) NOT NULL DEFAULT ''," +
+		"`response_body` mediumblob," +
+		"`expires_at` datetime NOT NULL," +
+		"`created_at` datetime NOT NULL," +
+		"PRIMARY KEY (`user_id`, `idempotency_key`)," +
+		"INDEX idx_expires_at (`expires_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `trade_cancellations` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`transaction_evidence_id` bigint NOT NULL," +
+		"`item_id` bigint NOT NULL," +
+		"`requested_by` bigint NOT NULL," +
+		"`requested_role` enum('seller', 'buyer', 'system') NOT NULL," +
+		"`reason` varchar(255) NOT NULL DEFAULT ''," +
+		"`relist` tinyint(1) NOT NULL DEFAULT 0," +
+		"`status` enum('requested', 'accepted', 'rejected') NOT NULL," +
+		"`responded_by` bigint NOT NULL DEFAULT 0," +
+		"`relisted_item_id` bigint NOT NULL DEFAULT 0," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
+		"INDEX idx_transaction_evidence_id_status (`transaction_evidence_id`, `status`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `trade_auto_actions` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`transaction_evidence_id` bigint NOT NULL," +
+		"`item_id` bigint NOT NULL," +
+		"`action` enum('cancel', 'complete') NOT NULL," +
+		"`reason` varchar(255) NOT NULL," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX idx_transaction_evidence_id (`transaction_evidence_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `sessions` (" +
+		"`id` varchar(64) NOT NULL PRIMARY KEY," +
+		"`user_id` bigint NOT NULL DEFAULT 0," +
+		"`data` blob NOT NULL," +
+		"`user_agent` varchar(255) NOT NULL DEFAULT ''," +
+		"`remote_addr` varchar(64) NOT NULL DEFAULT ''," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`expires_at` datetime NOT NULL," +
+		"INDEX idx_user_id (`user_id`)," +
+		"INDEX idx_expires_at (`expires_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `login_failures` (" +
+		"`scope` enum('account', 'ip') NOT NULL," +
+		"`key` varchar(191) NOT NULL," +
+		"`failures` int unsigned NOT NULL DEFAULT 0," +
+		"`locked_until` datetime NULL," +
+		"`updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`scope`, `key`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `item_views` (" +
+		"`item_id` bigint NOT NULL PRIMARY KEY," +
+		"`views` bigint unsigned NOT NULL DEFAULT 0," +
+		"INDEX idx_views (`views`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `item_view_rankings` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`created_at` datetime NOT NULL," +
+		"INDEX idx_created_at (`created_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `item_view_ranks` (" +
+		"`ranking_id` bigint NOT NULL," +
+		"`item_id` bigint NOT NULL," +
+		"`views` bigint unsigned NOT NULL," +
+		"PRIMARY KEY (`ranking_id`, `item_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `cache_invalidations` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`kind` varchar(32) NOT NULL," +
+		"`key_id` bigint NOT NULL," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX idx_created_at (`created_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `item_images` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`item_id` bigint NOT NULL," +
+		"`position` int unsigned NOT NULL," +
+		"`image_name` varchar(191) NOT NULL," +
+		"`thumbnail_name` varchar(191) NOT NULL," +
+		"`width` int unsigned NOT NULL," +
+		"`height` int unsigned NOT NULL," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY uniq_item_position (`item_id`, `position`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `blobs` (" +
+		"`key` varchar(191) NOT NULL PRIMARY KEY," +
+		"`ref_count` int NOT NULL DEFAULT 0," +
+		"`size` bigint NOT NULL," +
+		"`content_type` varchar(64) NOT NULL," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"`updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP," +
+		"INDEX idx_ref_count_updated_at (`ref_count`, `updated_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `item_edit_histories` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`item_id` bigint NOT NULL," +
+		"`user_id` bigint NOT NULL," +
+		"`changes` text NOT NULL," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX idx_item_id (`item_id`, `id`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	// append only; nothing updates or deletes these rows
+	"CREATE TABLE IF NOT EXISTS `audit_events` (" +
+		"`id` bigint NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`request_id` varchar(191) NOT NULL DEFAULT ''," +
+		"`actor_id` bigint NOT NULL DEFAULT 0," +
+		"`actor_role` varchar(32) NOT NULL DEFAULT ''," +
+		"`action` varchar(64) NOT NULL," +
+		"`entity_type` varchar(32) NOT NULL," +
+		"`entity_id` bigint NOT NULL DEFAULT 0," +
+		"`item_id` bigint NOT NULL DEFAULT 0," +
+		"`user_id` bigint NOT NULL DEFAULT 0," +
+		"`status_before` varchar(191) NOT NULL DEFAULT ''," +
+		"`status_after` varchar(191) NOT NULL DEFAULT ''," +
+		"`detail` text NOT NULL," +
+		"`created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"INDEX idx_item_id (`item_id`, `id`)," +
+		"INDEX idx_actor_id (`actor_id`, `id`)," +
+		"INDEX idx_user_id (`user_id`, `id`)," +
+		"INDEX idx_request_id (`request_id`)," +
+		"INDEX idx_created_at (`created_at`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	// rollups of transaction_evidences per seller for /users/me/stats.json
+	"CREATE TABLE IF NOT EXISTS `seller_stats` (" +
+		"`seller_id` bigint NOT NULL PRIMARY KEY," +
+		"`wait_shipping_count` int unsigned NOT NULL DEFAULT 0," +
+		"`wait_done_count` int unsigned NOT NULL DEFAULT 0," +
+		"`done_count` int unsigned NOT NULL DEFAULT 0," +
+		"`cancel_count` int unsigned NOT NULL DEFAULT 0," +
+		"`ship_count` int unsigned NOT NULL DEFAULT 0," +
+		"`ship_seconds` bigint NOT NULL DEFAULT 0," +
+		"`complete_count` int unsigned NOT NULL DEFAULT 0," +
+		"`complete_seconds` bigint NOT NULL DEFAULT 0," +
+		"`updated_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `seller_daily_sales` (" +
+		"`seller_id` bigint NOT NULL," +
+		"`day` date NOT NULL," +
+		"`items_sold` int unsigned NOT NULL DEFAULT 0," +
+		"`revenue` bigint NOT NULL DEFAULT 0," +
+		"PRIMARY KEY (`seller_id`, `day`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+	"CREATE TABLE IF NOT EXISTS `seller_category_sales` (" +
+		"`seller_id` bigint NOT NULL," +
+		"`root_category_id` int unsigned NOT NULL," +
+		"`items_sold` int unsigned NOT NULL DEFAULT 0," +
+		"`revenue` bigint NOT NULL DEFAULT 0," +
+		"PRIMARY KEY (`seller_id`, `root_category_id`)" +
+		") ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4",
+}
+
+// schemaColumns are columns this app adds to the tables from ../sql. MySQL has
+// no ADD COLUMN IF NOT EXISTS, so ensureSchema checks information_schema first.
+var schemaColumns = []struct {
+	Table      string
+	Column     string
+	Definition string
+}{
+	{"items", "thumbnail_name", "varchar(191) NOT NULL DEFAULT ''"},
+	{"shippings", "img_key", "varchar(191) NOT NULL DEFAULT ''"},
+	{"users", "role", "enum('user','moderator','admin') NOT NULL DEFAULT 'user'"},
+	{"users", "banned_at", "datetime NULL"},
+	{"users", "ban_reason", "varchar(255) NOT NULL DEFAULT ''"},
+	{"items", "stop_reason", "varchar(255) NOT NULL DEFAULT ''"},
+	{"transaction_evidences", "shipped_at", "datetime NULL"},
+}
+
+func ensureSchema(db *sqlx.DB) error {
+	for _, stmt := range schemaStatements {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range schemaColumns {
+		var n int
+		err := db.Get(&n, "SELECT COUNT(*) FROM `information_schema`.`columns` WHERE `table_schema` = DATABASE() AND `table_name` = ? AND `column_name` = ?", c.Table, c.Column)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE `" + c.Table + "` ADD COLUMN `" + c.Column + "` " + c.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
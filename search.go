@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const SearchQueryMaxLength = 100
+
+// statuses listed by /search.json when no status filter is given, the same as
+// /new_items.json
+var searchDefaultStatuses = []string{ItemStatusOnSale, ItemStatusSoldOut}
+
+var searchableStatuses = []string{ItemStatusOnSale, ItemStatusTrading, ItemStatusSoldOut}
+
+type searchDoc struct {
+	ID         int64
+	Status     string
+	Price      int
+	CategoryID int
+	CreatedAt  time.Time
+	// normalized name and description, to drop bigram false positives
+	text  string
+	grams []string
+}
+
+// SearchIndex is an in-process inverted index over the name and description
+// of every item. Text is cut into unigrams and bigrams, so Japanese needs no
+// word segmentation; queries look up bigrams and single characters only when
+// a term is one character long.
+type SearchIndex struct {
+	mu       sync.RWMutex
+	docs     map[int64]*searchDoc
+	postings map[string]map[int64]struct{}
+}
+
+var searchIndex = NewSearchIndex()
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		docs:     map[int64]*searchDoc{},
+		postings: map[string]map[int64]struct{}{},
+	}
+}
+
+// Rebuild replaces the whole index with what is in the DB.
+func (s *SearchIndex) Rebuild(q sqlx.Queryer) error {
+	items := []Item{}
+	err := sqlx.Select(q, &items, "SELECT `id`, `seller_id`, `buyer_id`, `status`, `name`, `price`, `description`, `image_name`, `category_id`, `created_at`, `updated_at` FROM `items`")
+	if err != nil {
+		return err
+	}
+
+	docs := make(map[int64]*searchDoc, len(items))
+	postings := map[string]map[int64]struct{}{}
+	for _, item := range items {
+		doc := newSearchDoc(item)
+		docs[doc.ID] = doc
+		addPostings(postings, doc)
+	}
+
+	s.mu.Lock()
+	s.docs = docs
+	s.postings = postings
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Put indexes the item as it is now. Call it after the change is committed.
+func (s *SearchIndex) Put(item Item) {
+	doc := newSearchDoc(item)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(doc.ID)
+	s.docs[doc.ID] = doc
+	addPostings(s.postings, doc)
+}
+
+// Refresh reloads the items from the DB, for callers that do not have the
+// rows at hand.
+func (s *SearchIndex) Refresh(q sqlx.Queryer, itemIDs ...int64) {
+	for _, itemID := range itemIDs {
+		item := Item{}
+		err := sqlx.Get(q, &item, "SELECT `id`, `seller_id`, `buyer_id`, `status`, `name`, `price`, `description`, `image_name`, `category_id`, `created_at`, `updated_at` FROM `items` WHERE `id` = ?", itemID)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		s.Put(item)
+	}
+}
+
+func (s *SearchIndex) remove(itemID int64) {
+	old, ok := s.docs[itemID]
+	if !ok {
+		return
+	}
+	for _, g := range old.grams {
+		delete(s.postings[g], itemID)
+		if len(s.postings[g]) == 0 {
+			delete(s.postings, g)
+		}
+	}
+	delete(s.docs, itemID)
+}
+
+type SearchQuery struct {
+	Keyword    string
+	CategoryID int
+	PriceMin   int
+	PriceMax   int
+	Statuses   []string
+
+	// newest first like the other listings
+	After *Cursor
+	Limit int
+}
+
+// Search returns the IDs of matching items ordered by created_at and id, both
+// descending.
+func (s *SearchIndex) Search(sq SearchQuery) []int64 {
+	terms := searchTerms(sq.Keyword)
+	if len(terms) == 0 {
+		return []int64{}
+	}
+	grams := []string{}
+	for _, t := range terms {
+		grams = append(grams, ngrams(t)...)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// walk the shortest posting list and probe the others
+	var shortest map[int64]struct{}
+	for _, g := range grams {
+		p := s.postings[g]
+		if len(p) == 0 {
+			return []int64{}
+		}
+		if shortest == nil || len(p) < len(shortest) {
+			shortest = p
+		}
+	}
+
+	matched := []*searchDoc{}
+	for id := range shortest {
+		doc := s.docs[id]
+		if !doc.matches(sq, terms) {
+			continue
+		}
+		ok := true
+		for _, g := range grams {
+			if _, found := s.postings[g][id]; !found {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, doc)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		}
+		return matched[i].ID > matched[j].ID
+	})
+
+	ids := []int64{}
+	for _, doc := range matched {
+		if len(ids) >= sq.Limit {
+			break
+		}
+		ids = append(ids, doc.ID)
+	}
+	return ids
+}
+
+func (doc *searchDoc) matches(sq SearchQuery, terms []string) bool {
+	if !containsStatus(sq.Statuses, doc.Status) {
+		return false
+	}
+	if sq.PriceMin > 0 && doc.Price < sq.PriceMin {
+		return false
+	}
+	if sq.PriceMax > 0 && doc.Price > sq.PriceMax {
+		return false
+	}
+	if sq.CategoryID > 0 && !currentCategoryTree().IsUnder(doc.CategoryID, sq.CategoryID) {
+		return false
+	}
+	if sq.After != nil {
+		t := sq.After.Time()
+		if doc.CreatedAt.After(t) || (doc.CreatedAt.Equal(t) && doc.ID >= sq.After.ID) {
+			return false
+		}
+	}
+	for _, t := range terms {
+		if !strings.Contains(doc.text, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func newSearchDoc(item Item) *searchDoc {
+	doc := &searchDoc{
+		ID:         item.ID,
+		Status:     item.Status,
+		Price:      item.Price,
+		CategoryID: item.CategoryID,
+		CreatedAt:  item.CreatedAt,
+	}
+
+	terms := searchTerms(item.Name + " " + item.Description)
+	doc.text = strings.Join(terms, " ")
+
+	seen := map[string]bool{}
+	for _, t := range terms {
+		for _, g := range append(unigrams(t), ngrams(t)...) {
+			if !seen[g] {
+				seen[g] = true
+				doc.grams = append(doc.grams, g)
+			}
+		}
+	}
+	return doc
+}
+
+func addPostings(postings map[string]map[int64]struct{}, doc *searchDoc) {
+	for _, g := range doc.grams {
+		p, ok := postings[g]
+		if !ok {
+			p = map[int64]struct{}{}
+			postings[g] = p
+		}
+		p[doc.ID] = struct{}{}
+	}
+}
+
+// searchTerms normalizes text and splits it at spaces and punctuation.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(normalizeSearchText(text), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+}
+
+// normalizeSearchText folds case and full-width ASCII, so that "ＰＣ" finds
+// "pc".
+func normalizeSearchText(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '！' && r <= '～':
+			r -= '！' - '!'
+		case r == '　':
+			r = ' '
+		}
+		return unicode.ToLower(r)
+	}, text)
+}
+
+func unigrams(term string) []string {
+	grams := []string{}
+	for _, r := range term {
+		grams = append(grams, string(r))
+	}
+	return grams
+}
+
+// ngrams returns the bigrams of term, or term itself if it is one character.
+func ngrams(term string) []string {
+	rs := []rune(term)
+	if len(rs) == 1 {
+		return []string{term}
+	}
+	grams := make([]string, 0, len(rs)-1)
+	for i := 0; i+1 < len(rs); i++ {
+		grams = append(grams, string(rs[i:i+2]))
+	}
+	return grams
+}
+
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	keyword := strings.TrimSpace(query.Get("q"))
+	if keyword == "" {
+		outputErrorMsg(w, http.StatusBadRequest, "q param is required")
+		return
+	}
+	if len([]rune(keyword)) > SearchQueryMaxLength {
+		outputErrorMsg(w, http.StatusBadRequest, "q param is too long")
+		return
+	}
+
+	page, err := parsePage(query, "search", ItemsPerPage)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sq := SearchQuery{
+		Keyword:  keyword,
+		Statuses: searchDefaultStatuses,
+		After:    page.Cursor,
+		Limit:    page.Limit + 1,
+	}
+
+	if v := query.Get("category_id"); v != "" {
+		sq.CategoryID, err = strconv.Atoi(v)
+		if err != nil || sq.CategoryID <= 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "category_id param error")
+			return
+		}
+	}
+	if v := query.Get("price_min"); v != "" {
+		sq.PriceMin, err = strconv.Atoi(v)
+		if err != nil || sq.PriceMin < 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "price_min param error")
+			return
+		}
+	}
+	if v := query.Get("price_max"); v != "" {
+		sq.PriceMax, err = strconv.Atoi(v)
+		if err != nil || sq.PriceMax < 0 {
+			outputErrorMsg(w, http.StatusBadRequest, "price_max param error")
+			return
+		}
+	}
+	if sq.PriceMax > 0 && sq.PriceMin > sq.PriceMax {
+		outputErrorMsg(w, http.StatusBadRequest, "price_min must not exceed price_max")
+		return
+	}
+	if v := query.Get("status"); v != "" {
+		sq.Statuses = strings.Split(v, ",")
+		for _, status := range sq.Statuses {
+			if !containsStatus(searchableStatuses, status) {
+				outputErrorMsg(w, http.StatusBadRequest, "status param error")
+				return
+			}
+		}
+	}
+	ld := requestLoader(r)
+
+	items := []Item{}
+	ids := searchIndex.Search(sq)
+	if len(ids) > 0 {
+		inQuery, inArgs, err := sqlx.In("SELECT * FROM `items` WHERE `id` IN (?) ORDER BY `created_at` DESC, `id` DESC", ids)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		err = sqlx.Select(ld.DB(), &items, inQuery, inArgs...)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+
+	sellerIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		sellerIDs = append(sellerIDs, item.SellerID)
+	}
+	err = ld.LoadUsers(sellerIDs...)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	itemSimples := []ItemSimple{}
+	for _, item := range items {
+		seller, ok := ld.User(item.SellerID)
+		if !ok {
+			outputErrorMsg(w, http.StatusNotFound, "seller not found")
+			return
+		}
+		category, err := ld.Category(item.CategoryID)
+		if err != nil {
+			outputErrorMsg(w, http.StatusNotFound, "category not found")
+			return
+		}
+		itemSimples = append(itemSimples, ItemSimple{
+			ID:           item.ID,
+			SellerID:     item.SellerID,
+			Seller:       seller,
+			Status:       item.Status,
+			Name:         item.Name,
+			Price:        item.Price,
+			ImageURL:     getImageURL(item.ImageName),
+			ThumbnailURL: getThumbnailURL(item),
+			CategoryID:   item.CategoryID,
+			Category:     &category,
+			CreatedAt:    item.CreatedAt.Unix(),
+		})
+	}
+
+	hasNext := false
+	nextCursor := ""
+	if len(itemSimples) > page.Limit {
+		hasNext = true
+		itemSimples = itemSimples[0:page.Limit]
+		last := items[page.Limit-1]
+		nextCursor = page.NextCursor(Cursor{
+			Sort:      ListingSortCreated,
+			ID:        last.ID,
+			CreatedAt: last.CreatedAt.Unix(),
+		})
+	}
+
+	rni := resNewItems{
+		Items:      itemSimples,
+		HasNext:    hasNext,
+		NextCursor: nextCursor,
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(rni)
+}
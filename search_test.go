@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSearchText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"iPhone", "iphone"},
+		{"ＰＣ", "pc"},
+		{"ｉＰｈｏｎｅ１２", "iphone12"},
+		{"Ａ　Ｂ", "a b"},
+		{"（中古）", "(中古)"},
+		{"カメラ", "カメラ"},
+		{"ｶﾒﾗ", "ｶﾒﾗ"},
+	}
+	for _, tt := range tests {
+		if got := normalizeSearchText(tt.text); got != tt.want {
+			t.Errorf("normalizeSearchText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"  ", []string{}},
+		{"ＰＣ　ケース", []string{"pc", "ケース"}},
+		{"pc,case! (new)", []string{"pc", "case", "new"}},
+		{"【美品】カメラ", []string{"美品", "カメラ"}},
+		{"a+b", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		got := searchTerms(tt.text)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestNgrams(t *testing.T) {
+	tests := []struct {
+		term string
+		want []string
+	}{
+		{"a", []string{"a"}},
+		{"犬", []string{"犬"}},
+		{"pc", []string{"pc"}},
+		{"カメラ", []string{"カメ", "メラ"}},
+		{"case", []string{"ca", "as", "se"}},
+	}
+	for _, tt := range tests {
+		if got := ngrams(tt.term); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ngrams(%q) = %q, want %q", tt.term, got, tt.want)
+		}
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	base := time.Date(2019, 8, 1, 0, 0, 0, 0, time.Local)
+	item := func(id int64, status, name, description string) Item {
+		return Item{
+			ID:          id,
+			Status:      status,
+			Name:        name,
+			Description: description,
+			Price:       int(id) * 100,
+			CreatedAt:   base.Add(time.Duration(id) * time.Minute),
+		}
+	}
+
+	// listed in the same second as item 2
+	tied := item(7, ItemStatusOnSale, "カメラ", "同時刻")
+	tied.CreatedAt = base.Add(2 * time.Minute)
+
+	s := NewSearchIndex()
+	for _, it := range []Item{
+		item(1, ItemStatusOnSale, "デジタルカメラ", "レンズ付き"),
+		item(2, ItemStatusOnSale, "カメラ", "本体のみ"),
+		item(3, ItemStatusOnSale, "ノートPC", "犬のステッカー付き"),
+		item(4, ItemStatusSoldOut, "pc case", "new"),
+		// has カメ and メラ, but not カメラ
+		item(5, ItemStatusOnSale, "カメ", "メラ"),
+		item(6, ItemStatusTrading, "カメラ レンズ", "trading"),
+		tied,
+	} {
+		s.Put(it)
+	}
+
+	statuses := []string{ItemStatusOnSale, ItemStatusSoldOut}
+	tests := []struct {
+		name string
+		sq   SearchQuery
+		want []int64
+	}{
+		{"newest first", SearchQuery{Keyword: "カメラ"}, []int64{7, 2, 1}},
+		{"bigrams of another word", SearchQuery{Keyword: "カメ"}, []int64{5, 7, 2, 1}},
+		{"one character", SearchQuery{Keyword: "犬"}, []int64{3}},
+		{"one latin character", SearchQuery{Keyword: "c"}, []int64{4, 3}},
+		{"full-width query", SearchQuery{Keyword: "ＰＣ"}, []int64{4, 3}},
+		{"every term must match", SearchQuery{Keyword: "カメラ　レンズ"}, []int64{1}},
+		{"term matching nothing", SearchQuery{Keyword: "カメラ 三脚"}, []int64{}},
+		{"punctuation only", SearchQuery{Keyword: "!!"}, []int64{}},
+		{"status", SearchQuery{Keyword: "レンズ", Statuses: []string{ItemStatusTrading}}, []int64{6}},
+		{"price", SearchQuery{Keyword: "カメラ", PriceMin: 150, PriceMax: 250}, []int64{2}},
+		{"limit", SearchQuery{Keyword: "カメ", Limit: 2}, []int64{5, 7}},
+		{
+			"after cursor",
+			SearchQuery{Keyword: "カメ", After: &Cursor{ID: 5, CreatedAt: base.Add(5 * time.Minute).Unix()}},
+			[]int64{7, 2, 1},
+		},
+		{
+			"after cursor in the same second",
+			SearchQuery{Keyword: "カメ", After: &Cursor{ID: 7, CreatedAt: base.Add(2 * time.Minute).Unix()}},
+			[]int64{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sq.Statuses == nil {
+				tt.sq.Statuses = statuses
+			}
+			if tt.sq.Limit == 0 {
+				tt.sq.Limit = 10
+			}
+			if got := s.Search(tt.sq); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.sq.Keyword, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchIndexPutReplaces(t *testing.T) {
+	s := NewSearchIndex()
+	it := Item{ID: 1, Status: ItemStatusOnSale, Name: "カメラ", Description: "本体"}
+	s.Put(it)
+
+	it.Name = "レンズ"
+	s.Put(it)
+
+	search := func(keyword string) []int64 {
+		return s.Search(SearchQuery{Keyword: keyword, Statuses: []string{ItemStatusOnSale}, Limit: 10})
+	}
+	if got := search("カメラ"); len(got) != 0 {
+		t.Errorf("old name still matches: %v", got)
+	}
+	if got := search("レンズ"); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("new name: %v", got)
+	}
+	if got := search("本体"); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("description: %v", got)
+	}
+	// the grams of the old name are gone rather than left pointing at it
+	if _, ok := s.postings["カメ"]; ok {
+		t.Errorf("posting list of カメ left behind: %v", s.postings["カメ"])
+	}
+	if len(s.docs) != 1 {
+		t.Errorf("%d docs, want 1", len(s.docs))
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+const (
+	SessionMaxAge          = 86400 * 30
+	SessionCleanupInterval = 10 * time.Minute
+	SessionIDBytes         = 32
+)
+
+// SessionRecord is what the server keeps for a session. The cookie only
+// carries the signed and encrypted ID.
+type SessionRecord struct {
+	ID         string    `db:"id"`
+	UserID     int64     `db:"user_id"`
+	Data       []byte    `db:"data"`
+	UserAgent  string    `db:"user_agent"`
+	RemoteAddr string    `db:"remote_addr"`
+	CreatedAt  time.Time `db:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+// PublicID identifies the session in the API without revealing the ID that
+// authenticates it.
+func (rec *SessionRecord) PublicID() string {
+	sum := sha256.Sum256([]byte(rec.ID))
+	return hex.EncodeToString(sum[:16])
+}
+
+type SessionBackend interface {
+	// Load returns nil without an error for unknown or expired sessions.
+	Load(id string) (*SessionRecord, error)
+	Save(rec *SessionRecord) error
+	Delete(id string) error
+	ListByUser(userID int64) ([]*SessionRecord, error)
+	DeleteByUser(userID int64) error
+	DeleteExpired(now time.Time) error
+}
+
+type mysqlSessionBackend struct {
+	db *sqlx.DB
+}
+
+func NewMySQLSessionBackend(db *sqlx.DB) SessionBackend {
+	return &mysqlSessionBackend{db: db}
+}
+
+func (b *mysqlSessionBackend) Load(id string) (*SessionRecord, error) {
+	rec := &SessionRecord{}
+	err := b.db.Get(rec, "SELECT * FROM `sessions` WHERE `id` = ? AND `expires_at` > ?", id, time.Now())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (b *mysqlSessionBackend) Save(rec *SessionRecord) error {
+	_, err := b.db.Exec("INSERT INTO `sessions` (`id`, `user_id`, `data`, `user_agent`, `remote_addr`, `created_at`, `updated_at`, `expires_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE `user_id` = VALUES(`user_id`), `data` = VALUES(`data`), `user_agent` = VALUES(`user_agent`), `remote_addr` = VALUES(`remote_addr`), `updated_at` = VALUES(`updated_at`), `expires_at` = VALUES(`expires_at`)",
+		rec.ID,
+		rec.UserID,
+		rec.Data,
+		rec.UserAgent,
+		rec.RemoteAddr,
+		rec.CreatedAt,
+		rec.UpdatedAt,
+		rec.ExpiresAt,
+	)
+	return err
+}
+
+func (b *mysqlSessionBackend) Delete(id string) error {
+	_, err := b.db.Exec("DELETE FROM `sessions` WHERE `id` = ?", id)
+	return err
+}
+
+func (b *mysqlSessionBackend) ListByUser(userID int64) ([]*SessionRecord, error) {
+	recs := []*SessionRecord{}
+	err := b.db.Select(&recs, "SELECT * FROM `sessions` WHERE `user_id` = ? AND `expires_at` > ? ORDER BY `updated_at` DESC", userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func (b *mysqlSessionBackend) DeleteByUser(userID int64) error {
+	_, err := b.db.Exec("DELETE FROM `sessions` WHERE `user_id` = ?", userID)
+	return err
+}
+
+func (b *mysqlSessionBackend) DeleteExpired(now time.Time) error {
+	_, err := b.db.Exec("DELETE FROM `sessions` WHERE `expires_at` <= ?", now)
+	return err
+}
+
+type memorySessionBackend struct {
+	sync.Mutex
+	records map[string]SessionRecord
+}
+
+// NewMemorySessionBackend keeps sessions in process, for tests and single
+// instance setups without MySQL.
+func NewMemorySessionBackend() SessionBackend {
+	return &memorySessionBackend{records: map[string]SessionRecord{}}
+}
+
+func (b *memorySessionBackend) Load(id string) (*SessionRecord, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	rec, ok := b.records[id]
+	if !ok || !rec.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (b *memorySessionBackend) Save(rec *SessionRecord) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if old, ok := b.records[rec.ID]; ok {
+		rec.CreatedAt = old.CreatedAt
+	}
+	b.records[rec.ID] = *rec
+	return nil
+}
+
+func (b *memorySessionBackend) Delete(id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.records, id)
+	return nil
+}
+
+func (b *memorySessionBackend) ListByUser(userID int64) ([]*SessionRecord, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	recs := []*SessionRecord{}
+	for _, rec := range b.records {
+		if rec.UserID == userID && rec.ExpiresAt.After(now) {
+			rec := rec
+			recs = append(recs, &rec)
+		}
+	}
+	return recs, nil
+}
+
+func (b *memorySessionBackend) DeleteByUser(userID int64) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for id, rec := range b.records {
+		if rec.UserID == userID {
+			delete(b.records, id)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) DeleteExpired(now time.Time) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for id, rec := range b.records {
+		if !rec.ExpiresAt.After(now) {
+			delete(b.records, id)
+		}
+	}
+	return nil
+}
+
+// ServerSessionStore is a sessions.Store whose cookie holds nothing but an
+// opaque session ID. The first codec signs new cookies; the rest are only used
+// to read cookies issued with rotated out keys.
+type ServerSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	Backend SessionBackend
+}
+
+func NewServerSessionStore(backend SessionBackend, keyPairs ...[]byte) *ServerSessionStore {
+	return &ServerSessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   SessionMaxAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		Backend: backend,
+	}
+}
+
+func (s *ServerSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *ServerSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	err = securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...)
+	if err != nil {
+		// forged or signed with a key we no longer have
+		return session, nil
+	}
+
+	rec, err := s.Backend.Load(id)
+	if err != nil {
+		return session, err
+	}
+	if rec == nil {
+		return session, nil
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&session.Values)
+	if err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+
+	return session, nil
+}
+
+func (s *ServerSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			err := s.Backend.Delete(session.ID)
+			if err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = secureRandomStr(SessionIDBytes)
+	}
+
+	buf := bytes.Buffer{}
+	err := gob.NewEncoder(&buf).Encode(session.Values)
+	if err != nil {
+		return err
+	}
+
+	userID, _ := session.Values["user_id"].(int64)
+	now := time.Now()
+	err = s.Backend.Save(&SessionRecord{
+		ID:         session.ID,
+		UserID:     userID,
+		Data:       buf.Bytes(),
+		UserAgent:  truncateString(r.UserAgent(), 255),
+		RemoteAddr: clientIP(r),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		ExpiresAt:  now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+// renewSession gives the session a fresh ID so that an ID known before login
+// cannot be used afterwards.
+func renewSession(session *sessions.Session) {
+	ss, ok := store.(*ServerSessionStore)
+	if !ok || session.ID == "" {
+		return
+	}
+	err := ss.Backend.Delete(session.ID)
+	if err != nil {
+		log.Print(err)
+	}
+	session.ID = ""
+}
+
+// parseSessionKeys reads key pairs in the form "hashKey[:blockKey]" separated
+// by commas, each key hex encoded. The first pair signs new cookies.
+func parseSessionKeys(v string) ([][]byte, error) {
+	keyPairs := [][]byte{}
+	for _, pair := range strings.Split(v, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		hashKey, err := hex.DecodeString(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(hashKey) < 32 {
+			return nil, errors.New("hash key must be at least 32 bytes")
+		}
+		var blockKey []byte
+		if len(parts) == 2 {
+			blockKey, err = hex.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			if l := len(blockKey); l != 16 && l != 24 && l != 32 {
+				return nil, fmt.Errorf("block key must be 16, 24 or 32 bytes: got %d", l)
+			}
+		}
+		keyPairs = append(keyPairs, hashKey, blockKey)
+	}
+	if len(keyPairs) == 0 {
+		return nil, errors.New("no session keys")
+	}
+	return keyPairs, nil
+}
+
+func runSessionCleaner(backend SessionBackend) {
+	for {
+		err := backend.DeleteExpired(time.Now())
+		if err != nil {
+			log.Print(err)
+		}
+
+		time.Sleep(SessionCleanupInterval)
+	}
+}
+
+// trustedProxies are the addresses allowed to tell the client address in
+// X-Forwarded-For or X-Real-IP, from ISUCARI_TRUSTED_PROXIES.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a comma separated list of IPs and CIDRs.
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client. A request from a trusted proxy
+// carries it in X-Forwarded-For, read from the right skipping further trusted
+// proxies, or in X-Real-IP. Headers from anyone else are ignored.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		hops := strings.Split(v, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !isTrustedProxy(hop) {
+				return hop
+			}
+		}
+		return host
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(v) != nil {
+		return v
+	}
+	return host
+}
+
+func truncateString(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+type resSession struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	RemoteAddr string `json:"remote_addr"`
+	Current    bool   `json:"current"`
+	CreatedAt  int64  `json:"created_at"`
+	UpdatedAt  int64  `json:"updated_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+type reqDeleteSession struct {
+	CSRFToken string `json:"csrf_token"`
+}
+
+func sessionBackend() (SessionBackend, bool) {
+	ss, ok := store.(*ServerSessionStore)
+	if !ok {
+		return nil, false
+	}
+	return ss.Backend, true
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	backend, ok := sessionBackend()
+	if !ok {
+		outputErrorMsg(w, http.StatusNotFound, "session listing is not supported")
+		return
+	}
+
+	recs, err := backend.ListByUser(user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	current := getSession(r).ID
+	res := []resSession{}
+	for _, rec := range recs {
+		res = append(res, resSession{
+			ID:         rec.PublicID(),
+			UserAgent:  rec.UserAgent,
+			RemoteAddr: rec.RemoteAddr,
+			Current:    rec.ID == current,
+			CreatedAt:  rec.CreatedAt.Unix(),
+			UpdatedAt:  rec.UpdatedAt.Unix(),
+			ExpiresAt:  rec.ExpiresAt.Unix(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	rds := reqDeleteSession{}
+	err := json.NewDecoder(r.Body).Decode(&rds)
+	if err != nil {
+		outputErrorMsg(w, http.StatusBadRequest, "json decode error")
+		return
+	}
+
+	if rds.CSRFToken != getCSRFToken(r) {
+		outputErrorMsg(w, http.StatusUnprocessableEntity, "csrf token error")
+		return
+	}
+
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	backend, ok := sessionBackend()
+	if !ok {
+		outputErrorMsg(w, http.StatusNotFound, "session listing is not supported")
+		return
+	}
+
+	recs, err := backend.ListByUser(user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	publicID := pat.Param(r, "session_id")
+	for _, rec := range recs {
+		if rec.PublicID() != publicID {
+			continue
+		}
+		err = backend.Delete(rec.ID)
+		if err != nil {
+			log.Print(err)
+			outputErrorMsg(w, http.StatusInternalServerError, "db error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		json.NewEncoder(w).Encode(resSession{
+			ID:         publicID,
+			UserAgent:  rec.UserAgent,
+			RemoteAddr: rec.RemoteAddr,
+			Current:    rec.ID == getSession(r).ID,
+			CreatedAt:  rec.CreatedAt.Unix(),
+			UpdatedAt:  rec.UpdatedAt.Unix(),
+			ExpiresAt:  rec.ExpiresAt.Unix(),
+		})
+		return
+	}
+
+	outputErrorMsg(w, http.StatusNotFound, "session not found")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	goji "goji.io"
+	"goji.io/pat"
+)
+
+// saveTestSession stores a session with the given values and returns its
+// cookie.
+func saveTestSession(t *testing.T, s *ServerSessionStore, values map[interface{}]interface{}) (*sessions.Session, *http.Cookie) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := s.New(r, sessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	err = s.Save(r, w, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("%d cookies set", len(cookies))
+	}
+	return session, cookies[0]
+}
+
+func loadTestSession(t *testing.T, s *ServerSessionStore, c *http.Cookie) *sessions.Session {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	session, err := s.New(r, sessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestServerSessionStoreCookie(t *testing.T) {
+	s := NewServerSessionStore(NewMemorySessionBackend(), securecookie.GenerateRandomKey(32))
+	session, c := saveTestSession(t, s, map[interface{}]interface{}{"user_id": int64(1), "csrf_token": "csrf"})
+
+	// the cookie holds only the signed ID; the values stay on the server
+	if strings.Contains(c.Value, session.ID) || strings.Contains(c.Value, "csrf") {
+		t.Errorf("cookie %q reveals the session", c.Value)
+	}
+	if !c.HttpOnly {
+		t.Error("cookie is not HttpOnly")
+	}
+
+	loaded := loadTestSession(t, s, c)
+	if loaded.IsNew || loaded.ID != session.ID || loaded.Values["user_id"] != int64(1) || loaded.Values["csrf_token"] != "csrf" {
+		t.Errorf("loaded session %s %v, new %v", loaded.ID, loaded.Values, loaded.IsNew)
+	}
+
+	tampered := *c
+	tampered.Value = c.Value[:len(c.Value)-2] + "xx"
+	if !loadTestSession(t, s, &tampered).IsNew {
+		t.Error("tampered cookie was accepted")
+	}
+
+	rec, _ := s.Backend.Load(session.ID)
+	rec.ExpiresAt = rec.CreatedAt
+	s.Backend.Save(rec)
+	if !loadTestSession(t, s, c).IsNew {
+		t.Error("expired session was loaded")
+	}
+}
+
+func TestServerSessionStoreKeyRotation(t *testing.T) {
+	backend := NewMemorySessionBackend()
+	oldKey := securecookie.GenerateRandomKey(32)
+	newKey := securecookie.GenerateRandomKey(32)
+
+	old := NewServerSessionStore(backend, oldKey)
+	session, c := saveTestSession(t, old, map[interface{}]interface{}{"user_id": int64(1)})
+
+	rotated := NewServerSessionStore(backend, newKey, nil, oldKey, nil)
+	loaded := loadTestSession(t, rotated, c)
+	if loaded.IsNew || loaded.ID != session.ID {
+		t.Fatal("cookie signed with the old key was not accepted after rotation")
+	}
+
+	// saving again signs the cookie with the new key
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	err := rotated.Save(r, w, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resigned := w.Result().Cookies()[0]
+	if loadTestSession(t, NewServerSessionStore(backend, newKey), resigned).ID != session.ID {
+		t.Error("cookie was not signed with the new key")
+	}
+
+	if !loadTestSession(t, NewServerSessionStore(backend, newKey), c).IsNew {
+		t.Error("cookie signed with a removed key was accepted")
+	}
+}
+
+func TestParseSessionKeys(t *testing.T) {
+	hashKey := strings.Repeat("ab", 32)
+	blockKey := strings.Repeat("cd", 32)
+
+	tests := []struct {
+		value string
+		keys  int
+		err   bool
+	}{
+		{value: hashKey, keys: 2},
+		{value: hashKey + ":" + blockKey, keys: 2},
+		{value: hashKey + ":" + blockKey + ", " + hashKey, keys: 4},
+		{value: "abcd", err: true},
+		{value: "zz" + hashKey[2:], err: true},
+	}
+	for _, tt := range tests {
+		keys, err := parseSessionKeys(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("parseSessionKeys(%q): %v", tt.value, err)
+			continue
+		}
+		if err == nil && len(keys) != tt.keys {
+			t.Errorf("parseSessionKeys(%q): %d keys, want %d", tt.value, len(keys), tt.keys)
+		}
+	}
+}
+
+func loginTestUser(t *testing.T, c *testClient, accountName string) {
+	t.Helper()
+
+	w := c.do(postLogin, http.MethodPost, "/login", reqLogin{AccountName: accountName, Password: testPassword})
+	decodeTestResponse(t, w, http.StatusOK, &c.User)
+	c.loadCSRFToken()
+}
+
+func TestLoginRenewsSession(t *testing.T) {
+	setupTestDB(t)
+	registerTestUser(t, "user")
+
+	// a session fixed before login, e.g. by an attacker who knows its cookie
+	ss := store.(*ServerSessionStore)
+	before, c := saveTestSession(t, ss, map[interface{}]interface{}{"csrf_token": "known"})
+	client := newTestClient(t)
+	client.cookies[c.Name] = c
+
+	loginTestUser(t, client, "user")
+
+	after := loadTestSession(t, ss, client.cookies[sessionName])
+	if after.IsNew || after.ID == before.ID {
+		t.Fatalf("session ID %s kept across login", after.ID)
+	}
+	if client.CSRFToken == "known" {
+		t.Error("CSRF token kept across login")
+	}
+	if rec, _ := ss.Backend.Load(before.ID); rec != nil {
+		t.Error("session from before login still exists")
+	}
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	setupTestDB(t)
+	laptop := registerTestUser(t, "user")
+	phone := newTestClient(t)
+	loginTestUser(t, phone, "user")
+	registerTestUser(t, "other")
+
+	sessions := []resSession{}
+	decodeTestResponse(t, laptop.do(getSessions, http.MethodGet, "/sessions", nil), http.StatusOK, &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions, want 2", len(sessions))
+	}
+	var current, other resSession
+	for _, s := range sessions {
+		if s.Current {
+			current = s
+		} else {
+			other = s
+		}
+	}
+	if current.ID == "" || other.ID == "" {
+		t.Fatalf("sessions %+v", sessions)
+	}
+	laptopSession := loadTestSession(t, store.(*ServerSessionStore), laptop.cookies[sessionName])
+	if current.ID == laptopSession.ID {
+		t.Error("the listing reveals the session ID")
+	}
+
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Delete("/sessions/:session_id"), deleteSession)
+	revoke := func(c *testClient, id string) *httptest.ResponseRecorder {
+		return c.do(mux.ServeHTTP, http.MethodDelete, "/sessions/"+id, reqDeleteSession{CSRFToken: c.CSRFToken})
+	}
+
+	// a session of another user cannot be revoked
+	stranger := registerTestUser(t, "stranger")
+	decodeTestResponse(t, revoke(stranger, other.ID), http.StatusNotFound, nil)
+
+	revoked := resSession{}
+	decodeTestResponse(t, revoke(laptop, other.ID), http.StatusOK, &revoked)
+	if revoked.ID != other.ID || revoked.Current {
+		t.Errorf("revoked %+v", revoked)
+	}
+
+	res := resSetting{}
+	decodeTestResponse(t, phone.do(getSettings, http.MethodGet, "/settings", nil), http.StatusOK, &res)
+	if res.User != nil {
+		t.Error("revoked session is still logged in")
+	}
+	decodeTestResponse(t, laptop.do(getSessions, http.MethodGet, "/sessions", nil), http.StatusOK, &sessions)
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("sessions after revoke %+v", sessions)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultShipmentSyncInterval    = 10 * time.Second
+	DefaultShipmentSyncConcurrency = 4
+
+	ShipmentSyncMinBackoff = 5 * time.Second
+	ShipmentSyncMaxBackoff = 5 * time.Minute
+)
+
+var shippingStatusOrder = map[string]int{
+	ShippingsStatusInitial:    0,
+	ShippingsStatusWaitPickup: 1,
+	ShippingsStatusShipping:   2,
+	ShippingsStatusDone:       3,
+}
+
+type shipmentSyncBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// ShipmentSyncer polls the shipment service for every shipping that has not
+// reached done yet and copies the status it reports into the DB.
+type ShipmentSyncer struct {
+	Interval    time.Duration
+	Concurrency int
+
+	mu      sync.Mutex
+	backoff map[int64]*shipmentSyncBackoff
+}
+
+func NewShipmentSyncer(interval time.Duration, concurrency int) *ShipmentSyncer {
+	return &ShipmentSyncer{
+		Interval:    interval,
+		Concurrency: concurrency,
+		backoff:     map[int64]*shipmentSyncBackoff{},
+	}
+}
+
+func (s *ShipmentSyncer) Run() {
+	for {
+		s.SyncOnce()
+		time.Sleep(s.Interval)
+	}
+}
+
+func (s *ShipmentSyncer) SyncOnce() {
+	shippings := []Shipping{}
+	err := dbx.Select(&shippings, "SELECT `transaction_evidence_id`, `item_id`, `status`, `reserve_id` FROM `shippings` WHERE `status` IN (?,?,?)",
+		ShippingsStatusInitial,
+		ShippingsStatusWaitPickup,
+		ShippingsStatusShipping,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	now := time.Now()
+	live := make(map[int64]bool, len(shippings))
+	sem := make(chan struct{}, s.Concurrency)
+	wg := sync.WaitGroup{}
+	for _, shipping := range shippings {
+		live[shipping.TransactionEvidenceID] = true
+		if !s.due(shipping.TransactionEvidenceID, now) {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(shipping Shipping) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s.syncShipping(shipping)
+		}(shipping)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	for id := range s.backoff {
+		if !live[id] {
+			delete(s.backoff, id)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *ShipmentSyncer) due(transactionEvidenceID int64, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.backoff[transactionEvidenceID]
+	return !ok || !b.next.After(now)
+}
+
+func (s *ShipmentSyncer) fail(transactionEvidenceID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.backoff[transactionEvidenceID]
+	if !ok {
+		b = &shipmentSyncBackoff{}
+		s.backoff[transactionEvidenceID] = b
+	}
+	b.failures++
+
+	d := ShipmentSyncMinBackoff
+	for i := 1; i < b.failures && d < ShipmentSyncMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > ShipmentSyncMaxBackoff {
+		d = ShipmentSyncMaxBackoff
+	}
+	b.next = time.Now().Add(d)
+}
+
+func (s *ShipmentSyncer) succeed(transactionEvidenceID int64) {
+	s.mu.Lock()
+	delete(s.backoff, transactionEvidenceID)
+	s.mu.Unlock()
+}
+
+func (s *ShipmentSyncer) syncShipping(shipping Shipping) {
+	ssr, err := shipmentService.Status(&APIShipmentStatusReq{
+		ReserveID: shipping.ReserveID,
+	})
+	if err != nil {
+		log.Printf("failed to sync shipment status of transaction_evidence %d: %v", shipping.TransactionEvidenceID, err)
+		s.fail(shipping.TransactionEvidenceID)
+		return
+	}
+	s.succeed(shipping.TransactionEvidenceID)
+
+	// wait_pickup is only reached through postShip, which also stores the QR
+	// code; moving there without it would break getQRCode
+	if ssr.Status != ShippingsStatusShipping && ssr.Status != ShippingsStatusDone {
+		return
+	}
+	if !shippingStatusAdvances(shipping.Status, ssr.Status) {
+		return
+	}
+
+	tx := dbx.MustBegin()
+
+	st, err := lockTrade(tx, shipping.ItemID)
+	if err != nil {
+		log.Print(err)
+		tx.Rollback()
+		return
+	}
+	if st.Shipping == nil || st.TransactionEvidence == nil || !shippingStatusAdvances(st.Shipping.Status, ssr.Status) {
+		tx.Rollback()
+		return
+	}
+
+	// the parcel has been handed over, which is what /ship_done confirms
+	transition := TradeShipSync
+	if st.TransactionEvidence.Status == TransactionEvidenceStatusWaitDone {
+		transition = TradeDeliverySync
+	}
+	err = transition.Check(st, TradeRoleSystem)
+	if err == nil {
+		err = transition.Apply(tx, st, ssr.Status, systemAuditActor("shipment-sync"))
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func shippingStatusAdvances(from, to string) bool {
+	f, ok := shippingStatusOrder[from]
+	if !ok {
+		return false
+	}
+	t, ok := shippingStatusOrder[to]
+	if !ok {
+		return false
+	}
+	return t > f
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	StatsDailyDays     = 31
+	StatsWeeklyWeeks   = 12
+	StatsMonthlyMonths = 12
+
+	statsDayLayout = "2006-01-02"
+)
+
+// statusCountColumns are the columns of seller_stats counting the trades of
+// a seller in each transaction_evidences status.
+var statusCountColumns = map[string]string{
+	TransactionEvidenceStatusWaitShipping: "wait_shipping_count",
+	TransactionEvidenceStatusWaitDone:     "wait_done_count",
+	TransactionEvidenceStatusDone:         "done_count",
+	TransactionEvidenceStatusCancel:       "cancel_count",
+}
+
+// SellerStats is the rollup of every trade of a seller. The seller_stats,
+// seller_daily_sales and seller_category_sales rows are updated in the
+// transaction that moves a trade, after the trade rows and before users.
+// Sales count when a trade is done, which a cancel can no longer undo.
+type SellerStats struct {
+	SellerID          int64 `db:"seller_id"`
+	WaitShippingCount int64 `db:"wait_shipping_count"`
+	WaitDoneCount     int64 `db:"wait_done_count"`
+	DoneCount         int64 `db:"done_count"`
+	CancelCount       int64 `db:"cancel_count"`
+	// buy to ship, over the trades that have been shipped
+	ShipCount   int64 `db:"ship_count"`
+	ShipSeconds int64 `db:"ship_seconds"`
+	// ship to complete, over the trades that are done
+	CompleteCount   int64     `db:"complete_count"`
+	CompleteSeconds int64     `db:"complete_seconds"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
+
+type SellerSales struct {
+	Period    string `json:"period" db:"period"`
+	ItemsSold int64  `json:"items_sold" db:"items_sold"`
+	Revenue   int64  `json:"revenue" db:"revenue"`
+}
+
+type SellerCategorySales struct {
+	RootCategoryID   int    `json:"root_category_id" db:"root_category_id"`
+	RootCategoryName string `json:"root_category_name" db:"-"`
+	ItemsSold        int64  `json:"items_sold" db:"items_sold"`
+	Revenue          int64  `json:"revenue" db:"revenue"`
+}
+
+// countTradeStatus moves one trade of the seller from the status count of
+// from to that of to. from is empty for a new trade.
+func countTradeStatus(tx *sqlx.Tx, sellerID int64, from, to string) error {
+	_, err := tx.Exec("INSERT IGNORE INTO `seller_stats` (`seller_id`) VALUES (?)", sellerID)
+	if err != nil {
+		return err
+	}
+
+	sets := []string{}
+	if column, ok := statusCountColumns[from]; ok {
+		sets = append(sets, "`"+column+"` = GREATEST(CAST(`"+column+"` AS SIGNED) - 1, 0)")
+	}
+	if column, ok := statusCountColumns[to]; ok {
+		sets = append(sets, "`"+column+"` = `"+column+"` + 1")
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	_, err = tx.Exec("UPDATE `seller_stats` SET "+strings.Join(sets, ", ")+" WHERE `seller_id` = ?", sellerID)
+	return err
+}
+
+// updateSellerStats rolls a change of the trade status from evidenceFrom into
+// the stats of the seller. Shipping is when the trade reaches wait_done.
+func updateSellerStats(tx *sqlx.Tx, st *TradeState, evidenceFrom string, now time.Time) error {
+	te := st.TransactionEvidence
+	if te == nil || te.Status == evidenceFrom {
+		return nil
+	}
+
+	err := countTradeStatus(tx, te.SellerID, evidenceFrom, te.Status)
+	if err != nil {
+		return err
+	}
+
+	switch te.Status {
+	case TransactionEvidenceStatusWaitDone:
+		_, err = tx.Exec("UPDATE `transaction_evidences` SET `shipped_at` = ? WHERE `id` = ?", now, te.ID)
+		if err != nil {
+			return err
+		}
+		te.ShippedAt = &now
+
+		_, err = tx.Exec("UPDATE `seller_stats` SET `ship_count` = `ship_count` + 1, `ship_seconds` = `ship_seconds` + ? WHERE `seller_id` = ?",
+			int64(now.Sub(te.CreatedAt)/time.Second),
+			te.SellerID,
+		)
+		if err != nil {
+			return err
+		}
+
+	case TransactionEvidenceStatusDone:
+		// trades shipped before shipped_at was recorded have no ship time
+		if te.ShippedAt != nil {
+			_, err = tx.Exec("UPDATE `seller_stats` SET `complete_count` = `complete_count` + 1, `complete_seconds` = `complete_seconds` + ? WHERE `seller_id` = ?",
+				int64(now.Sub(*te.ShippedAt)/time.Second),
+				te.SellerID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec("INSERT INTO `seller_daily_sales` (`seller_id`, `day`, `items_sold`, `revenue`) VALUES (?, ?, 1, ?) "+
+			"ON DUPLICATE KEY UPDATE `items_sold` = `items_sold` + 1, `revenue` = `revenue` + VALUES(`revenue`)",
+			te.SellerID,
+			now.Format(statsDayLayout),
+			te.ItemPrice,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO `seller_category_sales` (`seller_id`, `root_category_id`, `items_sold`, `revenue`) VALUES (?, ?, 1, ?) "+
+			"ON DUPLICATE KEY UPDATE `items_sold` = `items_sold` + 1, `revenue` = `revenue` + VALUES(`revenue`)",
+			te.SellerID,
+			te.ItemRootCategoryID,
+			te.ItemPrice,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildSellerStats recomputes the rollups from transaction_evidences, for
+// after /initialize has replaced the trades. Done trades are dated by their
+// updated_at.
+func rebuildSellerStats(q sqlx.Execer) error {
+	for _, query := range []string{
+		"DELETE FROM `seller_stats`",
+		"DELETE FROM `seller_daily_sales`",
+		"DELETE FROM `seller_category_sales`",
+		"INSERT INTO `seller_stats` (`seller_id`, `wait_shipping_count`, `wait_done_count`, `done_count`, `cancel_count`, `ship_count`, `ship_seconds`, `complete_count`, `complete_seconds`) " +
+			"SELECT `seller_id`, " +
+			"SUM(`status` = 'wait_shipping'), SUM(`status` = 'wait_done'), SUM(`status` = 'done'), SUM(`status` = 'cancel'), " +
+			"SUM(`shipped_at` IS NOT NULL), IFNULL(SUM(TIMESTAMPDIFF(SECOND, `created_at`, `shipped_at`)), 0), " +
+			"SUM(`status` = 'done' AND `shipped_at` IS NOT NULL), IFNULL(SUM(IF(`status` = 'done', TIMESTAMPDIFF(SECOND, `shipped_at`, `updated_at`), NULL)), 0) " +
+			"FROM `transaction_evidences` GROUP BY `seller_id`",
+		"INSERT INTO `seller_daily_sales` (`seller_id`, `day`, `items_sold`, `revenue`) " +
+			"SELECT `seller_id`, DATE(`updated_at`), COUNT(*), SUM(`item_price`) FROM `transaction_evidences` WHERE `status` = 'done' GROUP BY `seller_id`, DATE(`updated_at`)",
+		"INSERT INTO `seller_category_sales` (`seller_id`, `root_category_id`, `items_sold`, `revenue`) " +
+			"SELECT `seller_id`, `item_root_category_id`, COUNT(*), SUM(`item_price`) FROM `transaction_evidences` WHERE `status` = 'done' GROUP BY `seller_id`, `item_root_category_id`",
+	} {
+		_, err := q.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type resSellerRevenue struct {
+	Daily   []SellerSales `json:"daily"`
+	Weekly  []SellerSales `json:"weekly"`
+	Monthly []SellerSales `json:"monthly"`
+}
+
+type resSellerStats struct {
+	Revenue            resSellerRevenue      `json:"revenue"`
+	Categories         []SellerCategorySales `json:"categories"`
+	AvgShipSeconds     float64               `json:"avg_ship_seconds"`
+	AvgCompleteSeconds float64               `json:"avg_complete_seconds"`
+	StatusCounts       map[string]int64      `json:"status_counts"`
+}
+
+// bucketSales adds up the daily sales from since on, newest first, into the
+// periods key returns. Periods without sales are left out.
+func bucketSales(days []SellerSales, since string, key func(time.Time) string) []SellerSales {
+	res := []SellerSales{}
+	for _, d := range days {
+		if d.Period < since {
+			break
+		}
+		t, err := time.ParseInLocation(statsDayLayout, d.Period, time.Local)
+		if err != nil {
+			continue
+		}
+		k := key(t)
+		if len(res) == 0 || res[len(res)-1].Period != k {
+			res = append(res, SellerSales{Period: k})
+		}
+		res[len(res)-1].ItemsSold += d.ItemsSold
+		res[len(res)-1].Revenue += d.Revenue
+	}
+	return res
+}
+
+// weekStart is the Monday of the week of t.
+func weekStart(t time.Time) time.Time {
+	return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+}
+
+func getSellerStats(w http.ResponseWriter, r *http.Request) {
+	user, errCode, errMsg := getUser(r)
+	if errMsg != "" {
+		outputErrorMsg(w, errCode, errMsg)
+		return
+	}
+
+	stats := SellerStats{}
+	err := dbx.Get(&stats, "SELECT * FROM `seller_stats` WHERE `seller_id` = ?", user.ID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	dailySince := today.AddDate(0, 0, -(StatsDailyDays - 1)).Format(statsDayLayout)
+	weeklySince := weekStart(today).AddDate(0, 0, -7*(StatsWeeklyWeeks-1)).Format(statsDayLayout)
+	monthlySince := time.Date(today.Year(), today.Month()-(StatsMonthlyMonths-1), 1, 0, 0, 0, 0, time.Local).Format(statsDayLayout)
+	since := dailySince
+	for _, s := range []string{weeklySince, monthlySince} {
+		if s < since {
+			since = s
+		}
+	}
+
+	days := []SellerSales{}
+	err = dbx.Select(&days, "SELECT DATE_FORMAT(`day`, '%Y-%m-%d') AS `period`, `items_sold`, `revenue` FROM `seller_daily_sales` WHERE `seller_id` = ? AND `day` >= ? ORDER BY `day` DESC",
+		user.ID,
+		since,
+	)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	categories := []SellerCategorySales{}
+	err = dbx.Select(&categories, "SELECT `root_category_id`, `items_sold`, `revenue` FROM `seller_category_sales` WHERE `seller_id` = ? ORDER BY `revenue` DESC, `root_category_id`", user.ID)
+	if err != nil {
+		log.Print(err)
+		outputErrorMsg(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	tree := currentCategoryTree()
+	for i := range categories {
+		if c, ok := tree.Get(categories[i].RootCategoryID); ok {
+			categories[i].RootCategoryName = c.CategoryName
+		}
+	}
+
+	daily := bucketSales(days, dailySince, func(t time.Time) string {
+		return t.Format(statsDayLayout)
+	})
+	weekly := bucketSales(days, weeklySince, func(t time.Time) string {
+		return weekStart(t).Format(statsDayLayout)
+	})
+	monthly := bucketSales(days, monthlySince, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	res := resSellerStats{
+		Revenue: resSellerRevenue{
+			Daily:   daily,
+			Weekly:  weekly,
+			Monthly: monthly,
+		},
+		Categories: categories,
+		StatusCounts: map[string]int64{
+			TransactionEvidenceStatusWaitShipping: stats.WaitShippingCount,
+			TransactionEvidenceStatusWaitDone:     stats.WaitDoneCount,
+			TransactionEvidenceStatusDone:         stats.DoneCount,
+			TransactionEvidenceStatusCancel:       stats.CancelCount,
+		},
+	}
+	if stats.ShipCount > 0 {
+		res.AvgShipSeconds = float64(stats.ShipSeconds) / float64(stats.ShipCount)
+	}
+	if stats.CompleteCount > 0 {
+		res.AvgCompleteSeconds = float64(stats.CompleteSeconds) / float64(stats.CompleteCount)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
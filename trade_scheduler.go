@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DefaultShipDeadline           = 72 * time.Hour
+	DefaultCompleteDeadline       = 72 * time.Hour
+	DefaultTradeSchedulerInterval = 1 * time.Minute
+
+	TradeSchedulerBatchSize = 100
+
+	TradeAutoActionCancel   = "cancel"
+	TradeAutoActionComplete = "complete"
+)
+
+type TradeAutoAction struct {
+	ID                    int64     `json:"id" db:"id"`
+	TransactionEvidenceID int64     `json:"transaction_evidence_id" db:"transaction_evidence_id"`
+	ItemID                int64     `json:"item_id" db:"item_id"`
+	Action                string    `json:"action" db:"action"`
+	Reason                string    `json:"reason" db:"reason"`
+	CreatedAt             time.Time `json:"-" db:"created_at"`
+}
+
+// TradeScheduler settles trades that one side has abandoned: it cancels
+// trades the seller never ships and completes trades the buyer never closes
+// after the shipment service reported the delivery.
+type TradeScheduler struct {
+	Interval         time.Duration
+	ShipDeadline     time.Duration
+	CompleteDeadline time.Duration
+}
+
+func (s *TradeScheduler) Run() {
+	for {
+		s.cancelUnshipped()
+		s.completeDelivered()
+		time.Sleep(s.Interval)
+	}
+}
+
+func (s *TradeScheduler) cancelUnshipped() {
+	deadline := time.Now().Add(-s.ShipDeadline)
+
+	itemIDs := []int64{}
+	err := dbx.Select(&itemIDs, "SELECT `item_id` FROM `transaction_evidences` WHERE `status` = ? AND `updated_at` < ? ORDER BY `updated_at` LIMIT ?",
+		TransactionEvidenceStatusWaitShipping,
+		deadline,
+		TradeSchedulerBatchSize,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	reason := fmt.Sprintf("seller did not ship within %s", s.ShipDeadline)
+	for _, itemID := range itemIDs {
+		tx := dbx.MustBegin()
+
+		st, err := lockTrade(tx, itemID)
+		if err != nil || st.TransactionEvidence == nil || !st.TransactionEvidence.UpdatedAt.Before(deadline) {
+			tx.Rollback()
+			continue
+		}
+
+		ct, err := cancelTrade(tx, st, TradeRoleSystem, systemAuditActor("trade-scheduler"), reason)
+		if err != nil {
+			log.Printf("failed to auto-cancel item %d: %v", itemID, err)
+			tx.Rollback()
+			continue
+		}
+
+		// nobody has to answer pending cancel requests any more
+		_, err = tx.Exec("UPDATE `trade_cancellations` SET `status` = ? WHERE `transaction_evidence_id` = ? AND `status` = ?",
+			CancellationStatusAccepted,
+			st.TransactionEvidence.ID,
+			CancellationStatusRequested,
+		)
+		if err != nil {
+			log.Print(err)
+			tx.Rollback()
+			continue
+		}
+
+		err = recordTradeAutoAction(tx, st, TradeAutoActionCancel, reason)
+		if err != nil {
+			log.Print(err)
+			tx.Rollback()
+			continue
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		ct.settle()
+		searchIndex.Put(st.Item)
+	}
+}
+
+func (s *TradeScheduler) completeDelivered() {
+	deadline := time.Now().Add(-s.CompleteDeadline)
+
+	shippings := []Shipping{}
+	err := dbx.Select(&shippings, "SELECT `shippings`.`item_id`, `shippings`.`reserve_id` FROM `shippings` JOIN `transaction_evidences` ON `transaction_evidences`.`id` = `shippings`.`transaction_evidence_id` WHERE `transaction_evidences`.`status` = ? AND `shippings`.`status` = ? AND `shippings`.`updated_at` < ? LIMIT ?",
+		TransactionEvidenceStatusWaitDone,
+		ShippingsStatusDone,
+		deadline,
+		TradeSchedulerBatchSize,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	reason := fmt.Sprintf("buyer did not complete within %s after delivery", s.CompleteDeadline)
+	for _, shipping := range shippings {
+		// ask before taking the locks; Apply refuses anything but done
+		ssr, err := shipmentService.Status(&APIShipmentStatusReq{
+			ReserveID: shipping.ReserveID,
+		})
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		tx := dbx.MustBegin()
+
+		st, err := lockTrade(tx, shipping.ItemID)
+		if err != nil {
+			tx.Rollback()
+			continue
+		}
+
+		err = TradeComplete.Check(st, TradeRoleSystem)
+		if err == nil {
+			err = TradeComplete.Apply(tx, st, ssr.Status, systemAuditActor("trade-scheduler"))
+		}
+		if err != nil {
+			log.Printf("failed to auto-complete item %d: %v", shipping.ItemID, err)
+			tx.Rollback()
+			continue
+		}
+
+		err = recordTradeAutoAction(tx, st, TradeAutoActionComplete, reason)
+		if err != nil {
+			log.Print(err)
+			tx.Rollback()
+			continue
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		searchIndex.Put(st.Item)
+	}
+}
+
+func recordTradeAutoAction(e sqlx.Execer, st *TradeState, action, reason string) error {
+	_, err := e.Exec("INSERT INTO `trade_auto_actions` (`transaction_evidence_id`, `item_id`, `action`, `reason`) VALUES (?, ?, ?, ?)",
+		st.TransactionEvidence.ID,
+		st.Item.ID,
+		action,
+		reason,
+	)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestTradeScheduler() *TradeScheduler {
+	return &TradeScheduler{
+		Interval:         time.Minute,
+		ShipDeadline:     time.Hour,
+		CompleteDeadline: time.Hour,
+	}
+}
+
+// backdateTestTrade makes the trade look untouched for d.
+func backdateTestTrade(t *testing.T, te TransactionEvidence, d time.Duration) {
+	t.Helper()
+
+	past := time.Now().Add(-d)
+	_, err := dbx.Exec("UPDATE `transaction_evidences` SET `updated_at` = ? WHERE `id` = ?", past, te.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dbx.Exec("UPDATE `shippings` SET `updated_at` = ? WHERE `transaction_evidence_id` = ?", past, te.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestTradeAutoActions(t *testing.T, te TransactionEvidence) []TradeAutoAction {
+	t.Helper()
+
+	actions := []TradeAutoAction{}
+	err := dbx.Select(&actions, "SELECT * FROM `trade_auto_actions` WHERE `transaction_evidence_id` = ?", te.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return actions
+}
+
+func testEvidenceStatus(t *testing.T, te TransactionEvidence) string {
+	t.Helper()
+
+	var status string
+	err := dbx.Get(&status, "SELECT `status` FROM `transaction_evidences` WHERE `id` = ?", te.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestTradeSchedulerCancelsUnshipped(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	late := buyTestItem(t, buyer, insertTestItem(t, seller.User.ID, 1000))
+	recent := buyTestItem(t, buyer, insertTestItem(t, seller.User.ID, 2000))
+	s := newTestTradeScheduler()
+	backdateTestTrade(t, late, s.ShipDeadline+time.Minute)
+	backdateTestTrade(t, recent, s.ShipDeadline-time.Minute)
+
+	s.cancelUnshipped()
+
+	if got := testEvidenceStatus(t, late); got != TransactionEvidenceStatusCancel {
+		t.Errorf("trade past the deadline is %s, want %s", got, TransactionEvidenceStatusCancel)
+	}
+	if got := testItemStatus(t, late.ItemID); got != ItemStatusCancel {
+		t.Errorf("item past the deadline is %s, want %s", got, ItemStatusCancel)
+	}
+	actions := getTestTradeAutoActions(t, late)
+	if len(actions) != 1 || actions[0].Action != TradeAutoActionCancel || actions[0].Reason != "seller did not ship within 1h0m0s" {
+		t.Errorf("auto actions %+v", actions)
+	}
+
+	p := waitTestPayment(t, late.ItemID, PaymentStateCompensated)
+	if price, ok := paymentService.(*FakePaymentService).Refunded(p.Token); !ok || price != p.Price {
+		t.Errorf("refunded %d, %v; want %d", price, ok, p.Price)
+	}
+	if !p.ShipmentCancelled {
+		t.Error("shipment was not cancelled")
+	}
+
+	if got := testEvidenceStatus(t, recent); got != TransactionEvidenceStatusWaitShipping {
+		t.Errorf("trade within the deadline is %s, want %s", got, TransactionEvidenceStatusWaitShipping)
+	}
+	if actions := getTestTradeAutoActions(t, recent); len(actions) != 0 {
+		t.Errorf("auto actions for the trade within the deadline %+v", actions)
+	}
+	if p := getTestPayment(t, recent.ItemID); p.State != PaymentStateCaptured {
+		t.Errorf("payment within the deadline is %s, want %s", p.State, PaymentStateCaptured)
+	}
+}
+
+// deliverTestTrade ships the trade and has the courier deliver it, which
+// leaves it for the buyer to complete.
+func deliverTestTrade(t *testing.T, seller *testClient, te TransactionEvidence) {
+	t.Helper()
+
+	w := seller.do(postShip, http.MethodPost, "/ship", reqPostShip{CSRFToken: seller.CSRFToken, ItemID: te.ItemID})
+	decodeTestResponse(t, w, http.StatusOK, nil)
+
+	fake := shipmentService.(*FakeShipmentService)
+	reserveID := getTestShipping(t, te.ID).ReserveID
+	if err := fake.Accept(reserveID); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Deliver(reserveID); err != nil {
+		t.Fatal(err)
+	}
+
+	w = seller.do(postShipDone, http.MethodPost, "/ship_done", reqPostShipDone{CSRFToken: seller.CSRFToken, ItemID: te.ItemID})
+	decodeTestResponse(t, w, http.StatusOK, nil)
+}
+
+func TestTradeSchedulerCompletesDelivered(t *testing.T) {
+	setupTestDB(t)
+	seller := registerTestUser(t, "seller")
+	buyer := registerTestUser(t, "buyer")
+	late := buyTestItem(t, buyer, insertTestItem(t, seller.User.ID, 1000))
+	recent := buyTestItem(t, buyer, insertTestItem(t, seller.User.ID, 2000))
+	deliverTestTrade(t, seller, late)
+	deliverTestTrade(t, seller, recent)
+	s := newTestTradeScheduler()
+	backdateTestTrade(t, late, s.CompleteDeadline+time.Minute)
+
+	s.completeDelivered()
+
+	if got := testEvidenceStatus(t, late); got != TransactionEvidenceStatusDone {
+		t.Errorf("trade past the deadline is %s, want %s", got, TransactionEvidenceStatusDone)
+	}
+	if got := testItemStatus(t, late.ItemID); got != ItemStatusSoldOut {
+		t.Errorf("item past the deadline is %s, want %s", got, ItemStatusSoldOut)
+	}
+	actions := getTestTradeAutoActions(t, late)
+	if len(actions) != 1 || actions[0].Action != TradeAutoActionComplete || actions[0].Reason != "buyer did not complete within 1h0m0s after delivery" {
+		t.Errorf("auto actions %+v", actions)
+	}
+
+	if got := testEvidenceStatus(t, recent); got != TransactionEvidenceStatusWaitDone {
+		t.Errorf("trade within the deadline is %s, want %s", got, TransactionEvidenceStatusWaitDone)
+	}
+	if actions := getTestTradeAutoActions(t, recent); len(actions) != 0 {
+		t.Errorf("auto actions for the trade within the deadline %+v", actions)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type TradeRole string
+
+const (
+	TradeRoleNone   TradeRole = ""
+	TradeRoleSeller TradeRole = "seller"
+	TradeRoleBuyer  TradeRole = "buyer"
+	TradeRoleSystem TradeRole = "system"
+)
+
+// TradeError is returned by the trade state machine and carries the HTTP
+// status the handlers answer with.
+type TradeError struct {
+	Status int
+	Msg    string
+}
+
+func (e *TradeError) Error() string {
+	return e.Msg
+}
+
+var (
+	ErrTradeItemNotFound     = &TradeError{http.StatusNotFound, "item not found"}
+	ErrTradeEvidenceNotFound = &TradeError{http.StatusNotFound, "transaction_evidences not found"}
+	ErrTradeShippingNotFound = &TradeError{http.StatusNotFound, "shippings not found"}
+	ErrTradeForbidden        = &TradeError{http.StatusForbidden, "権限がありません"}
+	ErrTradeOwnItem          = &TradeError{http.StatusForbidden, "自分の商品は買えません"}
+	ErrTradeItemNotForSale   = &TradeError{http.StatusForbidden, "item is not for sale"}
+	ErrTradeItemNotTrading   = &TradeError{http.StatusForbidden, "商品が取引中ではありません"}
+	ErrTradeNotReady         = &TradeError{http.StatusForbidden, "準備ができていません"}
+	ErrTradeNotShipped       = &TradeError{http.StatusForbidden, "shipment service側で配送中か配送完了になっていません"}
+	ErrTradeNotDelivered     = &TradeError{http.StatusBadRequest, "shipment service側で配送完了になっていません"}
+	ErrTradeDB               = &TradeError{http.StatusInternalServerError, "db error"}
+)
+
+// TradeTransition is one row of the status transition table in
+// docs/APPLICATION_SPEC.md. Empty From lists are not checked and empty To
+// statuses leave the table untouched.
+type TradeTransition struct {
+	Name  string
+	Roles []TradeRole
+
+	ItemFrom     []string
+	EvidenceFrom []string
+	ShippingFrom []string
+
+	ItemTo     string
+	EvidenceTo string
+	// the shipping status may depend on what the shipment service reports, so
+	// callers pick one of these; the first one is the default
+	ShippingTo []string
+	// checks the item status before the role, as /buy always has
+	ItemBeforeRole bool
+
+	RoleErr       *TradeError
+	ItemErr       *TradeError
+	EvidenceErr   *TradeError
+	ShippingErr   *TradeError
+	ShippingToErr *TradeError
+}
+
+var (
+	TradeBuy = &TradeTransition{
+		Name:           "buy",
+		Roles:          []TradeRole{TradeRoleBuyer},
+		ItemFrom:       []string{ItemStatusOnSale},
+		ItemTo:         ItemStatusTrading,
+		EvidenceTo:     TransactionEvidenceStatusWaitShipping,
+		ShippingTo:     []string{ShippingsStatusInitial},
+		ItemBeforeRole: true,
+		RoleErr:        ErrTradeOwnItem,
+		ItemErr:        ErrTradeItemNotForSale,
+	}
+	TradeShip = &TradeTransition{
+		Name:         "ship",
+		Roles:        []TradeRole{TradeRoleSeller},
+		ItemFrom:     []string{ItemStatusTrading},
+		EvidenceFrom: []string{TransactionEvidenceStatusWaitShipping},
+		ShippingFrom: []string{ShippingsStatusInitial, ShippingsStatusWaitPickup},
+		ShippingTo:   []string{ShippingsStatusWaitPickup},
+		RoleErr:      ErrTradeForbidden,
+		ItemErr:      ErrTradeItemNotTrading,
+		EvidenceErr:  ErrTradeNotReady,
+		ShippingErr:  ErrTradeNotReady,
+	}
+	TradeShipDone = &TradeTransition{
+		Name:          "ship_done",
+		Roles:         []TradeRole{TradeRoleSeller},
+		ItemFrom:      []string{ItemStatusTrading},
+		EvidenceFrom:  []string{TransactionEvidenceStatusWaitShipping},
+		EvidenceTo:    TransactionEvidenceStatusWaitDone,
+		ShippingTo:    []string{ShippingsStatusShipping, ShippingsStatusDone},
+		RoleErr:       ErrTradeForbidden,
+		ItemErr:       ErrTradeItemNotTrading,
+		EvidenceErr:   ErrTradeNotReady,
+		ShippingToErr: ErrTradeNotShipped,
+	}
+	TradeComplete = &TradeTransition{
+		Name:          "complete",
+		Roles:         []TradeRole{TradeRoleBuyer, TradeRoleSystem},
+		ItemFrom:      []string{ItemStatusTrading},
+		EvidenceFrom:  []string{TransactionEvidenceStatusWaitDone},
+		ItemTo:        ItemStatusSoldOut,
+		EvidenceTo:    TransactionEvidenceStatusDone,
+		ShippingTo:    []string{ShippingsStatusDone},
+		RoleErr:       ErrTradeForbidden,
+		ItemErr:       ErrTradeItemNotTrading,
+		EvidenceErr:   ErrTradeNotReady,
+		ShippingToErr: ErrTradeNotDelivered,
+	}
+	// TradeShipSync is what the shipment synchronizer does when the courier
+	// picks the parcel up before the seller calls /ship_done.
+	TradeShipSync = &TradeTransition{
+		Name:          "ship_sync",
+		Roles:         []TradeRole{TradeRoleSystem},
+		ItemFrom:      []string{ItemStatusTrading},
+		EvidenceFrom:  []string{TransactionEvidenceStatusWaitShipping},
+		ShippingFrom:  []string{ShippingsStatusWaitPickup, ShippingsStatusShipping},
+		EvidenceTo:    TransactionEvidenceStatusWaitDone,
+		ShippingTo:    []string{ShippingsStatusShipping, ShippingsStatusDone},
+		RoleErr:       ErrTradeForbidden,
+		ItemErr:       ErrTradeItemNotTrading,
+		EvidenceErr:   ErrTradeNotReady,
+		ShippingErr:   ErrTradeNotReady,
+		ShippingToErr: ErrTradeNotShipped,
+	}
+	TradeDeliverySync = &TradeTransition{
+		Name:          "delivery_sync",
+		Roles:         []TradeRole{TradeRoleSystem},
+		ItemFrom:      []string{ItemStatusTrading},
+		EvidenceFrom:  []string{TransactionEvidenceStatusWaitDone},
+		ShippingFrom:  []string{ShippingsStatusShipping},
+		ShippingTo:    []string{ShippingsStatusDone},
+		RoleErr:       ErrTradeForbidden,
+		ItemErr:       ErrTradeItemNotTrading,
+		EvidenceErr:   ErrTradeNotReady,
+		ShippingErr:   ErrTradeNotReady,
+		ShippingToErr: ErrTradeNotDelivered,
+	}
+)
+
+// TradeState holds the rows of one trade, locked with FOR UPDATE in the order
+// items, transaction_evidences, shippings.
+type TradeState struct {
+	Item                Item
+	TransactionEvidence *TransactionEvidence
+	Shipping            *Shipping
+}
+
+func lockTrade(tx *sqlx.Tx, itemID int64) (*TradeState, error) {
+	st := &TradeState{}
+
+	err := tx.Get(&st.Item, "SELECT * FROM `items` WHERE `id` = ? FOR UPDATE", itemID)
+	if err == sql.ErrNoRows {
+		return nil, ErrTradeItemNotFound
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, ErrTradeDB
+	}
+
+	transactionEvidence := TransactionEvidence{}
+	err = tx.Get(&transactionEvidence, "SELECT * FROM `transaction_evidences` WHERE `item_id` = ? FOR UPDATE", itemID)
+	if err == sql.ErrNoRows {
+		return st, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, ErrTradeDB
+	}
+	st.TransactionEvidence = &transactionEvidence
+
+	shipping := Shipping{}
+	err = tx.Get(&shipping, "SELECT * FROM `shippings` WHERE `transaction_evidence_id` = ? FOR UPDATE", transactionEvidence.ID)
+	if err == sql.ErrNoRows {
+		return st, nil
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, ErrTradeDB
+	}
+	st.Shipping = &shipping
+
+	return st, nil
+}
+
+// Role tells which side of an existing trade the user is on.
+func (st *TradeState) Role(userID int64) TradeRole {
+	if userID == st.Item.SellerID {
+		return TradeRoleSeller
+	}
+	if st.TransactionEvidence != nil && userID == st.TransactionEvidence.BuyerID {
+		return TradeRoleBuyer
+	}
+	return TradeRoleNone
+}
+
+// BuyerRole is Role for someone about to buy: anyone but the seller.
+func (st *TradeState) BuyerRole(userID int64) TradeRole {
+	if userID == st.Item.SellerID {
+		return TradeRoleSeller
+	}
+	return TradeRoleBuyer
+}
+
+func (t *TradeTransition) Check(st *TradeState, role TradeRole) error {
+	itemOK := len(t.ItemFrom) == 0 || containsStatus(t.ItemFrom, st.Item.Status)
+	if t.ItemBeforeRole && !itemOK {
+		return t.ItemErr
+	}
+
+	if !containsRole(t.Roles, role) {
+		return t.RoleErr
+	}
+
+	if !itemOK {
+		return t.ItemErr
+	}
+
+	if len(t.EvidenceFrom) > 0 {
+		if st.TransactionEvidence == nil {
+			return ErrTradeEvidenceNotFound
+		}
+		if !containsStatus(t.EvidenceFrom, st.TransactionEvidence.Status) {
+			return t.EvidenceErr
+		}
+	}
+
+	if len(t.ShippingFrom) > 0 {
+		if st.Shipping == nil {
+			return ErrTradeShippingNotFound
+		}
+		if !containsStatus(t.ShippingFrom, st.Shipping.Status) {
+			return t.ShippingErr
+		}
+	} else if len(t.EvidenceFrom) > 0 && len(t.ShippingTo) > 0 && st.Shipping == nil {
+		// an existing trade always has its shipping row
+		return ErrTradeShippingNotFound
+	}
+
+	return nil
+}
+
+// Apply writes the target statuses of every row the trade already has.
+// Transitions that create rows (buy) insert them with EvidenceTo and
+// ShippingTo themselves. shippingStatus may be empty to use the default. Each
+// row changed gets an audit event in tx, and the seller stats follow the new
+// trade status.
+func (t *TradeTransition) Apply(tx *sqlx.Tx, st *TradeState, shippingStatus string, actor AuditActor) error {
+	if st.Shipping != nil && len(t.ShippingTo) > 0 {
+		if shippingStatus == "" {
+			shippingStatus = t.ShippingTo[0]
+		}
+		if !containsStatus(t.ShippingTo, shippingStatus) {
+			return t.ShippingToErr
+		}
+	}
+
+	now := time.Now()
+	events := []AuditEvent{}
+	evidenceFrom := ""
+	if st.TransactionEvidence != nil {
+		evidenceFrom = st.TransactionEvidence.Status
+	}
+
+	if st.Shipping != nil && len(t.ShippingTo) > 0 {
+		events = append(events, AuditEvent{
+			EntityType:   AuditEntityShipping,
+			EntityID:     st.Shipping.TransactionEvidenceID,
+			StatusBefore: st.Shipping.Status,
+			StatusAfter:  shippingStatus,
+		})
+		_, err := tx.Exec("UPDATE `shippings` SET `status` = ?, `updated_at` = ? WHERE `transaction_evidence_id` = ?",
+			shippingStatus,
+			now,
+			st.Shipping.TransactionEvidenceID,
+		)
+		if err != nil {
+			log.Print(err)
+			return ErrTradeDB
+		}
+		st.Shipping.Status = shippingStatus
+		st.Shipping.UpdatedAt = now
+	}
+
+	if st.TransactionEvidence != nil && t.EvidenceTo != "" {
+		events = append(events, AuditEvent{
+			EntityType:   AuditEntityTransactionEvidence,
+			EntityID:     st.TransactionEvidence.ID,
+			StatusBefore: st.TransactionEvidence.Status,
+			StatusAfter:  t.EvidenceTo,
+		})
+		_, err := tx.Exec("UPDATE `transaction_evidences` SET `status` = ?, `updated_at` = ? WHERE `id` = ?",
+			t.EvidenceTo,
+			now,
+			st.TransactionEvidence.ID,
+		)
+		if err != nil {
+			log.Print(err)
+			return ErrTradeDB
+		}
+		st.TransactionEvidence.Status = t.EvidenceTo
+		st.TransactionEvidence.UpdatedAt = now
+	}
+
+	if t.ItemTo != "" {
+		events = append(events, AuditEvent{
+			EntityType:   AuditEntityItem,
+			EntityID:     st.Item.ID,
+			StatusBefore: st.Item.Status,
+			StatusAfter:  t.ItemTo,
+		})
+		_, err := tx.Exec("UPDATE `items` SET `buyer_id` = ?, `status` = ?, `updated_at` = ? WHERE `id` = ?",
+			st.Item.BuyerID,
+			t.ItemTo,
+			now,
+			st.Item.ID,
+		)
+		if err != nil {
+			log.Print(err)
+			return ErrTradeDB
+		}
+		st.Item.Status = t.ItemTo
+		st.Item.UpdatedAt = now
+	}
+
+	err := updateSellerStats(tx, st, evidenceFrom, now)
+	if err != nil {
+		log.Print(err)
+		return ErrTradeDB
+	}
+
+	for _, ev := range events {
+		ev.Action = t.Name
+		ev.ItemID = st.Item.ID
+		ev.UserID = tradeCounterparty(st.Item, actor)
+		err = writeAudit(tx, actor, ev, nil)
+		if err != nil {
+			log.Print(err)
+			return ErrTradeDB
+		}
+	}
+
+	return nil
+}
+
+func outputTradeError(w http.ResponseWriter, err error) {
+	if te, ok := err.(*TradeError); ok {
+		outputErrorMsg(w, te.Status, te.Msg)
+		return
+	}
+	log.Print(err)
+	outputErrorMsg(w, http.StatusInternalServerError, "db error")
+}
+
+func containsRole(roles []TradeRole, role TradeRole) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStatus(statuses []string, status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
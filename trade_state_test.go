@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestTradeTransitionCheckOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		t      *TradeTransition
+		status string
+		role   TradeRole
+		err    error
+	}{
+		{"buy", TradeBuy, ItemStatusOnSale, TradeRoleBuyer, nil},
+		{"buy own item", TradeBuy, ItemStatusOnSale, TradeRoleSeller, ErrTradeOwnItem},
+		{"buy own item not for sale", TradeBuy, ItemStatusTrading, TradeRoleSeller, ErrTradeItemNotForSale},
+		{"buy item not for sale", TradeBuy, ItemStatusSoldOut, TradeRoleBuyer, ErrTradeItemNotForSale},
+		{"ship by stranger of item not trading", TradeShip, ItemStatusOnSale, TradeRoleNone, ErrTradeForbidden},
+		{"ship item not trading", TradeShip, ItemStatusOnSale, TradeRoleSeller, ErrTradeItemNotTrading},
+	}
+	for _, tt := range tests {
+		st := &TradeState{Item: Item{Status: tt.status}}
+		if err := tt.t.Check(st, tt.role); err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
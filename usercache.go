@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultUserCacheSize = 10000
+	DefaultUserCacheTTL  = 1 * time.Minute
+
+	DefaultCacheInvalidationInterval = 1 * time.Second
+	CacheInvalidationRetention       = 1 * time.Hour
+	CacheInvalidationBatchSize       = 1000
+
+	CacheKindUser = "user"
+)
+
+type userCacheEntry struct {
+	key       int64
+	value     *UserSimple
+	expiresAt time.Time
+}
+
+// UserCache is an LRU of UserSimple whose entries also expire after TTL. The
+// TTL bounds how stale an entry can get when an invalidation from another
+// instance is lost.
+type UserCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List
+	entries  map[int64]*list.Element
+
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+}
+
+type UserCacheStats struct {
+	Size          int   `json:"size"`
+	Capacity      int   `json:"capacity"`
+	TTLSeconds    int64 `json:"ttl_seconds"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+func NewUserCache(capacity int, ttl time.Duration) *UserCache {
+	return &UserCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		entries:  map[int64]*list.Element{},
+	}
+}
+
+func (c *UserCache) Set(key int64, value *UserSimple) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*userCacheEntry)
+		e.value = value
+		e.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&userCacheEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.ll.Len() > c.capacity {
+		c.removeElement(c.ll.Back())
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+func (c *UserCache) Get(key int64) (*UserSimple, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	e := el.Value.(*userCacheEntry)
+	if !e.expiresAt.After(time.Now()) {
+		c.removeElement(el)
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	atomic.AddInt64(&c.hits, 1)
+	return e.value, true
+}
+
+func (c *UserCache) Invalidate(key int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+		atomic.AddInt64(&c.invalidations, 1)
+	}
+}
+
+func (c *UserCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.entries = map[int64]*list.Element{}
+}
+
+func (c *UserCache) Stats() UserCacheStats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+
+	return UserCacheStats{
+		Size:          size,
+		Capacity:      c.capacity,
+		TTLSeconds:    int64(c.ttl / time.Second),
+		Hits:          atomic.LoadInt64(&c.hits),
+		Misses:        atomic.LoadInt64(&c.misses),
+		Evictions:     atomic.LoadInt64(&c.evictions),
+		Invalidations: atomic.LoadInt64(&c.invalidations),
+	}
+}
+
+func (c *UserCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*userCacheEntry).key)
+}
+
+// invalidateUser drops the user from this instance's cache and tells the
+// other instances to do the same. Call it after committing any change to a
+// column UserSimple carries.
+func invalidateUser(userID int64) {
+	userSimpleCache.Invalidate(userID)
+
+	_, err := dbx.Exec("INSERT INTO `cache_invalidations` (`kind`, `key_id`) VALUES (?, ?)", CacheKindUser, userID)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+type CacheInvalidation struct {
+	ID        int64     `db:"id"`
+	Kind      string    `db:"kind"`
+	KeyID     int64     `db:"key_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// runCacheInvalidationListener applies the invalidations every instance writes
+// to cache_invalidations, including its own, which is harmless.
+func runCacheInvalidationListener(interval time.Duration) {
+	var lastID int64
+	err := dbx.Get(&lastID, "SELECT IFNULL(MAX(`id`), 0) FROM `cache_invalidations`")
+	if err != nil {
+		log.Print(err)
+	}
+
+	lastCleanup := time.Now()
+	for {
+		time.Sleep(interval)
+
+		invalidations := []CacheInvalidation{}
+		err := dbx.Select(&invalidations, "SELECT * FROM `cache_invalidations` WHERE `id` > ? ORDER BY `id` LIMIT ?", lastID, CacheInvalidationBatchSize)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		for _, inv := range invalidations {
+			switch inv.Kind {
+			case CacheKindUser:
+				userSimpleCache.Invalidate(inv.KeyID)
+			case CacheKindCategory:
+				err = prepareCategory(dbx)
+				if err != nil {
+					log.Print(err)
+				}
+			}
+			lastID = inv.ID
+		}
+
+		if len(invalidations) == 0 {
+			// the table was emptied, by /initialize for instance
+			var maxID int64
+			err = dbx.Get(&maxID, "SELECT IFNULL(MAX(`id`), 0) FROM `cache_invalidations`")
+			if err == nil && maxID < lastID {
+				lastID = maxID
+				userSimpleCache.Purge()
+			}
+		}
+
+		if time.Since(lastCleanup) > CacheInvalidationRetention {
+			// keep the last one seen so that an empty table still means a reset
+			_, err = dbx.Exec("DELETE FROM `cache_invalidations` WHERE `created_at` < ? AND `id` < ?", time.Now().Add(-CacheInvalidationRetention), lastID)
+			if err != nil {
+				log.Print(err)
+			}
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+type resCacheStats struct {
+	UserCache UserCacheStats `json:"user_cache"`
+}
+
+func getAdminCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(resCacheStats{
+		UserCache: userSimpleCache.Stats(),
+	})
+}